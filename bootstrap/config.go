@@ -0,0 +1,210 @@
+package bootstrap
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+)
+
+/*
+	Every setting is a flag.  A flag that isn't given on the command line is taken from the environment, then from the
+	YAML file named by -config, then from its default.  The environment variable for a flag is PROVISION_ followed by
+	the flag name in capitals with dots as underscores, so -kafka.brokers is PROVISION_KAFKA_BROKERS.  The YAML file
+	can nest the names or write them out in full:
+
+		loglevel: debug
+		kafka:
+		  brokers: kf01.dc1.osh.telmax.ca:9092,kf02.dc1.osh.telmax.ca:9092
+		  group: internet-olt
+		kafka.retry.attempts: 3
+*/
+
+const EnvPrefix = "PROVISION_"
+
+var (
+	ConfigFile = flag.String("config", "", "YAML file of settings - the command line and environment override it")
+	LogLevel   = flag.String("loglevel", "info", "Log level - a name, or a number from 0 (panic) to 6 (trace)")
+	Listen     = flag.String("health.listen", "", "Address:port for the health and metrics endpoints - disabled when empty")
+
+	KafkaTopic = flag.String("kafka.topic", "provisionrequest", "Kafka topics to consume from, separated by commas")
+	KafkaBrk   = flag.String("kafka.brokers", strings.Join(kafka.KafkaBrokers, ","), "Kafka brokers list separated by commas")
+	KafkaGroup = flag.String("kafka.group", "", "Kafka group id - the subsystem name when empty")
+	KafkaDLQ   = flag.String("kafka.deadletter", "provisionrequest.dlq", "Kafka topic for messages that could not be handled - empty to disable")
+	KafkaRetry = flag.String("kafka.retry", "", "Delays between retries of failed requests, each with its own retry topic - empty to disable")
+	KafkaTries = flag.Int("kafka.retry.attempts", 0, "Attempts before a failed request is parked - 0 for one more than the retry delays")
+	KafkaRedo  = flag.Bool("kafka.reprocess", false, "Handle requests again even if the ledger says they were already completed")
+	KafkaRerun = flag.Bool("kafka.replay", false, "Also consume the replay topic for this subsystem, such as provisionrequest.replay.rg")
+
+	EarlyTolerance = flag.Duration("schedule.tolerance", time.Minute, "How far ahead of its EffectiveAt a request is still accepted, for clocks that disagree")
+
+	MongoURI        = flag.String("mongo.uri", "mongodb://coredb01.dc1.osh.telmax.ca:27017", "MongoDB URL for telmax database")
+	MongoUser       = flag.String("mongo.user", "maxcoredb", "MongoDB User")
+	MongoPass       = flag.String("mongo.pass", "", "MongoDB Password - deprecated, use the mongo.password secret")
+	CoreDatabase    = flag.String("mongo.core", "telmaxmb", "Core Database name")
+	TicketDatabase  = flag.String("mongo.ticket", "maxticket", "Ticketing Database name")
+	NetworkDatabase = flag.String("mongo.network", "network", "Network Database name")
+)
+
+// The names the subsystems used before they shared their flags, so existing command lines keep working
+var renamed = map[string]string{
+	"log":             "loglevel",
+	"mongouri":        "mongo.uri",
+	"coredatabase":    "mongo.core",
+	"ticketdatabase":  "mongo.ticket",
+	"networkdatabase": "mongo.network",
+}
+
+func init() {
+	for old, name := range renamed {
+		current := flag.Lookup(name)
+		flag.Var(renamedFlag{old: old, current: current}, old, "Deprecated - use -"+name)
+	}
+}
+
+// Sets the flag it was renamed to
+type renamedFlag struct {
+	old     string
+	current *flag.Flag
+}
+
+func (renamed renamedFlag) String() string {
+	if renamed.current == nil {
+		return ""
+	}
+	return renamed.current.Value.String()
+}
+
+func (renamed renamedFlag) Set(value string) error {
+	log.Warnf("-%s is deprecated - use -%s", renamed.old, renamed.current.Name)
+	return flag.Set(renamed.current.Name, value)
+}
+
+// Change the default of a flag.  Call before Init, so the config file, environment and command line still override it.
+func Default(name string, value string) {
+	setting := flag.Lookup(name)
+	if setting == nil {
+		log.Panicf("No flag named %s", name)
+	}
+	if err := setting.Value.Set(value); err != nil {
+		log.Panicf("Bad default for %s - %v", name, err)
+	}
+	setting.DefValue = value
+}
+
+// The environment variable for a flag
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// Parse the command line, then fill in the flags it didn't set from the environment and the config file
+func loadConfig() error {
+	flag.Parse()
+	given := map[string]bool{}
+	flag.Visit(func(setting *flag.Flag) {
+		given[setting.Name] = true
+	})
+	if !given["config"] {
+		if value, ok := os.LookupEnv(EnvName("config")); ok {
+			*ConfigFile = value
+		}
+	}
+
+	file := map[string]string{}
+	if *ConfigFile != "" {
+		data, err := ioutil.ReadFile(*ConfigFile)
+		if err != nil {
+			return err
+		}
+		var settings map[string]interface{}
+		if err := yaml.Unmarshal(data, &settings); err != nil {
+			return fmt.Errorf("problem reading %s - %v", *ConfigFile, err)
+		}
+		flatten("", settings, file)
+		for name := range file {
+			if flag.Lookup(name) == nil {
+				return fmt.Errorf("unknown setting %s in %s", name, *ConfigFile)
+			}
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(setting *flag.Flag) {
+		if given[setting.Name] || setting.Name == "config" || err != nil {
+			return
+		}
+		value, ok := os.LookupEnv(EnvName(setting.Name))
+		if !ok {
+			value, ok = file[setting.Name]
+		}
+		if ok {
+			if serr := flag.Set(setting.Name, value); serr != nil {
+				err = fmt.Errorf("bad value %q for %s - %v", value, setting.Name, serr)
+			}
+		}
+	})
+	return err
+}
+
+// Turn nested YAML maps into dotted flag names.  Lists are joined with commas.
+func flatten(prefix string, settings map[string]interface{}, into map[string]string) {
+	for key, value := range settings {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flatten(name, value, into)
+		case []interface{}:
+			var items []string
+			for _, item := range value {
+				items = append(items, fmt.Sprint(item))
+			}
+			into[name] = strings.Join(items, ",")
+		case nil:
+			into[name] = ""
+		default:
+			into[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// Split a comma separated list, dropping the spaces around each item
+func split(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Set the log level from a name like "debug", or from the number the old -log flag took
+func setLogLevel(level string) {
+	if number, err := strconv.Atoi(level); err == nil {
+		if number < 0 {
+			number = 0
+		}
+		if number > 6 {
+			number = 6
+		}
+		log.SetLevel(log.Level(number))
+		return
+	}
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		log.Warnf("Unknown log level %s - using info", level)
+		lvl = log.InfoLevel
+	}
+	log.SetLevel(lvl)
+}
@@ -0,0 +1,123 @@
+package bootstrap
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Consistent response structure - error only exists if there is an error.  Status is always "ok" or "error"
+type Response struct {
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Add a readiness check.  The service isn't ready while any check returns an error.
+func (service *Service) Check(name string, fn func(ctx context.Context) error) {
+	service.checks[name] = fn
+}
+
+// Run every readiness check, returning the failures by name
+func (service *Service) Ready(ctx context.Context) map[string]string {
+	failed := map[string]string{}
+	if atomic.LoadInt32(&service.running) == 0 {
+		failed["consumer"] = "not running"
+	}
+	if service.Bus == nil {
+		failed["kafka"] = "not connected"
+	} else if err := service.Bus.Ping(); err != nil {
+		failed["kafka"] = err.Error()
+	}
+	if service.Mongo {
+		if service.MongoClient == nil {
+			failed["mongo"] = "not connected"
+		} else if err := service.MongoClient.Ping(ctx, nil); err != nil {
+			failed["mongo"] = err.Error()
+		}
+	}
+	if service.DhcpDB != nil {
+		if err := service.DhcpDB.PingContext(ctx); err != nil {
+			failed["sql"] = err.Error()
+		}
+	}
+	for name, check := range service.checks {
+		if err := check(ctx); err != nil {
+			failed[name] = err.Error()
+		}
+	}
+	return failed
+}
+
+// A readiness check that a backend accepts connections.  The address is host:port, or a URL with the port taken from
+// the scheme if it doesn't give one.
+func Reachable(address string) func(ctx context.Context) error {
+	if parsed, err := url.Parse(address); err == nil && parsed.Host != "" {
+		address = parsed.Host
+		if parsed.Port() == "" {
+			port := "80"
+			if parsed.Scheme == "https" {
+				port = "443"
+			}
+			address = net.JoinHostPort(parsed.Hostname(), port)
+		}
+	}
+	return func(ctx context.Context) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// Start the health and metrics endpoints if there is an address to listen on
+func (service *Service) serveHealth() *http.Server {
+	if *Listen == "" {
+		return nil
+	}
+	router := mux.NewRouter().StrictSlash(false)
+	router.HandleFunc("/healthz", service.handleHealth).Methods("GET")
+	router.HandleFunc("/readyz", service.handleReady).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	server := &http.Server{Addr: *Listen, Handler: router}
+	go func() {
+		log.Infof("Health and metrics endpoints listening on %s", *Listen)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Errorf("Health endpoints stopped - %v", err)
+		}
+	}()
+	return server
+}
+
+// GET /healthz - the process is up
+func (service *Service) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeResponse(w, http.StatusOK, Response{Status: "ok", Data: service.Name})
+}
+
+// GET /readyz - the consumer is running and everything it depends on can be reached
+func (service *Service) handleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if failed := service.Ready(ctx); len(failed) > 0 {
+		writeResponse(w, http.StatusServiceUnavailable, Response{Status: "error", Error: "not ready", Data: failed})
+		return
+	}
+	writeResponse(w, http.StatusOK, Response{Status: "ok", Data: service.Name})
+}
+
+func writeResponse(w http.ResponseWriter, code int, response Response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,326 @@
+package bootstrap
+
+/*
+	The start up and shut down every provisioning subsystem shares.  A subsystem creates a Service, registers the
+	handler for the request types it deals with and any hooks it needs, then calls Init and Run from main().  Init
+	isn't called from init(), so tests can load the package without connecting to anything:
+
+		var Service = bootstrap.New("rg")
+
+		func setup() {
+			Service.Init()
+			Bus = Service.Bus
+			CoreDB = Service.CoreDB
+		}
+
+		func main() {
+			setup()
+			Service.Handle(HandleProvision, telmaxprovision.RequestNew, telmaxprovision.RequestCancel)
+			Service.Run()
+		}
+*/
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"bitbucket.org/telmaxdc/telmax-common"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"bitbucket.org/telmaxdc/telmax-provision/dhcpdb"
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+	"bitbucket.org/telmaxdc/telmax-provision/tickets"
+)
+
+// Handles a valid provision request of one of the types it was registered for
+type RequestHandler func(ctx context.Context, request telmaxprovision.ProvisionRequest) error
+
+// A provisioning subsystem and the connections it works with
+type Service struct {
+	Name  string // Used as the System on exceptions, and as the Kafka group unless one is set
+	Mongo bool   // Connect to Mongo - on unless turned off before Init
+	SQL   bool   // Connect to the DHCP SQL database
+	Early bool   // Take requests before their EffectiveAt - only the scheduler should
+
+	Bus         *kafka.Client
+	MongoClient *mongo.Client
+	CoreDB      *mongo.Database
+	TicketDB    *mongo.Database
+	NetDB       *mongo.Database
+	DhcpDB      *sql.DB
+	TZLocation  *time.Location
+
+	handler RequestHandler
+	planner RequestHandler
+	raw     kafka.HandlerFunc
+	types   map[telmaxprovision.RequestType]bool
+	setup   []func() error
+	start   []func(ctx context.Context) error
+	stop    []func()
+	reload  []func()
+	checks  map[string]func(ctx context.Context) error
+	running int32 // Set while the consumer is running
+}
+
+func New(name string) *Service {
+	return &Service{
+		Name:   name,
+		Mongo:  true,
+		types:  map[telmaxprovision.RequestType]bool{},
+		checks: map[string]func(ctx context.Context) error{},
+	}
+}
+
+// Send requests of the given types to the handler.  Other request types are skipped.
+func (service *Service) Handle(handler RequestHandler, types ...telmaxprovision.RequestType) {
+	service.handler = handler
+	for _, requestType := range types {
+		service.types[requestType] = true
+	}
+}
+
+// Send dry run requests of the registered types to the planner instead of the handler.  The planner must not change
+// anything - it reports what the handler would do as planned results.
+func (service *Service) HandlePlan(planner RequestHandler) {
+	service.planner = planner
+}
+
+// Take every message as it comes off the topics instead of opening provision requests - for services that consume
+// results or exceptions.  Handle and HandlePlan are ignored.
+func (service *Service) HandleMessages(handler kafka.HandlerFunc) {
+	service.raw = handler
+}
+
+// Run fn once the config is loaded and the databases are connected, before Kafka is.  An error stops the service.
+func (service *Service) OnSetup(fn func() error) {
+	service.setup = append(service.setup, fn)
+}
+
+// Run fn just before consuming starts.  The context ends when the service is told to stop.
+func (service *Service) OnStart(fn func(ctx context.Context) error) {
+	service.start = append(service.start, fn)
+}
+
+// Run fn once consuming has stopped, before the connections are closed.  Stop hooks run in reverse order.
+func (service *Service) OnStop(fn func()) {
+	service.stop = append(service.stop, fn)
+}
+
+// Run fn on SIGHUP, for config a subsystem reads from its own files.  Secrets are read again on SIGHUP as well.
+func (service *Service) OnReload(fn func()) {
+	service.reload = append(service.reload, fn)
+}
+
+// Load the config, set up logging and connect to the databases and Kafka.  Exits if anything fails.
+func (service *Service) Init() {
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Problem loading config - %v", err)
+	}
+	setLogLevel(*LogLevel)
+	if err := secrets.Load(); err != nil {
+		log.Fatalf("Problem loading secrets - %v", err)
+	}
+	service.TZLocation, _ = time.LoadLocation("America/Toronto")
+
+	if service.Mongo {
+		service.MongoClient = telmax.DBConnect(*MongoURI, *MongoUser, secrets.Get("mongo.password", *MongoPass))
+		if service.MongoClient != nil {
+			service.CoreDB = service.MongoClient.Database(*CoreDatabase)
+			service.TicketDB = service.MongoClient.Database(*TicketDatabase)
+			service.NetDB = service.MongoClient.Database(*NetworkDatabase)
+		} else {
+			log.Error("Could not connect to Mongo")
+		}
+	}
+	if service.SQL {
+		var err error
+		service.DhcpDB, err = dhcpdb.Connect()
+		if err != nil {
+			log.Fatalf("Failed to connect to the DHCP database - %v", err)
+		}
+	}
+	for _, setup := range service.setup {
+		if err := setup(); err != nil {
+			log.Fatalf("Problem setting up %s - %v", service.Name, err)
+		}
+	}
+
+	topics := split(*KafkaTopic)
+	if len(topics) < 1 {
+		log.Fatalf("no Kafka topics!")
+	}
+	var err error
+	service.Bus, err = kafka.Connect(split(*KafkaBrk))
+	if err != nil {
+		log.Fatalf("Failed to connect to Kafka - %v", err)
+	}
+	service.Bus.DeadLetterTopic = *KafkaDLQ
+	if service.CoreDB != nil {
+		service.Bus.UseLedger(service.CoreDB)
+		// Requests we send get their sequence numbers from the same counters as every other producer's
+		service.Bus.UseSequences(service.CoreDB)
+	}
+	if service.TicketDB != nil {
+		service.Bus.Tickets = tickets.NewWriter(service.TicketDB, service.Name)
+	}
+	service.Bus.ForceReprocess = *KafkaRedo
+	service.Bus.RetryTiers, err = kafka.ParseRetryTiers(topics[0], *KafkaRetry)
+	if err != nil {
+		log.Fatalf("Problem with retry delays - %v", err)
+	}
+	service.Bus.RetryMaxAttempts = *KafkaTries
+	if *KafkaRerun {
+		service.Bus.ReplayTopic = kafka.ReplayTopic(topics[0], service.Name)
+		log.Infof("Consuming replayed requests from %v", service.Bus.ReplayTopic)
+	}
+}
+
+// The Kafka group to consume as
+func (service *Service) Group() string {
+	if *KafkaGroup != "" {
+		return *KafkaGroup
+	}
+	return service.Name
+}
+
+// Consume requests until a quit signal, then finish the requests in progress, run the stop hooks and close
+// everything.  Exits 0 on a clean stop.
+func (service *Service) Run() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	secrets.Watch(ctx)
+	service.watchReload(ctx)
+
+	server := service.serveHealth()
+	var err error
+	for _, start := range service.start {
+		if err = start(ctx); err != nil {
+			log.Errorf("Problem starting %s - %v", service.Name, err)
+			break
+		}
+	}
+	if err == nil {
+		handler := service.MessageHandler
+		if service.raw != nil {
+			handler = service.raw
+		}
+		atomic.StoreInt32(&service.running, 1)
+		err = service.Bus.Consume(ctx, split(*KafkaTopic), service.Group(), handler)
+		atomic.StoreInt32(&service.running, 0)
+		if err != nil {
+			log.Errorf("Consumer stopped - %v", err)
+		}
+	}
+
+	log.Error("Stopping Application")
+	for i := len(service.stop) - 1; i >= 0; i-- {
+		service.stop[i]()
+	}
+	if server != nil {
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		server.Shutdown(shutdown)
+		cancel()
+	}
+	service.Close()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// Run the reload hooks on SIGHUP until the context is done
+func (service *Service) watchReload(ctx context.Context) {
+	if len(service.reload) == 0 {
+		return
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				log.Warningf("Reloading %s config", service.Name)
+				for _, reload := range service.reload {
+					reload()
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Close the connections to Kafka and the databases
+func (service *Service) Close() {
+	if service.Bus != nil {
+		service.Bus.Close()
+		// Finish writing to tickets before the database goes
+		service.Bus.Tickets.Stop()
+	}
+	if service.MongoClient != nil {
+		service.MongoClient.Disconnect(context.TODO())
+	}
+	if service.DhcpDB != nil {
+		service.DhcpDB.Close()
+	}
+}
+
+// Open and validate each request, and pass the ones of our types to the handler
+func (service *Service) MessageHandler(ctx context.Context, topic string, timestamp time.Time, data []byte) error {
+	log.Infof("Kafka message %v, %v, %v", topic, timestamp, string(data))
+	//	Open the message envelope and upgrade the request to the current schema
+	request, _, err := telmaxprovision.OpenRequest(data)
+	if err != nil {
+		log.Warnf("unmarshaling error: %v", err)
+		return err
+	}
+	// Whatever we send about the request from here on goes on its ticket
+	service.Bus.Tickets.Open(request)
+	defer service.Bus.Tickets.Close(request.RequestID)
+	if verr := request.Validate(); len(verr) > 0 {
+		metrics.RequestsConsumed.WithLabelValues("invalid").Inc()
+		log.Warnf("invalid provision request %v - %v", request.RequestID, verr)
+		service.Bus.SubmitException(verr.Exception(request, service.Name))
+		return verr
+	}
+	metrics.RequestsConsumed.WithLabelValues(string(request.RequestType)).Inc()
+	if !service.types[request.RequestType] || service.handler == nil {
+		log.Debugf("Skipping %v request %v", request.RequestType, request.RequestID)
+		return nil
+	}
+	if !service.Early && !request.Due(time.Now().Add(*EarlyTolerance)) {
+		// Should have gone to the scheduler - don't act on it, but park it so it can be re-driven
+		err := fmt.Errorf("request is not effective until %v", request.EffectiveAt.Format(time.RFC3339))
+		log.Warnf("Rejecting early request %v - %v", request.RequestID, err)
+		exception := request.NewException(service.Name)
+		exception.Reference = request.RequestID
+		exception.ReferenceType = "RequestID"
+		exception.Tag = "Early Request"
+		exception.Error = err.Error()
+		service.Bus.SubmitException(exception)
+		return err
+	}
+	log.Debug(request)
+	if request.DryRun {
+		if service.planner == nil {
+			// Never fall through to the handler - a dry run must not change anything
+			log.Warnf("Ignoring dry run request %v - %s can't plan requests", request.RequestID, service.Name)
+			result := request.NewResult()
+			result.Result = service.Name + " does not support dry runs - nothing planned"
+			service.Bus.SubmitResult(result)
+			return nil
+		}
+		return service.planner(ctx, request)
+	}
+	return service.handler(ctx, request)
+}
@@ -0,0 +1,150 @@
+package bootstrap
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// A handler like a subsystem's HandleProvision - it reports each request as a result and fails the ones it is told to
+func testHandler(bus *kafka.Client) RequestHandler {
+	return func(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
+		result := request.NewResult()
+		switch request.AccountCode {
+		case "RETRY":
+			result.Result = "backend busy"
+			bus.SubmitResult(result)
+			return kafka.Retryable(errors.New("backend busy"))
+		case "FAIL":
+			result.Result = "no such subscriber"
+			bus.SubmitResult(result)
+			return errors.New("no such subscriber")
+		}
+		result.Success = true
+		result.Result = "provisioned"
+		bus.SubmitResult(result)
+		return nil
+	}
+}
+
+// Requests go through the consumer and MessageHandler to the handler, and its results, exceptions and failures come
+// out on the right topics
+func TestProvisionFlow(t *testing.T) {
+	broker := kafka.NewMemoryBroker()
+	defer broker.Close()
+	service := New("test")
+	service.Bus = kafka.NewClient(broker)
+	service.Bus.DeadLetterTopic = "provisionrequest.dlq"
+	service.Bus.RetryTiers, _ = kafka.ParseRetryTiers("provisionrequest", "1h")
+	service.Handle(testHandler(service.Bus), telmaxprovision.RequestNew)
+
+	request := func(account string, requestType telmaxprovision.RequestType) telmaxprovision.ProvisionRequest {
+		return telmaxprovision.ProvisionRequest{AccountCode: account, SubscribeCode: "SUBS001", RequestType: requestType}
+	}
+	submitted := map[string]string{} // RequestID by account
+	for _, r := range []telmaxprovision.ProvisionRequest{
+		request("OK", telmaxprovision.RequestNew),
+		request("FAIL", telmaxprovision.RequestNew),
+		request("RETRY", telmaxprovision.RequestNew),
+		request("SKIP", telmaxprovision.RequestCancel), // Not a type we handle
+		request("", telmaxprovision.RequestNew),        // Invalid
+	} {
+		id, err := service.Bus.SubmitRequest(r)
+		if err != nil {
+			t.Fatalf("SubmitRequest: %v", err)
+		}
+		submitted[r.AccountCode] = id
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- service.Bus.Consume(ctx, []string{"provisionrequest"}, service.Group(), service.MessageHandler)
+	}()
+	if !broker.WaitIdle([]string{"provisionrequest"}, service.Group(), 5*time.Second) {
+		t.Fatal("requests were not all consumed")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Consume: %v", err)
+	}
+
+	results := map[string]telmaxprovision.ProvisionResult{}
+	for _, message := range broker.Messages("provisionresult") {
+		result, _, err := telmaxprovision.OpenResult(message.Value)
+		if err != nil {
+			t.Fatalf("OpenResult: %v", err)
+		}
+		results[result.RequestID] = result
+	}
+	if len(results) != 3 {
+		t.Errorf("%d results, want one each for OK, FAIL and RETRY", len(results))
+	}
+	if result := results[submitted["OK"]]; !result.Success || result.Result != "provisioned" {
+		t.Errorf("result for OK = %+v", result)
+	}
+	if _, ok := results[submitted["SKIP"]]; ok {
+		t.Error("a request type that isn't handled got a result")
+	}
+
+	// The handler's failure and the invalid request are parked, and the retryable failure waits on the retry tier
+	parked := map[string]bool{}
+	for _, message := range broker.Messages("provisionrequest.dlq") {
+		request, _, _ := telmaxprovision.OpenRequest(message.Value)
+		parked[request.RequestID] = true
+	}
+	if len(parked) != 2 || !parked[submitted["FAIL"]] || !parked[submitted[""]] {
+		t.Errorf("parked %v, want FAIL and the invalid request", parked)
+	}
+	retries := broker.Messages("provisionrequest.retry.1h")
+	if len(retries) != 1 || retries[0].Header(kafka.HeaderConsumerGroup) != service.Group() {
+		t.Errorf("retries = %v, want the RETRY request", retries)
+	}
+
+	exceptions := broker.Messages("provisionexception")
+	if len(exceptions) != 1 {
+		t.Fatalf("%d exceptions, want one for the invalid request", len(exceptions))
+	}
+	exception, _, _ := telmaxprovision.OpenException(exceptions[0].Value)
+	if exception.Tag != "Invalid Request" || exception.System != "test" {
+		t.Errorf("exception = %+v", exception)
+	}
+}
+
+// A request that isn't due yet is refused and parked, so it can be re-driven once it is
+func TestEarlyRequest(t *testing.T) {
+	broker := kafka.NewMemoryBroker()
+	service := New("test")
+	service.Bus = kafka.NewClient(broker)
+	handled := false
+	service.Handle(func(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
+		handled = true
+		return nil
+	}, telmaxprovision.RequestNew)
+	request := telmaxprovision.ProvisionRequest{
+		RequestID:     "req-1",
+		AccountCode:   "ACCT0001",
+		SubscribeCode: "SUBS001",
+		RequestType:   telmaxprovision.RequestNew,
+		EffectiveAt:   time.Now().Add(time.Hour),
+	}
+	data, _ := telmaxprovision.Seal(telmaxprovision.MessageRequest, "test", request)
+	if err := service.MessageHandler(context.Background(), "provisionrequest", time.Now(), data); err == nil {
+		t.Error("expected an early request to be refused")
+	}
+	if handled {
+		t.Error("early request was handled")
+	}
+	if exceptions := broker.Messages("provisionexception"); len(exceptions) != 1 {
+		t.Errorf("%d exceptions, want one", len(exceptions))
+	}
+
+	service.Early = true
+	if err := service.MessageHandler(context.Background(), "provisionrequest", time.Now(), data); err != nil || !handled {
+		t.Errorf("an Early service should take the request - %v", err)
+	}
+}
@@ -12,40 +12,57 @@ import (
 	log "github.com/sirupsen/logrus"
 	"net"
 	"strconv"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 )
 
 var (
 	SQL     *sql.DB
 	SQLHost = flag.String("dhcpdb.host", "dhcp04.tor2.telmax.ca", "DHCP SQL hostname")
+	SQLUser = flag.String("dhcpdb.user", "provisioning", "DHCP SQL Username")
+	SQLPass = flag.String("dhcpdb.pass", "", "DHCP SQL Password - deprecated, use the dhcpdb.password secret")
 )
 
-// Connect to the SQL database that stores the leases and reservations
-func SQLConnect() *sql.DB {
+// Open a connection to the SQL database that stores the leases and reservations, and check it works
+func Connect() (*sql.DB, error) {
 	s := sqlServer{
 		Hostname: *SQLHost,
-		Username: "provisioning",
-		Password: "telMAXProv720",
+		Username: *SQLUser,
+		Password: secrets.Get("dhcpdb.password", *SQLPass),
 	}
 	d := "dhcp"
 	connect_str := s.Username + ":" + s.Password + "@tcp(" + s.Hostname + ":3306)/" + d
 	db, err := sql.Open("mysql", connect_str)
 	if err != nil {
-		log.Fatal(err)
-		panic(err.Error())
+		return nil, err
 	}
 	err = db.Ping()
 	if err != nil {
-		log.Fatal(err)
-		panic(err.Error())
+		db.Close()
+		return nil, err
 	}
 	log.Info("Connected to SQL server - using database " + d)
+	return db, nil
+}
+
+// Connect to the SQL database that stores the leases and reservations
+func SQLConnect() *sql.DB {
+	db, err := Connect()
+	if err != nil {
+		log.Fatal(err)
+	}
 	return db
 }
 
 // Assigns an address from the named pool and returns the address object and the success of the operation.  Will return existing allocation if already assigned.
 //
 func DhcpAssign(node string, pool string, subs string) (reservation Reservation, err error) {
-	db := SQLConnect()
+	defer metrics.Backend("dhcpdb", "assign").Done(&err)
+	db, err := Connect()
+	if err != nil {
+		return
+	}
 	defer db.Close()
 	ctx := context.TODO()
 	dhcpid := subs
@@ -80,9 +97,42 @@ func DhcpAssign(node string, pool string, subs string) (reservation Reservation,
 
 }
 
+// Find the address DhcpAssign would give the subscriber, without assigning it.  Existing is true if the subscriber
+// already has it.
+func DhcpPlan(node string, pool string, subs string) (reservation Reservation, existing bool, err error) {
+	defer metrics.Backend("dhcpdb", "plan").Done(&err)
+	ctx := context.TODO()
+	reservation, err = dhcpGetAssign(ctx, subs, pool)
+	if err != nil && err.Error() != "DHCP allocation not found!" {
+		return
+	} else if reservation.HostID != 0 {
+		return reservation, true, nil
+	}
+	db, err := Connect()
+	if err != nil {
+		return
+	}
+	defer db.Close()
+	var v4address string
+	row := db.QueryRowContext(ctx, `select host_id,pool,node,vlan,inet_ntoa(ipv4_address) from hosts where node= ? AND pool= ? AND status='Available' order by host_id limit 1`, node, pool)
+	err = row.Scan(&reservation.HostID, &reservation.Pool, &reservation.Node, &reservation.VlanID, &v4address)
+	if err == sql.ErrNoRows {
+		err = errors.New("No addresses available in pool " + pool + " on node " + node)
+		return
+	} else if err != nil {
+		return
+	}
+	reservation.V4Addr = net.ParseIP(v4address)
+	return
+}
+
 // Release a specific address
 func DhcpRelease(node string, pool string, subs string) (success bool, err error) {
-	db := SQLConnect()
+	defer metrics.Backend("dhcpdb", "release").Done(&err)
+	db, err := Connect()
+	if err != nil {
+		return
+	}
 	defer db.Close()
 	ctx := context.TODO()
 	//	dhcpid := subs
@@ -106,18 +156,24 @@ func DhcpRelease(node string, pool string, subs string) (success bool, err error
 }
 
 // Release all addresses assigned to a given subscriber.  Handy if they cancel and you want to clean up
-func DhcpReleaseAll(subs string) error {
+func DhcpReleaseAll(subs string) (err error) {
+	defer metrics.Backend("dhcpdb", "releaseall").Done(&err)
 	ctx := context.TODO()
-	db := SQLConnect()
+	db, err := Connect()
+	if err != nil {
+		return
+	}
 	defer db.Close()
 	log.Info("Releasing reservations for subscriber " + subs)
 
 	result, err := db.ExecContext(ctx, `update hosts set dhcp_identifier = null, hostname="", subscriber='unassigned', status='Available' where subscriber=?`, subs)
-
-	rows, _ := result.RowsAffected()
 	if err != nil {
 		log.Info("Problem assigning IP address")
-	} else if rows > 0 {
+		return err
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows > 0 {
 		log.Info("Released %v resources", rows)
 	} else {
 		log.Info("No address resources to release!")
@@ -127,7 +183,10 @@ func DhcpReleaseAll(subs string) error {
 
 // Get a specific reservation with a subscriber ID and a pool name
 func dhcpGetAssign(ctx context.Context, subs string, pool string) (reservation Reservation, err error) {
-	db := SQLConnect()
+	db, err := Connect()
+	if err != nil {
+		return
+	}
 	defer db.Close()
 	log.Info("requesting reservation for subscriber " + subs + " in pool " + pool)
 
@@ -157,9 +216,11 @@ func dhcpGetAssign(ctx context.Context, subs string, pool string) (reservation R
 		//		reservation.V4Addr = ipint.Int2ip(uint32(v4address))
 		reservation.V4Addr = net.ParseIP(v4address)
 		sqlQuery = `select reservation_id,address,prefix_len,type,dhcp6_iaid,host_id from ipv6_reservations where host_id=?`
-		rows, err := db.QueryContext(ctx, sqlQuery, hostidstr)
+		var rows *sql.Rows
+		rows, err = db.QueryContext(ctx, sqlQuery, hostidstr)
 		if err != nil {
-			log.Fatal(err)
+			log.Errorf("Problem getting IPv6 reservations %v", err)
+			return
 		}
 		var v6res ipv6Reservation
 		var iaid sql.NullInt32
@@ -168,8 +229,9 @@ func dhcpGetAssign(ctx context.Context, subs string, pool string) (reservation R
 		defer rows.Close()
 		for rows.Next() {
 			log.Info("found ipv6 reservation")
-			if err := rows.Scan(&v6res.ResID, &ip6address, &v6res.Length, &v6res.Type, &iaid, &v6res.HostID); err != nil {
-				log.Fatal(err)
+			if err = rows.Scan(&v6res.ResID, &ip6address, &v6res.Length, &v6res.Type, &iaid, &v6res.HostID); err != nil {
+				log.Errorf("Problem reading IPv6 reservation %v", err)
+				return
 			} else {
 				v6res.Address = net.ParseIP(ip6address)
 				if iaid.Valid {
@@ -7,6 +7,8 @@ import (
 	_ "github.com/go-sql-driver/mysql"
 	log "github.com/sirupsen/logrus"
 	"ipint"
+
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 )
 
 var (
@@ -25,7 +27,7 @@ func SQLConnect() *sql.DB {
 	s := sqlServer{
 		Hostname: "dhcp01.lab.dc1.osh.telmax.ca",
 		Username: "provisioning",
-		Password: "telMAXProv720",
+		Password: secrets.Get("dhcpdb.password", ""),
 	}
 	d := "dhcp"
 	connect_str := s.Username + ":" + s.Password + "@tcp(" + s.Hostname + ":3306)/" + d
@@ -47,6 +49,9 @@ func init() {
 	flag.Parse()
 	lvl, _ := log.ParseLevel(*LogLevel)
 	log.SetLevel(lvl)
+	if err := secrets.Load(); err != nil {
+		log.Fatalf("Problem loading secrets - %v", err)
+	}
 	SQL = SQLConnect
 }
 
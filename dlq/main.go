@@ -0,0 +1,149 @@
+package main
+
+/*
+	Inspect the provisioning dead letter topic, and re-drive parked messages back to the topic they came from.
+
+	List everything:	dlq
+	Only one group:		dlq -group eero
+	Re-drive a message:	dlq -partition 0 -offset 42 -redrive
+	Force a redo:		dlq -requestid <id> -redrive -reprocess
+*/
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	LogLevel  = flag.String("loglevel", "warn", "Log Level")
+	KafkaBrk  = flag.String("kafka.brokers", "kfk01.tor2.telmax.ca:9092", "Kafka brokers list separated by commas")
+	KafkaDLQ  = flag.String("kafka.deadletter", "provisionrequest.dlq", "Dead letter topic to read")
+	Group     = flag.String("group", "", "Only messages that failed in this consumer group")
+	RequestID = flag.String("requestid", "", "Only messages for this RequestID")
+	Partition = flag.Int("partition", -1, "Only messages in this dead letter partition")
+	Offset    = flag.Int64("offset", -1, "Only the message at this dead letter offset")
+	Redrive   = flag.Bool("redrive", false, "Re-publish the selected messages to their original topic")
+	Target    = flag.String("target", "", "Re-drive to this topic instead of the original topic")
+	Reprocess = flag.Bool("reprocess", false, "Have the re-driven messages handled even if the ledger says they were completed")
+	ShowValue = flag.Bool("value", false, "Print the message value")
+)
+
+func main() {
+	flag.Parse()
+	lvl, _ := log.ParseLevel(*LogLevel)
+	log.SetLevel(lvl)
+	if err := secrets.Load(); err != nil {
+		log.Fatalf("Problem loading secrets - %v", err)
+	}
+	brokers := strings.Split(*KafkaBrk, ",")
+
+	var bus *kafka.Client
+	if *Redrive {
+		var err error
+		bus, err = kafka.Connect(brokers)
+		if err != nil {
+			log.Fatalf("Failed to connect to Kafka - %v", err)
+		}
+		defer bus.Close()
+	}
+	var count, redriven int
+	err := kafka.ScanTopic(brokers, *KafkaDLQ, func(message *kafka.Message) error {
+		if !selected(message) {
+			return nil
+		}
+		count++
+		printMessage(message)
+		if *Redrive {
+			err := redrive(bus, message)
+			if err != nil {
+				return err
+			}
+			redriven++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Problem reading dead letter topic %v - %v", *KafkaDLQ, err)
+	}
+	fmt.Printf("%d messages selected, %d re-driven\n", count, redriven)
+}
+
+// Apply the command line filters
+func selected(message *kafka.Message) bool {
+	if *Partition >= 0 && message.Partition != int32(*Partition) {
+		return false
+	}
+	if *Offset >= 0 && message.Offset != *Offset {
+		return false
+	}
+	if *Group != "" && message.Header(kafka.HeaderConsumerGroup) != *Group {
+		return false
+	}
+	if *RequestID != "" && requestID(message) != *RequestID {
+		return false
+	}
+	return true
+}
+
+// Pull the RequestID out of whatever sort of provisioning message this is
+func requestID(message *kafka.Message) string {
+	if request, _, err := telmaxprovision.OpenRequest(message.Value); err == nil {
+		return request.RequestID
+	}
+	if result, _, err := telmaxprovision.OpenResult(message.Value); err == nil {
+		return result.RequestID
+	}
+	if exception, _, err := telmaxprovision.OpenException(message.Value); err == nil {
+		return exception.RequestID
+	}
+	return ""
+}
+
+func printMessage(message *kafka.Message) {
+	fmt.Printf("%d/%d\t%s\tgroup=%s from=%s/%s/%s request=%s\n\terror: %s\n",
+		message.Partition, message.Offset,
+		message.Header(kafka.HeaderFailedTime),
+		message.Header(kafka.HeaderConsumerGroup),
+		message.Header(kafka.HeaderOriginalTopic),
+		message.Header(kafka.HeaderOriginalPartition),
+		message.Header(kafka.HeaderOriginalOffset),
+		requestID(message),
+		message.Header(kafka.HeaderError))
+	if *ShowValue {
+		fmt.Printf("\t%s\n", string(message.Value))
+	}
+}
+
+// Send the message back to where it came from, marked with where it was parked
+func redrive(bus *kafka.Client, message *kafka.Message) error {
+	topic := *Target
+	if topic == "" {
+		topic = message.Header(kafka.HeaderOriginalTopic)
+	}
+	if topic == "" {
+		return errors.New("message has no original topic - use -target")
+	}
+	republish := kafka.Message{
+		Topic: topic,
+		Key:   message.Key,
+		Value: message.Value,
+	}
+	republish.SetHeader(kafka.HeaderRedriven, *KafkaDLQ+"/"+strconv.Itoa(int(message.Partition))+"/"+strconv.FormatInt(message.Offset, 10))
+	if *Reprocess {
+		republish.SetHeader(kafka.HeaderReprocess, "true")
+	}
+	err := bus.Transport.Publish(&republish)
+	if err != nil {
+		return err
+	}
+	log.Infof("Re-drove %v/%v to %v partition %v offset %v", message.Partition, message.Offset, topic, republish.Partition, republish.Offset)
+	return nil
+}
@@ -1,42 +1,45 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	"bitbucket.org/telmaxdc/telmax-common/lab"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
 )
 
 // auditDaemon learns about the network then periodically checks to see if there
 // are any actions that must be taken
 // refreshing its database every hour
 // and performing daily tasks during off-peak hours
-func auditDaemon() {
-	//start := time.Now()
+// until the context is done
+func auditDaemon(ctx context.Context) {
 	eeroApi.UpdateEeroDatabase() // run on init
-	for {                        // forever
-		lastDay := time.Now()
-		for { // day timer
-			lastHour := time.Now()
-			for { // hour timer
-				if time.Since(lastHour) > time.Duration(60*time.Minute) {
-					eeroApi.UpdateEeroDatabase()
-					eeroApi.UpdateMissingNetworkLabels(CoreDB, DhcpDB)
-					eeroApi.TransferNetworks(CoreDB)
-					break
-				}
-			}
-			// more than 24 hours since last time but only in off-peak hours window
-			if time.Since(lastDay) > time.Duration(24*time.Hour) && lab.OffHours() {
-				eeroApi.UntransferPendingNetworks()
-				eeroApi.FirmwareUpdateNetworks()
-				eeroApi.LatestSpeedTests()
-				eeroApi.RemoveDerelictNetworks()
-				break
-			}
+	lastDay := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(60 * time.Minute):
+		}
+		timer := metrics.Backend("eero", "audit")
+		eeroApi.UpdateEeroDatabase()
+		eeroApi.UpdateMissingNetworkLabels(CoreDB, DhcpDB)
+		eeroApi.TransferNetworks(CoreDB)
+		timer.Done(nil)
+
+		// more than 24 hours since last time but only in off-peak hours window
+		if time.Since(lastDay) > time.Duration(24*time.Hour) && lab.OffHours() {
+			timer := metrics.Backend("eero", "audit_daily")
+			eeroApi.UntransferPendingNetworks()
+			eeroApi.FirmwareUpdateNetworks()
+			eeroApi.LatestSpeedTests()
+			eeroApi.RemoveDerelictNetworks()
+			timer.Done(nil)
+			lastDay = time.Now()
 		}
 		// TODO
 		// send results to zabbix
-		// expose metrics
-		// graceful shutdown
 	}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
@@ -12,47 +13,56 @@ import (
 	"bitbucket.org/telmaxdc/telmax-common/maxbill"
 	"bitbucket.org/telmaxnate/eero"
 
-	"bitbucket.org/timstpierre/telmax-provision/kafka"
-	telmaxprovision "bitbucket.org/timstpierre/telmax-provision/structs"
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
 )
 
-// for retries on failures
-var sleepTimer = time.Duration(60)
 var networkPrefix = "https://dashboard.eero.com/networks/"
 
-func HandleProvision(request telmaxprovision.ProvisionRequest) {
+// Returns an error if the request could not be completed.  Retryable errors are tried again later from the retry
+// topics, anything else is parked on the dead letter topic.
+func HandleProvision(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
 
 	switch request.RequestType {
-	case "New":
+	case telmaxprovision.RequestNew:
 		// add one or more device and create a new network
 		log.Info("Eero Handler inspecting New Device request")
-		// put a guard on the number of loops... for now
-		for n := 0; n < 3; n++ {
-			if NewEero(request) {
-				break
-			}
-			log.Debugf("Sleeping for %d seconds\n", sleepTimer)
-			// if provision is not successful, sleep and retry
-			time.Sleep(sleepTimer * time.Second)
+		// The devices often aren't online yet when the order comes through, so try again later rather than giving up
+		if !NewEero(request) {
+			return kafka.Retryable(fmt.Errorf("could not provision Eeros for %s-%s", request.AccountCode, request.SubscribeCode))
 		}
-	case "Update":
+	case telmaxprovision.RequestUpdate:
 		// add one or more device to the existing network OR
 		// add one or more device and create a new network (was smart-rg)
 		log.Info("Eero Handler inspecting Update request")
-		NewEero(request)
+		if !NewEero(request) {
+			return kafka.Retryable(fmt.Errorf("could not update Eeros for %s-%s", request.AccountCode, request.SubscribeCode))
+		}
 
-	case "DeviceReturn":
+	case telmaxprovision.RequestDeviceReturn:
 		// Remove device but do not delete network
 		// assume there are other devices using it or will use it
 		log.Info("Eero Handler inspecting returned devices")
-		EeroReturn(request)
+		return EeroReturn(request)
 
-	case "Cancel":
+	case telmaxprovision.RequestCancel:
 		// CancelSubscription
 		// Remove device and delete network
 		log.Info("Eero Handler inspecting cancel subscription request")
-		EeroCancel(request)
+		return EeroCancel(request)
+
+	case telmaxprovision.RequestSuspend:
+		// Pause the subscriber's network, leaving the Eeros and settings on it for Resume
+		log.Info("Eero Handler inspecting suspend request")
+		return EeroSuspend(request, true)
+
+	case telmaxprovision.RequestResume:
+		// Unpause the network the Subscribe record points at
+		log.Info("Eero Handler inspecting resume request")
+		return EeroSuspend(request, false)
 	}
+	return nil
 }
 
 // ProvisionHandler is the custom object that carries the information required
@@ -66,11 +76,9 @@ type ProvisionHandler struct {
 	Results     []string       // collect all results and publish to Kafka as one entry to reduce false positives
 }
 
-// NewEero handles 'New' and 'Update' provisioning requests
-// what about returning a bool and looping the handler until it returns true?
-func NewEero(request telmaxprovision.ProvisionRequest) bool {
-
-	var eeroSerials []string
+// requestSerials collects the serial numbers of the Eeros in a request, looking
+// up the ones that only came with a device code
+func requestSerials(request telmaxprovision.ProvisionRequest) (eeroSerials []string) {
 	for _, device := range request.Devices {
 		if device.DeviceType == "RG" {
 			if eero.IsDeviceCode(device.DefinitionCode) {
@@ -87,15 +95,20 @@ func NewEero(request telmaxprovision.ProvisionRequest) bool {
 			}
 		}
 	}
+	return
+}
+
+// NewEero handles 'New' and 'Update' provisioning requests
+// what about returning a bool and looping the handler until it returns true?
+func NewEero(request telmaxprovision.ProvisionRequest) bool {
+
+	eeroSerials := requestSerials(request)
 	if len(eeroSerials) == 0 {
 		log.Infof("No Eeros in Provision Request")
 		return true
 	}
 
-	result := telmaxprovision.ProvisionResult{
-		RequestID: request.RequestID,
-		Time:      time.Now(),
-	}
+	result := request.NewResult()
 	// instantiate maps to prevent panic
 	ph := &ProvisionHandler{
 		EeroSerials: eeroSerials,
@@ -109,7 +122,7 @@ func NewEero(request telmaxprovision.ProvisionRequest) bool {
 	if err != nil {
 		log.Errorf("getting Subscribe (%s-%s) from CoreDB - %v", request.AccountCode, request.SubscribeCode, err)
 		result.Result = fmt.Sprintf("Error getting Subscribe (%s-%s) from CoreDB - %v", request.AccountCode, request.SubscribeCode, err)
-		kafka.SubmitResult(result)
+		Bus.SubmitResult(result)
 		// return here, there is only one subscribe account per provision request
 		// failed access to the Core DB is a fatal error that prevents provisoning, will block
 		return false
@@ -118,7 +131,9 @@ func NewEero(request telmaxprovision.ProvisionRequest) bool {
 	// This will handle the Update Provision in the same place as New Device.
 	if subscribe.ACSSubscriber != 0 {
 		// netEeroRsp contains a list of all the Eeros on a given network
+		timer := metrics.Backend("eero", "GetNetworkEeros")
 		netEeroRsp, err := eeroApi.GetNetworkEeros(subscribe.ACSSubscriber)
+		timer.Done(&err)
 		if err != nil {
 			log.Infof("failed to retrieve Eero Network by Subscribe.ACSSubscriber (%d) - %v", subscribe.ACSSubscriber, err)
 			ph.Results = append(ph.Results, fmt.Sprintf("Existing network (%s%d) unreachable (%v), creating a new network", networkPrefix, subscribe.ACSSubscriber, err))
@@ -126,7 +141,9 @@ func NewEero(request telmaxprovision.ProvisionRequest) bool {
 		} else {
 			// network exists, do not create a new one but learn more about it
 			ph.NetId = subscribe.ACSSubscriber
+			timer := metrics.Backend("eero", "GetNetworkById")
 			net, err := eeroApi.GetNetworkById(ph.NetId)
+			timer.Done(&err)
 			if err != nil {
 				log.Infof("GetNetworkEeros succeeded but GetNetworkById failed with - %v", err)
 				// shouldn't happen, but doesn't break anything. Simple check combines with logic below to null out a problematic network.
@@ -164,7 +181,7 @@ func NewEero(request telmaxprovision.ProvisionRequest) bool {
 					result.Result = fmt.Sprintf("All Eeros already belong to valid Network (%s%d)", networkPrefix, ph.NetId)
 					result.Success = true
 					result.Time = time.Now()
-					kafka.SubmitResult(result)
+					Bus.SubmitResult(result)
 					return true
 				case 0:
 					// no serials have been mapped to the netid
@@ -188,12 +205,14 @@ func NewEero(request telmaxprovision.ProvisionRequest) bool {
 			subscribe.LanPassphrase = lab.RandString(12)
 		}
 		// create network returns network ID
+		timer := metrics.Backend("eero", "CreateDefaultNetwork")
 		net, err := eeroApi.CreateDefaultNetwork(subscribe.LanSSID, subscribe.LanPassphrase)
+		timer.Done(&err)
 		if err != nil {
 			log.Errorf("creating new network (SSID %s)(PSK %s) - %v", subscribe.LanSSID, subscribe.LanPassphrase, err)
 			result.Result = fmt.Sprintf("Error creating new network (SSID %s)(PSK %s) - %v", subscribe.LanSSID, subscribe.LanPassphrase, err)
 			result.Time = time.Now()
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
 			// if new network can't be created, and one doesn't exist
 			// zero out the subscribe SSID & PSK to change the potential for next provision success
 			subscribe.LanSSID = ""
@@ -213,7 +232,7 @@ func NewEero(request telmaxprovision.ProvisionRequest) bool {
 			log.Errorf("Failed to create a valid Eero Network (NetID==0)(URL %s). Exiting...", net.Url)
 			result.Result = fmt.Sprintf("Error creating new network (SSID %s)(PSK %s) - invalid URL %s", subscribe.LanSSID, subscribe.LanPassphrase, net.Url)
 			result.Time = time.Now()
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
 			return false
 		}
 		log.Infof("Created New Network (%s%d) (SSID %s)(PSK %s)", networkPrefix, ph.NetId, subscribe.LanSSID, subscribe.LanPassphrase)
@@ -236,7 +255,9 @@ device:
 			}
 		}
 		// if Eero is configured for the wrong network, delete it
+		timer := metrics.Backend("eero", "GetEeroBySn")
 		devSearch, err := eeroApi.GetEeroBySn(sn)
+		timer.Done(&err)
 		if err == nil {
 			if devSearch.Network.Url == "" {
 				log.Infof("Eero (SN %s) does not have a Network configured", sn)
@@ -252,7 +273,9 @@ device:
 					// device has network but not proper one
 					log.Infof("Eero (SN %s) is configured for the wrong Network (%d) - overwriting", sn, tmpNetId)
 					// Can't patch over, must remove Eero and readd!
+					timer := metrics.Backend("eero", "DeleteEeroBySn")
 					err = eeroApi.DeleteEeroBySn(sn)
+					timer.Done(&err)
 					if err != nil {
 						log.Errorf("Eero (SN %s) is configured for the Wrong Network (%d) and trying to delete returns this error - %v", sn, tmpNetId, err)
 						ph.Results = append(ph.Results, fmt.Sprintf("Eero (SN %s) is configured for the Wrong Network (%d) and trying to delete returns this error - %v", sn, tmpNetId, err))
@@ -269,7 +292,9 @@ device:
 			continue device
 		}
 		// each Eero must be "Posted" to the API, even though it is already known to the API (as shown with GetbySn)
+		timer = metrics.Backend("eero", "PostNewEero")
 		dev, err := eeroApi.PostNewEero(sn)
+		timer.Done(&err)
 		if err != nil {
 			// most obvious error is already handled: if it already belong to a network
 			// abort this device provision
@@ -281,7 +306,9 @@ device:
 		log.Infof("Eero (SN %s) posted to Eero API (SNID %d)", sn, ph.SnToSnid[sn])
 		// location is passed as "" because it doesn't matter and we can't know in pre-provision
 		// object is disregarded as it does not reflect the addition of the network and does not provide value
+		timer = metrics.Backend("eero", "UpdateEero")
 		_, err = eeroApi.UpdateEero(sn, "", ph.NetId, ph.SnToSnid[sn])
+		timer.Done(&err)
 		if err != nil {
 			log.Errorf("assigning Eero (SN %s)(SNID %d) to Network (%d) - %v", sn, ph.SnToSnid[sn], ph.NetId, err)
 			ph.Results = append(ph.Results, fmt.Sprintf("Error assigning Eero (SN %s)(SNID %d) to Network (%d) - %v", sn, ph.SnToSnid[sn], ph.NetId, err))
@@ -318,13 +345,17 @@ device:
 	// HomeID binding now done by Audit after network comes up
 	/*
 		// this assertion proves or disproves whether the network exists
+		timer := metrics.Backend("eero", "PutNetworkLabel")
 		err = eeroApi.PutNetworkLabel(ph.NetId, ph.HomeId)
+		timer.Done(&err)
 		if err != nil {
 			log.Errorf("Error assigning Home Identifier (%s) to Network (%d) - %v", ph.HomeId, ph.NetId, err)
 			// this assertion we
 			ph.Results = append(ph.Results, fmt.Sprintf("Assigning Home Identifier (%s) to Network (%d) failed with - %v", ph.HomeId, ph.NetId, err))
 		} else {
+			timer := metrics.Backend("eero", "GetNetworkLabel")
 			label, err := eeroApi.GetNetworkLabel(ph.NetId)
+			timer.Done(&err)
 			if err != nil || label != ph.HomeId {
 				log.Errorf("Unsuccessful assigning Home Identifier (%s) to Network (%d)", ph.HomeId, ph.NetId)
 				ph.Results = append(ph.Results, fmt.Sprintf("Unsuccessful assigning Home Identifier (%s) to Network (%d)", ph.HomeId, ph.NetId))
@@ -353,15 +384,80 @@ assert:
 		result.Result += fmt.Sprintf("\t-%s\n", res)
 	}
 	result.Time = time.Now()
-	kafka.SubmitResult(result)
+	Bus.SubmitResult(result)
 	return result.Success
 }
 
+// subscriberNetwork finds the subscriber's Eero network from the Subscribe
+// record, the same as NewEero does.  The network is only theirs if it carries
+// their Home Identifier label, since ACSSubscriber is also used for SmartRG
+// subscribers.  Returns 0 if they have no Eero network.
+func subscriberNetwork(request telmaxprovision.ProvisionRequest) (int, error) {
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		return 0, fmt.Errorf("getting Subscribe (%s-%s) from CoreDB - %w", request.AccountCode, request.SubscribeCode, err)
+	}
+	if subscribe.ACSSubscriber == 0 {
+		return 0, nil
+	}
+	timer := metrics.Backend("eero", "GetNetworkLabel")
+	label, err := eeroApi.GetNetworkLabel(subscribe.ACSSubscriber)
+	timer.Done(&err)
+	if err != nil {
+		if err.Error() == "404 Not Found" {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("getting label of Network (%s%d) - %w", networkPrefix, subscribe.ACSSubscriber, err)
+	}
+	if label != request.AccountCode+request.SubscribeCode {
+		return 0, nil
+	}
+	return subscribe.ACSSubscriber, nil
+}
+
+// EeroSuspend pauses the subscriber's network, so it stops serving their
+// Wi-Fi, or unpauses it again on Resume.  The Eeros and the network's SSID and
+// passphrase are left alone, so nothing has to be provisioned again.
+func EeroSuspend(request telmaxprovision.ProvisionRequest, suspend bool) (failed error) {
+	result := request.NewResult()
+	netId, err := subscriberNetwork(request)
+	if err != nil {
+		log.Errorf("Problem finding Eero network for %s-%s - %v", request.AccountCode, request.SubscribeCode, err)
+		result.Result = fmt.Sprintf("Problem finding Eero network - %v", err)
+		result.Time = time.Now()
+		Bus.SubmitResult(result)
+		return err
+	}
+	if netId == 0 {
+		log.Infof("No Eero network for %s-%s", request.AccountCode, request.SubscribeCode)
+		return
+	}
+	action, call, pause := "pause", "PauseNetwork", eeroApi.PauseNetwork
+	if !suspend {
+		action, call, pause = "unpause", "UnpauseNetwork", eeroApi.UnpauseNetwork
+	}
+	timer := metrics.Backend("eero", call)
+	err = pause(netId)
+	timer.Done(&err)
+	if err != nil {
+		log.Errorf("Problem trying to %s Network (%s%d) - %v", action, networkPrefix, netId, err)
+		result.Result = fmt.Sprintf("Problem trying to %s Network (%s%d) - %v", action, networkPrefix, netId, err)
+		failed = err
+	} else {
+		log.Infof("Network (%s%d) has been %sd", networkPrefix, netId, action)
+		result.Result = fmt.Sprintf("Network (%s%d) has been %sd", networkPrefix, netId, action)
+		result.Success = true
+	}
+	result.Time = time.Now()
+	Bus.SubmitResult(result)
+	return
+}
+
 // EeroReturn deletes each Eero device by Serial if it exists in the system.
 // This does not remove the network the Eero was using. If devices are still
 // connected to that network and not part of the Return Request, they should
 // not lose access.
-func EeroReturn(request telmaxprovision.ProvisionRequest) {
+func EeroReturn(request telmaxprovision.ProvisionRequest) (failed error) {
 	// no result object returned?
 	for _, device := range request.Devices {
 		if device.DeviceType == "RG" {
@@ -375,23 +471,27 @@ func EeroReturn(request telmaxprovision.ProvisionRequest) {
 						log.Errorf("Received NIL SN and cannot retrieve Database entry by Device Code (%s) - %v", device.DeviceCode, err)
 						// no result in Return
 						//result.Result = fmt.Sprintf("Received NIL SN and cannot retreieve Database entry by Device Code (%s) - %v", device.DeviceCode, err)
-						//kafka.SubmitResult(result)
-						return
+						//Bus.SubmitResult(result)
+						return err
 					} else {
 						sn = dev.Serial
 					}
 				} else {
 					sn = device.Serial
 				}
+				timer := metrics.Backend("eero", "DeleteEeroBySn")
 				err := eeroApi.DeleteEeroBySn(sn)
+				timer.Done(&err)
 				if err != nil && err.Error() != "404 Not Found" {
 					log.Errorf("Problem removing Eero (SN %s) - %v", sn, err)
+					failed = err
 				} else {
 					log.Infof("Eero (SN %s) has been removed from any associated networks", sn)
 				}
 			}
 		}
 	}
+	return
 }
 
 // EeroCancel deletes each Eero device by Serial if it exists in the system.
@@ -400,7 +500,7 @@ func EeroReturn(request telmaxprovision.ProvisionRequest) {
 // case, the device will still be removed but a network may be left over.
 // This fails safe in case this network has other live devices attached and was
 // given in error.
-func EeroCancel(request telmaxprovision.ProvisionRequest) {
+func EeroCancel(request telmaxprovision.ProvisionRequest) (failed error) {
 	// no result object returned?
 	network := make(map[string][]string)
 	for _, device := range request.Devices {
@@ -413,7 +513,7 @@ func EeroCancel(request telmaxprovision.ProvisionRequest) {
 					dev, err := devices.GetDevice(CoreDB, "device_code", device.DeviceCode)
 					if err != nil {
 						log.Errorf("Received NIL SN and cannot retrieve Database entry by Device Code (%s) - %v", device.DeviceCode, err)
-						return
+						return err
 					} else {
 						sn = dev.Serial
 					}
@@ -421,15 +521,21 @@ func EeroCancel(request telmaxprovision.ProvisionRequest) {
 					sn = device.Serial
 				}
 				// need to get the eero object to know the associated network to delete
+				timer := metrics.Backend("eero", "GetEeroBySn")
 				devSearch, err := eeroApi.GetEeroBySn(sn)
+				timer.Done(&err)
 				if err != nil {
 					log.Errorf("Problem finding Eero (SN %s) in Insight - %v", sn, err)
+					failed = err
 				} else {
 					// tie back network to Mac address, using a map to identify unique values
 					network[devSearch.Network.Url] = append(network[devSearch.Network.Url], sn)
+					timer := metrics.Backend("eero", "DeleteEeroBySn")
 					err = eeroApi.DeleteEeroBySn(sn)
+					timer.Done(&err)
 					if err != nil && err.Error() != "404 Not Found" {
 						log.Errorf("Problem removing Eero (SN %s) - %v", sn, err)
+						failed = err
 					} else {
 						log.Infof("Eero (SN %s) has been removed from any associated networks", sn)
 					}
@@ -440,11 +546,15 @@ func EeroCancel(request telmaxprovision.ProvisionRequest) {
 	// keys in map will be unique networks
 	// prevents deleting the same network twice and deciding if that error is important
 	for url := range network {
+		timer := metrics.Backend("eero", "DeleteNetwork")
 		err := eeroApi.DeleteNetwork(eero.LastUrlSegmentInt(url))
+		timer.Done(&err)
 		if err != nil {
 			log.Errorf("Problem deleting network (ID %d) - %v", eero.LastUrlSegmentInt(url), err)
+			failed = err
 		} else {
 			log.Infof("Eero network (ID %d) deleted", eero.LastUrlSegmentInt(url))
 		}
 	}
+	return
 }
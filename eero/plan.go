@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-common/maxbill"
+	"bitbucket.org/telmaxnate/eero"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// PlanProvision reports the networks and devices HandleProvision would change
+// for a dry run request, only reading from the Eero API
+func PlanProvision(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
+	log.Infof("Planning provision request %v", request)
+	switch request.RequestType {
+	case telmaxprovision.RequestNew, telmaxprovision.RequestUpdate:
+		PlanNew(request)
+
+	case telmaxprovision.RequestDeviceReturn:
+		PlanRemove(request, false)
+
+	case telmaxprovision.RequestSuspend, telmaxprovision.RequestResume:
+		PlanSuspend(request, request.RequestType == telmaxprovision.RequestSuspend)
+
+	case telmaxprovision.RequestCancel:
+		PlanRemove(request, true)
+	}
+	return nil
+}
+
+// submitPlan sends the planned steps as one result, the same as NewEero sends
+// its summary
+func submitPlan(request telmaxprovision.ProvisionRequest, success bool, steps []string) {
+	if len(steps) == 0 {
+		return
+	}
+	result := request.NewResult()
+	result.Success = success
+	result.Result = "Eero provisioning plan:\n"
+	for _, step := range steps {
+		result.Result += fmt.Sprintf("\t-%s\n", step)
+	}
+	result.Time = time.Now()
+	Bus.SubmitResult(result)
+}
+
+// PlanNew works out which network NewEero would use or create, and which Eeros
+// it would add or move to it
+func PlanNew(request telmaxprovision.ProvisionRequest) {
+	eeroSerials := requestSerials(request)
+	if len(eeroSerials) == 0 {
+		return
+	}
+	var steps []string
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		submitPlan(request, false, []string{fmt.Sprintf("Error getting Subscribe (%s-%s) from CoreDB - %v", request.AccountCode, request.SubscribeCode, err)})
+		return
+	}
+	netId := 0
+	onNetwork := map[string]bool{}
+	if subscribe.ACSSubscriber != 0 {
+		timer := metrics.Backend("eero", "GetNetworkEeros")
+		netEeroRsp, err := eeroApi.GetNetworkEeros(subscribe.ACSSubscriber)
+		timer.Done(&err)
+		if err != nil {
+			steps = append(steps, fmt.Sprintf("Existing network (%s%d) unreachable (%v), would create a new network", networkPrefix, subscribe.ACSSubscriber, err))
+		} else {
+			netId = subscribe.ACSSubscriber
+			for _, dev := range netEeroRsp.Data {
+				onNetwork[dev.Serial] = true
+			}
+			steps = append(steps, fmt.Sprintf("Would use existing Network (%s%d)", networkPrefix, netId))
+		}
+	}
+	if netId == 0 {
+		ssid := subscribe.LanSSID
+		if ssid == "" {
+			ssid = "a generated SSID"
+		}
+		steps = append(steps, fmt.Sprintf("Would create a new Network with SSID (%s) and record it on the Subscribe", ssid))
+	}
+	network := "the new Network"
+	if netId != 0 {
+		network = fmt.Sprintf("Network (%d)", netId)
+	}
+
+	success := true
+	for _, sn := range eeroSerials {
+		if onNetwork[sn] {
+			steps = append(steps, fmt.Sprintf("Eero (SN %s) already belongs to %s", sn, network))
+			continue
+		}
+		timer := metrics.Backend("eero", "GetEeroBySn")
+		devSearch, err := eeroApi.GetEeroBySn(sn)
+		timer.Done(&err)
+		if err != nil {
+			success = false
+			steps = append(steps, fmt.Sprintf("Eero (SN %s) is not found in the Eero Insight portal - %v", sn, err))
+			continue
+		}
+		current := 0
+		if devSearch.Network.Url != "" {
+			current = eero.LastUrlSegmentInt(devSearch.Network.Url)
+		}
+		switch {
+		case current != 0 && current == netId:
+			steps = append(steps, fmt.Sprintf("Eero (SN %s) is already configured for %s", sn, network))
+		case current != 0:
+			steps = append(steps, fmt.Sprintf("Would remove Eero (SN %s) from the wrong Network (%d) and assign it to %s", sn, current, network))
+		default:
+			steps = append(steps, fmt.Sprintf("Would assign Eero (SN %s) to %s and update its Device record", sn, network))
+		}
+	}
+	submitPlan(request, success, steps)
+}
+
+// PlanRemove reports the Eeros EeroReturn or EeroCancel would remove, and for
+// a cancel the networks that would be deleted with them
+func PlanRemove(request telmaxprovision.ProvisionRequest, cancel bool) {
+	var steps []string
+	networks := map[int]bool{}
+	for _, sn := range requestSerials(request) {
+		steps = append(steps, fmt.Sprintf("Would remove Eero (SN %s) from any associated networks", sn))
+		if !cancel {
+			continue
+		}
+		timer := metrics.Backend("eero", "GetEeroBySn")
+		devSearch, err := eeroApi.GetEeroBySn(sn)
+		timer.Done(&err)
+		if err != nil {
+			steps = append(steps, fmt.Sprintf("Eero (SN %s) is not found in Insight, it would be skipped - %v", sn, err))
+		} else if devSearch.Network.Url != "" {
+			networks[eero.LastUrlSegmentInt(devSearch.Network.Url)] = true
+		}
+	}
+	for netId := range networks {
+		steps = append(steps, fmt.Sprintf("Would delete Network (%s%d)", networkPrefix, netId))
+	}
+	submitPlan(request, true, steps)
+}
+
+// PlanSuspend reports the network EeroSuspend would pause or unpause
+func PlanSuspend(request telmaxprovision.ProvisionRequest, suspend bool) {
+	netId, err := subscriberNetwork(request)
+	if err != nil {
+		submitPlan(request, false, []string{fmt.Sprintf("Problem finding Eero network - %v", err)})
+		return
+	}
+	if netId == 0 {
+		return
+	}
+	action := "pause"
+	if !suspend {
+		action = "unpause"
+	}
+	submitPlan(request, true, []string{fmt.Sprintf("Would %s Network (%s%d)", action, networkPrefix, netId)})
+}
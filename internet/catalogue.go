@@ -0,0 +1,79 @@
+package main
+
+/*
+	The voice catalogue says how phone lines in each SIP domain are provisioned - the MCP profile, the VLAN, and
+	optionally a content provider, codec and SIP server that differ from the defaults, so business and residential
+	domains can be set up differently.  It is a YAML file keyed by domain, read at start-up and again on SIGHUP.  A
+	line in a domain that isn't in the catalogue is not provisioned - it raises an exception instead.  Without the
+	file the catalogue is empty, so the rest of provisioning carries on and every line raises that exception.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+var CatalogueFile = flag.String("voice.catalogue", "/etc/provision/voice.yaml", "YAML file of voice profiles and VLANs by SIP domain")
+
+// How voice services in a SIP domain are provisioned
+type VoiceProfile struct {
+	Profile         string `yaml:"profile"`          // MCP service profile
+	Vlan            int    `yaml:"vlan"`             // Uplink VLAN
+	ContentProvider string `yaml:"content_provider"` // Use this content provider instead of the circuit's
+	Codec           string `yaml:"codec"`            // Preferred codec - the profile's when empty
+	SIPServer       string `yaml:"sip_server"`       // Proxy to register with - the profile's when empty
+}
+
+type Catalogue struct {
+	Domains map[string]VoiceProfile `yaml:"domains"`
+}
+
+var (
+	catalogue     Catalogue
+	catalogueLock sync.RWMutex
+)
+
+// Read the catalogue file, and use it if every domain has a profile and VLAN.  A missing file empties the catalogue.
+func LoadCatalogue(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Warnf("No voice catalogue at %s - phone lines won't be provisioned until there is one", path)
+		catalogueLock.Lock()
+		catalogue = Catalogue{}
+		catalogueLock.Unlock()
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var loaded Catalogue
+	if err := yaml.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("problem reading %s - %v", path, err)
+	}
+	if len(loaded.Domains) == 0 {
+		return fmt.Errorf("no domains in %s", path)
+	}
+	for domain, profile := range loaded.Domains {
+		if profile.Profile == "" || profile.Vlan == 0 {
+			return fmt.Errorf("domain %s in %s needs a profile and vlan", domain, path)
+		}
+	}
+	catalogueLock.Lock()
+	catalogue = loaded
+	catalogueLock.Unlock()
+	log.Infof("Loaded %d voice domains from %s", len(loaded.Domains), path)
+	return nil
+}
+
+// How to provision voice services in a SIP domain.  Ok is false if the domain isn't in the catalogue.
+func voiceProfile(domain string) (profile VoiceProfile, ok bool) {
+	catalogueLock.RLock()
+	defer catalogueLock.RUnlock()
+	profile, ok = catalogue.Domains[domain]
+	return
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// Without the file there are no voice domains, but the service still starts
+func TestLoadCatalogueMissing(t *testing.T) {
+	catalogue = Catalogue{Domains: map[string]VoiceProfile{"res.telmax.ca": {Profile: "Voice", Vlan: 200}}}
+	if err := LoadCatalogue(filepath.Join(t.TempDir(), "voice.yaml")); err != nil {
+		t.Fatalf("LoadCatalogue: %v", err)
+	}
+	if _, ok := voiceProfile("res.telmax.ca"); ok {
+		t.Error("the catalogue should be empty")
+	}
+}
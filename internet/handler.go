@@ -9,15 +9,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"strings"
-	"time"
 
 	"bitbucket.org/telmaxdc/telmax-common"
 	"bitbucket.org/telmaxdc/telmax-common/devices"
 	"bitbucket.org/telmaxdc/telmax-common/maxbill"
 	"bitbucket.org/telmaxdc/telmax-provision/dhcpdb"
-	"bitbucket.org/telmaxdc/telmax-provision/kafka"
 	"bitbucket.org/telmaxdc/telmax-provision/mcp"
 	"bitbucket.org/telmaxdc/telmax-provision/netdb"
 	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
@@ -26,79 +25,99 @@ import (
 )
 
 // Accept and process a provision request and invoke the appropriate functions based on the request type
-func HandleProvision(request telmaxprovision.ProvisionRequest) {
+func HandleProvision(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
 	log.Infof("Got provision request %v", request)
 	switch request.RequestType {
-	case "New":
-		NewRequest(request)
+	case telmaxprovision.RequestNew:
+		return NewRequest(request)
 
-	case "Update":
-		//		NewRequest(request)
+	case telmaxprovision.RequestUpdate:
+		return UpdateServices(request)
 
-	case "Device Swap":
+	case telmaxprovision.RequestDeviceSwap:
 		log.Info("Handling device swap request")
-		DeviceSwap(request)
+		return DeviceSwap(request)
 
-	case "DeviceReturn":
+	case telmaxprovision.RequestDeviceReturn:
+		log.Info("Handling device return request")
+		return ReturnONT(request)
 
-	case "UnProvision":
-		UnProvisionServices(request)
+	case telmaxprovision.RequestUnProvision:
+		return UnProvisionServices(request)
 
-	case "Cancel":
-		UnProvisionServices(request)
-		DeleteONT(request)
+	case telmaxprovision.RequestCancel:
+		// The ONT goes even if a service couldn't be removed
+		err := UnProvisionServices(request)
+		if onterr := DeleteONT(request); onterr != nil {
+			err = onterr
+		}
 		//		ReleaseCircuit(request)
+		return err
+
+	case telmaxprovision.RequestSuspend:
+		return SuspendServices(request, true)
+
+	case telmaxprovision.RequestResume:
+		return SuspendServices(request, false)
 
 	}
+	return nil
+}
 
+// What a new request needs, all looked up before anything is changed
+type newOrder struct {
+	subscriber string
+	site       Site
+	PON        string
+	pools      map[string]bool  // DHCP pools to assign addresses from
+	services   []mcp.OLTService // Services to create on the ONT
+	ont        mcp.ONTData      // The ONT to create - the last one in the request if there are several
 }
 
-// Provision services as new (check to see if they exist already)
-func NewRequest(request telmaxprovision.ProvisionRequest) {
+// Look up the subscriber, site, products and ONT for a new request.  Problems are sent as results, and ok is false
+// if there is nothing to provision.  Failed is the last problem, even one that only left a product or device out.
+func resolveNew(request telmaxprovision.ProvisionRequest) (order newOrder, ok bool, failed error) {
 	var (
 		site       Site
 		subscriber string
 		PON        string
 	)
 	// result is the Kafka response object
-	result := telmaxprovision.ProvisionResult{
-		RequestID: request.RequestID,
-		Time:      time.Now(),
-		Success:   false, // let a success set this bool
-	}
+	result := request.NewResult() // Success stays false until something sets it
 	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
 	if err != nil {
 		log.Errorf("getting subscriber (%s)(%s) %v", request.AccountCode, request.SubscribeCode, err)
 		result.Result = fmt.Sprintf("Problem getting subscriber (%s)(%s) %v", request.AccountCode, request.SubscribeCode, err)
-		kafka.SubmitResult(result)
+		Bus.SubmitResult(result)
+		return order, false, err
 	}
 	// We only act on this if the subscription is Fibre
 	if subscribe.NetworkType != "Fibre" {
 		log.Debugf("not a fibre customer")
-		return
+		return order, false, nil
 	}
 	subscriber = subscribe.AccountCode + "-" + subscribe.SubscribeCode
 
 	// Check to see if there is a site ID
 	if subscribe.SiteID == "" {
 		result.Result = "Subscriber site ID not set - mandatory!"
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return order, false, fmt.Errorf("subscriber (%s) has no site ID", subscriber)
 	}
 	// extract the Site info
 	site, err = GetSite(subscribe.SiteID)
 	if err != nil {
 		log.Errorf("getting site (%s) -  %v", subscribe.SiteID, err)
 		result.Result = fmt.Sprintf("Problem getting site (%s) -  %v", subscribe.SiteID, err)
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return order, false, err
 	}
 	// validate the Circuit Data
 	if len(site.CircuitData) < 1 {
 		log.Errorf("site (%s) does not have valid circuit data", subscribe.SiteID)
 		result.Result = "This site does not have valid circuit data!"
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return order, false, fmt.Errorf("site (%s) does not have valid circuit data", subscribe.SiteID)
 	}
 	log.Debugf("Subscriber (%s) Site data is %v", subscriber, site)
 	PON = site.CircuitData[0].PON
@@ -106,12 +125,11 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 	if PON == "" {
 		log.Errorf("site (%s) does not have PON data", subscribe.SiteID)
 		result.Result = fmt.Sprintf("PON data missing for site (%s)", subscribe.SiteID)
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return order, false, fmt.Errorf("PON data missing for site (%s)", subscribe.SiteID)
 	}
 	// Check to see if they have any Internet services
 	pools := map[string]bool{}
-	reservations := map[string]dhcpdb.Reservation{}
 	var services []mcp.OLTService
 
 	// see which products have a network profile to add them as a service
@@ -121,7 +139,8 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 		if err != nil {
 			log.Errorf("getting maxbill product (%s) - %v", product.ProductCode, err)
 			result.Result = fmt.Sprintf("Problem getting maxbill product (%s) - %v", product.ProductCode, err)
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
+			failed = err
 			continue
 		}
 		// only provision products with a network profile field; determines the network provisioning template
@@ -142,13 +161,15 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 				if err != nil {
 					log.Errorf("getting subscribed product (%s) details %v", product.SubProductCode, err)
 					result.Result = fmt.Sprintf("Problem getting subscribed product (%s) details %v", product.SubProductCode, err)
-					kafka.SubmitResult(result)
+					Bus.SubmitResult(result)
+					failed = err
 					continue
 				}
 				if len(subscribeservicearray) < 1 {
 					log.Errorf("subscribed product (%s) returned no results", product.SubProductCode)
 					result.Result = fmt.Sprintf("Internet provision Error - subprod_code (%s) does not exist!", product.SubProductCode)
-					kafka.SubmitResult(result)
+					Bus.SubmitResult(result)
+					failed = fmt.Errorf("subprod_code (%s) does not exist", product.SubProductCode)
 					continue
 				}
 				servicedata.SubscribeProduct = subscribeservicearray[0]
@@ -174,7 +195,8 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 			if err != nil {
 				log.Errorf("getting device definition (%s) - %v", device.DefinitionCode, err)
 				result.Result = fmt.Sprintf("Problem getting device definition (%s) - %v", device.DefinitionCode, err)
-				kafka.SubmitResult(result)
+				Bus.SubmitResult(result)
+				failed = err
 				continue
 			}
 			log.Debugf("device definition is %v", definition)
@@ -194,7 +216,8 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 				if err != nil {
 					log.Errorf("getting device (%s) - %v", definition.Model, err)
 					result.Result = fmt.Sprintf("Problem getting device (%s) - %v", definition.Model, err)
-					kafka.SubmitResult(result)
+					Bus.SubmitResult(result)
+					failed = err
 					continue
 				}
 				allONT = append(allONT, thisONT)
@@ -204,88 +227,112 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 	// return if no ONT found
 	if len(allONT) < 1 {
 		log.Debugf("no ONT in device provision request, nothing to do")
-		return
+		return order, false, failed
 	}
 	// if more than one ONT, the Latest one us used.
 	activeONT = allONT[len(allONT)-1]
+	order = newOrder{
+		subscriber: subscriber,
+		site:       site,
+		PON:        PON,
+		pools:      pools,
+		services:   services,
+		ont:        activeONT,
+	}
+	return order, true, failed
+}
 
+// Provision services as new (check to see if they exist already).  Each change is a step that can be undone - see
+// steps.go for what happens when one fails.
+func NewRequest(request telmaxprovision.ProvisionRequest) error {
+	order, ok, failed := resolveNew(request)
+	if !ok {
+		return failed
+	}
 	var (
-		ONU int
-		CP  string // ContentProvider
+		site         = order.site
+		subscriber   = order.subscriber
+		PON          = order.PON
+		services     = order.services
+		activeONT    = order.ont
+		reservations = map[string]dhcpdb.Reservation{}
+		circuit      netdb.Circuit
+		err          error
 	)
-	// Assign a circuit and ONU ID
-	circuit, assigned, err := netdb.AllocateCircuit(NetDB, site.WireCentre, PON, subscriber)
-	if err != nil {
-		log.Errorf("assigning circuit (%s)(%s)(%s) - %v", site.WireCentre, PON, subscriber, err)
-		result.Result = fmt.Sprintf("Problem assigning circuit (%s)(%s)(%s) - %v", site.WireCentre, PON, subscriber, err)
-		result.Success = false
-		kafka.SubmitResult(result)
-		return
-	}
-	// assigned reflects whether work was done, ie a new assignment was completed
-	if !assigned {
-		log.Infof("Circuit (%s) was already assigned", circuit.ID)
-		result.Result = fmt.Sprintf("Re-using existing circuit ID (%s)", circuit.ID)
-		result.Success = true
-		kafka.SubmitResult(result)
-	}
-	// Set variables for the circuit and content provider strings
-	ONU = circuit.Unit
-	CP = circuit.AccessNode + "-cp"
-	log.Infof("ONU (%d) on Content-Provider (%s) from Circuit (%s) assigned to Subscriber (%s)", ONU, CP, circuit.ID, subscriber)
-	result.Result = fmt.Sprintf("Assigned Circuit (%s) to Subscriber (%s)", circuit.ID, subscriber)
-	result.Success = true
-	kafka.SubmitResult(result)
-	// revert result.Success back to false to let future successes toggle it
-	result.Success = false
-
 	// modify the PON interface if GPON... arbitrary naming convention
 	// messes up the Circuit Allocation! must be altered after
 	// and not reflected in the network.access_ports DB
+	ontPON := PON
 	if activeONT.IsGpon {
-		tmp := strings.Split(PON, "-")
-		if len(tmp) < 2 {
-			log.Errorf("unexpected PON (%s)", PON)
-			result.Result = fmt.Sprintf("unexpected PON (%s)", PON)
-			kafka.SubmitResult(result)
-			return
+		ontPON, err = gponInterface(PON)
+		if err != nil {
+			log.Error(err)
+			result := request.NewResult()
+			result.Result = err.Error()
+			Bus.SubmitResult(result)
+			return err
 		}
-		// stouffville-olt01-pon01 then stouffville-olt01-gpon01
-		// OR sandiford-lab-olt01-pon01 then sandiford-lab-olt01-gpon01
-		// OR olt01-pon01 then olt01-gpon01
-		tmp[len(tmp)-1] = "g" + tmp[len(tmp)-1]
-		PON = strings.Join(tmp, "-")
 	}
+	run := StartRun(request)
+
+	// Assign a circuit and ONU ID
+	run.Step(Step{
+		Name:   "circuit",
+		Repeat: true,
+		Do: func() (string, bool, error) {
+			var assigned bool
+			circuit, assigned, err = netdb.AllocateCircuit(NetDB, site.WireCentre, PON, subscriber)
+			if err != nil {
+				log.Errorf("assigning circuit (%s)(%s)(%s) - %v", site.WireCentre, PON, subscriber, err)
+				return fmt.Sprintf("Problem assigning circuit (%s)(%s)(%s) - %v", site.WireCentre, PON, subscriber, err), false, err
+			}
+			log.Infof("ONU (%d) on Content-Provider (%s-cp) from Circuit (%s) assigned to Subscriber (%s)", circuit.Unit, circuit.AccessNode, circuit.ID, subscriber)
+			// assigned reflects whether work was done, ie a new assignment was completed
+			if !assigned {
+				log.Infof("Circuit (%s) was already assigned", circuit.ID)
+				return fmt.Sprintf("Re-using existing circuit ID (%s)", circuit.ID), false, nil
+			}
+			return fmt.Sprintf("Assigned Circuit (%s) to Subscriber (%s)", circuit.ID, subscriber), true, nil
+		},
+		Undo: func() (string, error) {
+			return fmt.Sprintf("Released circuit (%s)", circuit.ID), netdb.ReleaseCircuit(NetDB, circuit.ID)
+		},
+	})
+	// Set variables for the circuit and content provider strings
+	ONU := circuit.Unit
+	CP := circuit.AccessNode + "-cp"
+
 	// Create the ONT and interfaces in MCP
-	err = mcp.CreateONT(subscriber, activeONT, PON, ONU)
-	if err != nil {
-		// logged error within function
-		result.Result = err.Error()
-		kafka.SubmitResult(result)
-		return
-	}
-	result.Result = "Created ONT and interface objects"
-	result.Success = true
-	kafka.SubmitResult(result)
-	result.Success = false
+	run.Step(ontStep(subscriber, activeONT, ontPON, ONU, mcpDevice))
 
 	// Get DHCP leases for each service that needs one  This is based on the network profile, if a DHCP pool is listed
-	log.Debugf("Allocating addresses in DHCP pools %v", pools)
-	for pool := range pools {
-		var resulttext string
+	log.Debugf("Allocating addresses in DHCP pools %v", order.pools)
+	for pool := range order.pools {
 		// the pool like likely be "residential"
-		reservations[pool], err = dhcpdb.DhcpAssign(circuit.RoutingNode, pool, subscriber)
-		if err != nil {
-			resulttext = fmt.Sprintf("Problem assigning address (%s) - %v", pool, err)
-			result.Success = false
-		} else {
-			resulttext = fmt.Sprintf("Assigned address (%s) from pool (%s) with VLAN (%d)", reservations[pool].V4Addr.String(), pool, reservations[pool].VlanID)
-			result.Success = true
-		}
-		result.Result = resulttext
-		kafka.SubmitResult(result)
+		pool := pool
+		run.Step(Step{
+			Name:   "dhcp:" + pool,
+			Repeat: true,
+			Do: func() (string, bool, error) {
+				_, existing, err := dhcpdb.DhcpPlan(circuit.RoutingNode, pool, subscriber)
+				if err == nil {
+					reservations[pool], err = dhcpdb.DhcpAssign(circuit.RoutingNode, pool, subscriber)
+				}
+				if err == nil && reservations[pool].HostID == 0 {
+					err = fmt.Errorf("no address available on (%s)", circuit.RoutingNode)
+				}
+				if err != nil {
+					return fmt.Sprintf("Problem assigning address (%s) - %v", pool, err), false, err
+				}
+				return fmt.Sprintf("Assigned address (%s) from pool (%s) with VLAN (%d)", reservations[pool].V4Addr.String(), pool, reservations[pool].VlanID), !existing, nil
+			},
+			Undo: func() (string, error) {
+				_, err := dhcpdb.DhcpRelease(circuit.RoutingNode, pool, subscriber)
+				return fmt.Sprintf("Released address (%s) in pool (%s)", reservations[pool].V4Addr.String(), pool), err
+			},
+		})
 	}
-	result.Success = false
+
 	// Add services
 	for _, service := range services {
 		// You need the vlan ID from the reservation to know which VLAN the customer should be connected to
@@ -296,7 +343,97 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 		} else {
 			service.Vlan = service.ProductData.NetworkProfile.Vlan
 		}
-		if service.ProductData.Category == "Internet" {
+		if service.ProductData.Category != "Internet" {
+			log.Infof("unexpected service type - %v", service.ProductData.Category)
+			continue
+		}
+		run.Step(serviceStep(service, subscriber, CP, mcpService))
+	}
+
+	// Bring the voice services in line with the phone numbers on the ONT device record - see voice.go
+	var voice []serviceChange
+	run.Step(Step{
+		Name:   "voice",
+		Repeat: true,
+		Do: func() (string, bool, error) {
+			voice, err = voiceChanges(subscriber, activeONT.Device.VoiceServices, nil)
+			if err != nil {
+				log.Errorf("checking voice services (%s) - %v", subscriber, err)
+				return fmt.Sprintf("Problem checking voice services (%s) - %v", subscriber, err), false, err
+			}
+			return fmt.Sprintf("Found %d voice services to change", len(voice)), false, nil
+		},
+	})
+	for _, change := range voice {
+		change := change
+		step := Step{
+			Name: "voice:" + change.voice.Username,
+			Do: func() (string, bool, error) {
+				text, err := applyVoice(request, change, subscriber, CP)
+				return text, err == nil, err
+			},
+		}
+		// Removed and moved lines would need their old DID settings back, so only new ones are undone
+		if change.action == ChangeVoice {
+			step.Undo = func() (string, error) {
+				return fmt.Sprintf("Removed voice service (%s)", change.name), deleteVoice(subscriber, change.voice.Username)
+			}
+		}
+		run.Step(step)
+	}
+	if err := run.Finish(); err != nil {
+		return err
+	}
+	return failed
+}
+
+// Create the ONT and its interfaces in MCP.  An ONT that is already deployed belongs to the subscriber from before,
+// so it is left alone and isn't undone on a rollback.
+func ontStep(subscriber string, ont mcp.ONTData, pon string, onu int, lookup func(name string) (mcp.MCPDeviceInfo, error)) Step {
+	name := subscriber + "-ONT"
+	return Step{
+		Name: "ont",
+		Do: func() (string, bool, error) {
+			info, err := lookup(name)
+			if err != nil {
+				return fmt.Sprintf("Problem getting device (%s) from MCP - %v", name, err), false, err
+			}
+			if info.State == "deployed" || info.State == "activated" {
+				if info.Parameters.Serial != ont.Device.Serial {
+					err = fmt.Errorf("ONT (%s) already deployed with serial number (%s)", name, info.Parameters.Serial)
+					return err.Error(), false, err
+				}
+				return fmt.Sprintf("ONT (%s) is already deployed", name), false, nil
+			}
+			err = mcp.CreateONT(subscriber, ont, pon, onu)
+			if err != nil {
+				// logged error within function
+				return err.Error(), false, err
+			}
+			return "Created ONT and interface objects", true, nil
+		},
+		Undo: func() (string, error) {
+			return fmt.Sprintf("Deleted ONT (%s)", name), mcp.DeleteONT(subscriber, ont)
+		},
+	}
+}
+
+// Create a data service on the ONT.  A service that is already deployed is left alone, and isn't undone.
+func serviceStep(service mcp.OLTService, subscriber string, CP string, lookup func(name string) (mcp.MCPServiceInfo, error)) Step {
+	return Step{
+		Name: "service:" + service.Name,
+		Do: func() (string, bool, error) {
+			info, err := lookup(service.Name)
+			if err != nil {
+				return fmt.Sprintf("Problem getting service (%s) from MCP - %v", service.Name, err), false, err
+			}
+			if info.State == "deployed" || info.State == "activated" {
+				if info.Vlan() != service.Vlan {
+					err = fmt.Errorf("service (%s) already deployed on VLAN (%d), not (%d)", service.Name, info.Vlan(), service.Vlan)
+					return err.Error(), false, err
+				}
+				return fmt.Sprintf("Service (%s) is already deployed", service.Name), false, nil
+			}
 			log.Debugf("creating Internet service %v", service.ProductData.NetworkProfile.ProfileName)
 			if service.ProductData.NetworkProfile.ProfileName == "" {
 				log.Errorf("Service %v does not have a network profile!", service.Name)
@@ -305,79 +442,98 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 			err = mcp.CreateDataService(service.Name, subscriber+"-ONT", subscriber, service.ProductData.NetworkProfile.ProfileName, CP, service.Vlan, 1)
 			if err != nil {
 				log.Errorf("creating service (%s) - %v", service.Name, err)
-				result.Result = fmt.Sprintf("Problem creating service (%s) - %v", service.Name, err)
-				result.Success = false
-				kafka.SubmitResult(result)
-			} else {
-				log.Infof("created service object (%s) - %v", service.Name, service)
-				result.Result = "Created service object " + service.Name
-				result.Success = true
-				kafka.SubmitResult(result)
+				return fmt.Sprintf("Problem creating service (%s) - %v", service.Name, err), false, err
 			}
-		} else {
-			log.Infof("unexpected service type - %v", service.ProductData.Category)
-		}
+			log.Infof("created service object (%s) - %v", service.Name, service)
+			return "Created service object " + service.Name, true, nil
+		},
+		Undo: func() (string, error) {
+			return fmt.Sprintf("Removed service (%s)", service.Name), mcp.DeleteService(service.Name)
+		},
+	}
+}
 
+// Look up a device in MCP
+func mcpDevice(name string) (mcp.MCPDeviceInfo, error) {
+	token, err := mcp.MCPAuth()
+	if err != nil {
+		return mcp.MCPDeviceInfo{}, err
 	}
-	// iterate through the phone numbers on the ONT device record
-	for _, voicesvc := range activeONT.Device.VoiceServices {
-		if voicesvc.Username != "" {
-			log.Infof("Creating voice service for DID (%s)", voicesvc.Username)
-			var (
-				profile   string
-				voicevlan int
-			)
-			// Right now, we only have residential, but we could use the domain to determine some config options
-			switch voicesvc.Domain {
-			case "residential.telmax.ca":
-				profile = "telmax-res-voice"
-				voicevlan = 202 // HARDCODED VLAN... EEP
-			default:
-				profile = "telmax-res-voice"
-				voicevlan = 202 // HARDCODED VLAN... EEP
-			}
-			var did DID
-			// Get the DID information from the telephone database
-			did, err := GetDID(voicesvc.Username)
-			if err != nil {
-				log.Errorf("Problem getting voice DID %v", err)
-				result.Result = fmt.Sprintf("Could not get DID (%s) from telephone API - %v", voicesvc.Username, err)
-				result.Success = false
-			} else if did.UserData == nil {
-				result.Result = fmt.Sprintf("Missing user data for DID (%s)", voicesvc.Username)
-				result.Success = false
-			} else {
-				log.Infof("DID data for (%s) is %v", voicesvc.Username, did)
-				// Create a voice service in MCP, now that we have all the information we need
-				err = mcp.CreatePhoneService(subscriber+"-"+voicesvc.Username, subscriber+"-ONT", subscriber, profile, CP, voicevlan, did.Number, did.UserData.SIPPassword, int(voicesvc.Line))
-				if err != nil {
-					result.Result = "Problem adding voice service " + err.Error()
-					result.Success = false
-				} else {
-					result.Result = fmt.Sprintf("Added DID (%s) to FXS port (%d)", voicesvc.Username, int(voicesvc.Line))
-					result.Success = true
-				}
-			}
-			kafka.SubmitResult(result)
-		}
+	return mcp.GetDevice(token, name)
+}
+
+// Look up a service in MCP
+func mcpService(name string) (mcp.MCPServiceInfo, error) {
+	token, err := mcp.MCPAuth()
+	if err != nil {
+		return mcp.MCPServiceInfo{}, err
+	}
+	return mcp.GetService(token, name)
+}
+
+// Create the MCP voice service for a phone line on the ONT, with the SIP credentials from the telephone API and the
+// settings for its domain from the voice catalogue
+func createVoice(request telmaxprovision.ProvisionRequest, name string, subscriber string, CP string, voicesvc devices.VoiceService) (string, error) {
+	log.Infof("Creating voice service for DID (%s)", voicesvc.Username)
+	settings, ok := voiceProfile(voicesvc.Domain)
+	if !ok {
+		err := fmt.Errorf("SIP domain (%s) for DID (%s) is not in the voice catalogue", voicesvc.Domain, voicesvc.Username)
+		exception := request.NewException(Service.Name)
+		exception.Tag = "Unknown Voice Domain"
+		exception.Reference = voicesvc.Username
+		exception.ReferenceType = "DID"
+		exception.Error = err.Error()
+		Bus.SubmitException(exception)
+		return fmt.Sprintf("Could not add DID (%s) - %v", voicesvc.Username, err), err
+	}
+	if settings.ContentProvider != "" {
+		CP = settings.ContentProvider
+	}
+	// Get the DID information from the telephone database
+	did, err := GetDID(voicesvc.Username)
+	if err != nil {
+		log.Errorf("Problem getting voice DID %v", err)
+		return fmt.Sprintf("Could not get DID (%s) from telephone API - %v", voicesvc.Username, err), err
+	}
+	if did.UserData == nil {
+		err = fmt.Errorf("missing user data for DID (%s)", voicesvc.Username)
+		return fmt.Sprintf("Missing user data for DID (%s)", voicesvc.Username), err
 	}
+	log.Infof("DID data for (%s) is %v", voicesvc.Username, did)
+	// Create a voice service in MCP, now that we have all the information we need
+	err = mcp.CreatePhoneService(name, subscriber+"-ONT", subscriber, settings.Profile, CP, settings.Vlan, did.Number, did.UserData.SIPPassword, int(voicesvc.Line), settings.Codec, settings.SIPServer)
+	if err != nil {
+		return "Problem adding voice service " + err.Error(), err
+	}
+	rememberLine(subscriber, voicesvc)
+	return fmt.Sprintf("Added DID (%s) to FXS port (%d)", voicesvc.Username, int(voicesvc.Line)), nil
+}
+
+// The name MCP knows a PON by when the ONT is GPON
+func gponInterface(PON string) (string, error) {
+	tmp := strings.Split(PON, "-")
+	if len(tmp) < 2 {
+		return PON, fmt.Errorf("unexpected PON (%s)", PON)
+	}
+	// stouffville-olt01-pon01 then stouffville-olt01-gpon01
+	// OR sandiford-lab-olt01-pon01 then sandiford-lab-olt01-gpon01
+	// OR olt01-pon01 then olt01-gpon01
+	tmp[len(tmp)-1] = "g" + tmp[len(tmp)-1]
+	return strings.Join(tmp, "-"), nil
 }
 
 // Unprovision services - used for cancelling a customer, or backing out provisioning (wrong PON or other re-do)
 // This is similar to provision, but a bit simpler and only removes the services.  Could also apply for a cancellation
 // of a subset of services, but not the whole thing.
-// Does not unprovision Voice.
-func UnProvisionServices(request telmaxprovision.ProvisionRequest) {
-	result := telmaxprovision.ProvisionResult{
-		RequestID: request.RequestID,
-		Time:      time.Now(),
-	}
+// Voice services are removed on a Cancel, or when the request has a Phone product - see unProvisionVoice.
+func UnProvisionServices(request telmaxprovision.ProvisionRequest) (failed error) {
+	result := request.NewResult()
 	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
 	if err != nil {
 		log.Errorf("getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
 		result.Result = fmt.Sprintf("Problem getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return err
 	}
 	if subscribe.NetworkType != "Fibre" {
 		log.Debugf("nothing to do here")
@@ -386,12 +542,12 @@ func UnProvisionServices(request telmaxprovision.ProvisionRequest) {
 	subscriber := subscribe.AccountCode + "-" + subscribe.SubscribeCode
 	//		var site Site
 	//var circuit netdb.Circuit
-	circuit, err := netdb.GetSubscriberCircuit(CoreDB, subscriber)
+	circuit, err := netdb.GetSubscriberCircuit(NetDB, subscriber)
 	if err != nil {
 		log.Errorf("getting subscriber circuit (%s) - %v", subscriber, err)
 		result.Result = fmt.Sprintf("Problem getting subscriber circuit (%s) - %v", subscriber, err)
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return err
 	}
 	// Make a list of the services we need to remove  Mostly, we just need the name
 	for _, product := range request.Products {
@@ -401,7 +557,8 @@ func UnProvisionServices(request telmaxprovision.ProvisionRequest) {
 		if err != nil {
 			log.Errorf("getting maxbill product (%s) - %v", product.ProductCode, err)
 			result.Result = fmt.Sprintf("Problem getting maxbill product (%s) - %v", product.ProductCode, err)
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
+			failed = err
 			continue
 		}
 		name := subscriber + "-" + product.SubProductCode
@@ -414,7 +571,8 @@ func UnProvisionServices(request telmaxprovision.ProvisionRequest) {
 					log.Errorf("releasing subscribed circuit DHCP (%s) %v", productData.NetworkProfile.AddressPool, err)
 					result.Result = fmt.Sprintf("Problem releasing subscribed circuit DHCP (%s) %v", productData.NetworkProfile.AddressPool, err)
 					result.Success = false
-					kafka.SubmitResult(result)
+					Bus.SubmitResult(result)
+					failed = err
 				} else if success {
 					log.Infof("removed DHCP lease from pool (%s)", productData.NetworkProfile.AddressPool)
 				} else {
@@ -429,6 +587,7 @@ func UnProvisionServices(request telmaxprovision.ProvisionRequest) {
 			log.Errorf("deleting service (%s) - %v", name, err)
 			result.Result = fmt.Sprintf("Problem deleting service (%s) - %v", name, err)
 			result.Success = false
+			failed = err
 		} else {
 			result.Success = true
 			result.Result = fmt.Sprintf("Removed service (%s)", name)
@@ -436,22 +595,85 @@ func UnProvisionServices(request telmaxprovision.ProvisionRequest) {
 				result.Result += " and released DHCP binding."
 			}
 		}
-		kafka.SubmitResult(result)
+		Bus.SubmitResult(result)
+	}
+	if err := unProvisionVoice(request, subscribe); err != nil {
+		return err
 	}
+	return
 }
 
-// Remove the ONT and interfaces
-func DeleteONT(request telmaxprovision.ProvisionRequest) {
-	result := telmaxprovision.ProvisionResult{
-		RequestID: request.RequestID,
-		Time:      time.Now(),
+// Whether unprovisioning a request takes the phone lines with it
+func removesVoice(request telmaxprovision.ProvisionRequest) bool {
+	if request.RequestType == telmaxprovision.RequestCancel {
+		return true
+	}
+	for _, product := range request.Products {
+		if product.Category == telmaxprovision.CategoryPhone {
+			return true
+		}
+	}
+	return false
+}
+
+// The voice services unprovisioning a request removes.  A Cancel removes every line the subscriber has.  Otherwise
+// only the lines billing has taken off the ONT go - the DIDs still on the device record belong to phone products
+// the subscriber is keeping.
+func voiceRemovals(request telmaxprovision.ProvisionRequest, subscribe maxbill.Subscribe) (removals []serviceChange, err error) {
+	subscriber := subscribe.AccountCode + "-" + subscribe.SubscribeCode
+	var lines []devices.VoiceService
+	for _, ont := range subscriberONTs(request, subscribe) {
+		lines = append(lines, ont.VoiceServices...)
+	}
+	var voice []serviceChange
+	if request.RequestType == telmaxprovision.RequestCancel {
+		voice, err = voiceChanges(subscriber, nil, lines)
+	} else {
+		voice, err = voiceChanges(subscriber, lines, nil)
+	}
+	for _, change := range voice {
+		if change.action == ChangeVoiceDelete {
+			removals = append(removals, change)
+		}
 	}
+	return
+}
+
+// Remove the voice services for the phone lines that are going, as voiceRemovals decides
+func unProvisionVoice(request telmaxprovision.ProvisionRequest, subscribe maxbill.Subscribe) (failed error) {
+	if !removesVoice(request) {
+		return nil
+	}
+	result := request.NewResult()
+	subscriber := subscribe.AccountCode + "-" + subscribe.SubscribeCode
+	voice, err := voiceRemovals(request, subscribe)
+	if err != nil {
+		log.Errorf("checking voice services (%s) - %v", subscriber, err)
+		result.Result = fmt.Sprintf("Problem checking voice services (%s) - %v", subscriber, err)
+		Bus.SubmitResult(result)
+		return err
+	}
+	for _, change := range voice {
+		// The CP is only needed to create services
+		result.Result, err = applyVoice(request, change, subscriber, "")
+		result.Success = err == nil
+		Bus.SubmitResult(result)
+		if err != nil {
+			failed = err
+		}
+	}
+	return
+}
+
+// Remove the ONT and interfaces
+func DeleteONT(request telmaxprovision.ProvisionRequest) (failed error) {
+	result := request.NewResult()
 	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
 	if err != nil {
 		log.Errorf("getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
 		result.Result = fmt.Sprintf("Problem getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return err
 	}
 	if subscribe.NetworkType != "Fibre" {
 		log.Debugf("nothing to do here")
@@ -462,12 +684,12 @@ func DeleteONT(request telmaxprovision.ProvisionRequest) {
 	//		var site Site
 	var circuit netdb.Circuit
 	// Get the circuit so we can clean it up properly
-	circuit, err = netdb.GetSubscriberCircuit(CoreDB, subscriber)
+	circuit, err = netdb.GetSubscriberCircuit(NetDB, subscriber)
 	if err != nil {
 		log.Errorf("getting subscriber circuit (%s) - %v", subscriber, err)
 		result.Result = fmt.Sprintf("Problem getting subscriber circuit (%s) - %v", subscriber, err)
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return err
 	}
 	var ONT mcp.ONTData
 	for _, device := range request.Devices {
@@ -475,7 +697,8 @@ func DeleteONT(request telmaxprovision.ProvisionRequest) {
 		if err != nil {
 			log.Errorf("getting device definition (%s) - %v", device.DefinitionCode, err)
 			result.Result = fmt.Sprintf("Problem getting device definition (%s) - %v", device.DefinitionCode, err)
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
+			failed = err
 			continue
 		}
 		if definition.Vendor == "AdTran" {
@@ -487,6 +710,7 @@ func DeleteONT(request telmaxprovision.ProvisionRequest) {
 		log.Errorf("deleting ONT (%s) %v", name, err)
 		result.Result = fmt.Sprintf("Problem deleting ONT (%s) %v", name, err)
 		result.Success = false
+		failed = err
 	} else {
 		// Release the circuit back to the pool
 		err = netdb.ReleaseCircuit(CoreDB, circuit.ID)
@@ -497,23 +721,22 @@ func DeleteONT(request telmaxprovision.ProvisionRequest) {
 			log.Errorf("releasing circuit (%s) - %v", circuit.ID, err)
 			result.Result = fmt.Sprintf("releasing circuit (%s) - %v", circuit.ID, err)
 			result.Success = false
+			failed = err
 		}
 	}
-	kafka.SubmitResult(result)
+	Bus.SubmitResult(result)
+	return
 }
 
 // Handle an ONT swap through update mechanisms and reflow job
-func DeviceSwap(request telmaxprovision.ProvisionRequest) {
-	result := telmaxprovision.ProvisionResult{
-		RequestID: request.RequestID,
-		Time:      time.Now(),
-	}
+func DeviceSwap(request telmaxprovision.ProvisionRequest) (failed error) {
+	result := request.NewResult()
 	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
 	if err != nil {
 		log.Errorf("getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
 		result.Result = fmt.Sprintf("Problem getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
-		kafka.SubmitResult(result)
-		return
+		Bus.SubmitResult(result)
+		return err
 	}
 	if subscribe.NetworkType != "Fibre" {
 		log.Debugf("nothing to do here")
@@ -538,7 +761,8 @@ func DeviceSwap(request telmaxprovision.ProvisionRequest) {
 			if err != nil {
 				log.Errorf("getting device definition (%s) - %v", device.DefinitionCode, err)
 				result.Result = fmt.Sprintf("Problem getting device definition (%s) - %v", device.DefinitionCode, err)
-				kafka.SubmitResult(result)
+				Bus.SubmitResult(result)
+				failed = err
 				continue
 			}
 			var thisONT mcp.ONTData
@@ -557,7 +781,8 @@ func DeviceSwap(request telmaxprovision.ProvisionRequest) {
 				if err != nil {
 					log.Errorf("getting device (%s) - %v", definition.Model, err)
 					result.Result = fmt.Sprintf("Problem getting device (%s) - %v", definition.Model, err)
-					kafka.SubmitResult(result)
+					Bus.SubmitResult(result)
+					failed = err
 					continue
 				}
 				allONT = append(allONT, thisONT)
@@ -576,13 +801,14 @@ func DeviceSwap(request telmaxprovision.ProvisionRequest) {
 		if err != nil {
 			log.Errorf("updating ONT (%s) - %v", subscriber, err)
 			result.Result = fmt.Sprintf("Problem updating ONT (%s) - %v", subscriber, err)
-			kafka.SubmitResult(result)
-			return
+			Bus.SubmitResult(result)
+			return err
 		} else {
 			log.Infof("Updated ONT (%s) object and queued re-flow job", subscriber)
 			result.Result = fmt.Sprintf("Updated ONT (%s) object and queued re-flow job", subscriber)
 			result.Success = true
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
 		}
 	}
+	return
 }
@@ -0,0 +1,342 @@
+package main
+
+/*
+	Dry runs.  The planner looks up everything the handler would, and reports the circuit, DHCP address, VLAN and MCP
+	objects it would use as planned results, without assigning or creating anything.
+*/
+
+import (
+	"context"
+
+	"bitbucket.org/telmaxdc/telmax-common/devices"
+	"bitbucket.org/telmaxdc/telmax-common/maxbill"
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/dhcpdb"
+	"bitbucket.org/telmaxdc/telmax-provision/netdb"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// Report what HandleProvision would do with a request
+func PlanProvision(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
+	log.Infof("Planning provision request %v", request)
+	switch request.RequestType {
+	case telmaxprovision.RequestNew:
+		PlanNew(request)
+
+	case telmaxprovision.RequestUpdate:
+		PlanUpdate(request)
+
+	case telmaxprovision.RequestDeviceSwap:
+		PlanDeviceSwap(request)
+
+	case telmaxprovision.RequestDeviceReturn:
+		PlanReturn(request)
+
+	case telmaxprovision.RequestUnProvision:
+		PlanUnProvision(request)
+
+	case telmaxprovision.RequestCancel:
+		PlanUnProvision(request)
+		PlanDeleteONT(request)
+
+	case telmaxprovision.RequestSuspend:
+		PlanSuspend(request, true)
+
+	case telmaxprovision.RequestResume:
+		PlanSuspend(request, false)
+	}
+	return nil
+}
+
+// The circuit, ONT, addresses and services a new request would get
+func PlanNew(request telmaxprovision.ProvisionRequest) {
+	order, ok, _ := resolveNew(request)
+	if !ok {
+		return
+	}
+	result := request.NewResult()
+	circuit, existing, err := netdb.PlanCircuit(NetDB, order.PON, order.subscriber)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Would fail to assign a circuit (%s)(%s)(%s) - %v", order.site.WireCentre, order.PON, order.subscriber, err)
+		return
+	}
+	if existing {
+		Bus.SubmitPlanned(result, "Would re-use existing circuit (%s) ONU (%d)", circuit.ID, circuit.Unit)
+	} else {
+		Bus.SubmitPlanned(result, "Would assign circuit (%s) ONU (%d) to subscriber (%s)", circuit.ID, circuit.Unit, order.subscriber)
+	}
+	CP := circuit.AccessNode + "-cp"
+
+	PON := order.PON
+	if order.ont.IsGpon {
+		PON, err = gponInterface(PON)
+		if err != nil {
+			Bus.SubmitPlannedFailure(result, "Would fail to create ONT - %v", err)
+			return
+		}
+	}
+	Bus.SubmitPlanned(result, "Would create ONT (%s-ONT) model (%s) serial (%s) on (%s) ONU (%d) with %d Ethernet interfaces",
+		order.subscriber, order.ont.Definition.Model, order.ont.Device.Serial, PON, circuit.Unit, int(order.ont.Definition.EthernetPorts))
+
+	reservations := map[string]dhcpdb.Reservation{}
+	for pool := range order.pools {
+		reservation, existing, err := dhcpdb.DhcpPlan(circuit.RoutingNode, pool, order.subscriber)
+		if err != nil {
+			Bus.SubmitPlannedFailure(result, "Would fail to assign an address from pool (%s) on (%s) - %v", pool, circuit.RoutingNode, err)
+			continue
+		}
+		reservations[pool] = reservation
+		if existing {
+			Bus.SubmitPlanned(result, "Would keep address (%s) in pool (%s) with VLAN (%d)", reservation.V4Addr, pool, reservation.VlanID)
+		} else {
+			Bus.SubmitPlanned(result, "Would assign address (%s) from pool (%s) on (%s) with VLAN (%d)", reservation.V4Addr, pool, circuit.RoutingNode, reservation.VlanID)
+		}
+	}
+
+	for _, service := range order.services {
+		if service.ProductData.Category != "Internet" {
+			continue
+		}
+		service.Vlan = service.ProductData.NetworkProfile.Vlan
+		if service.ProductData.NetworkProfile.AddressPool != "" {
+			service.Vlan = reservations[service.ProductData.NetworkProfile.AddressPool].VlanID
+		}
+		Bus.SubmitPlanned(result, "Would create data service (%s) on (%s-ONT) port 1 with profile (%s) on VLAN (%d) through (%s)",
+			service.Name, order.subscriber, service.ProductData.NetworkProfile.ProfileName, service.Vlan, CP)
+	}
+
+	voice, err := voiceChanges(order.subscriber, order.ont.Device.VoiceServices, nil)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Would fail to check voice services (%s) - %v", order.subscriber, err)
+	}
+	for _, change := range voice {
+		planVoice(result, change)
+	}
+}
+
+// Report a voice change, with the DID details a new line would get
+func planVoice(result telmaxprovision.ProvisionResult, change serviceChange) {
+	switch change.action {
+	case ChangeVoice:
+		settings, ok := voiceProfile(change.voice.Domain)
+		did, err := GetDID(change.voice.Username)
+		if !ok {
+			Bus.SubmitPlannedFailure(result, "Would fail - SIP domain (%s) for DID (%s) is not in the voice catalogue", change.voice.Domain, change.voice.Username)
+		} else if err != nil {
+			Bus.SubmitPlannedFailure(result, "Would fail to get DID (%s) from telephone API - %v", change.voice.Username, err)
+		} else if did.UserData == nil {
+			Bus.SubmitPlannedFailure(result, "Would fail - missing user data for DID (%s)", change.voice.Username)
+		} else {
+			Bus.SubmitPlanned(result, "Would add DID (%s) to FXS port (%d) as (%s) with profile (%s) on VLAN (%d)",
+				did.Number, int(change.voice.Line), change.name, settings.Profile, settings.Vlan)
+		}
+	case ChangeVoiceMove:
+		Bus.SubmitPlanned(result, "Would move DID (%s) from FXS port (%d) to (%d)", change.voice.Username, change.oldLine, int(change.voice.Line))
+	case ChangeVoiceDelete:
+		Bus.SubmitPlanned(result, "Would remove voice service (%s) from FXS port (%d)", change.name, change.oldLine)
+	}
+}
+
+// Look up the fibre subscriber for a request that works on existing services.  Problems are sent as results.
+func planSubscriber(request telmaxprovision.ProvisionRequest, result telmaxprovision.ProvisionResult) (subscriber string, ok bool) {
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Problem getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
+		return "", false
+	}
+	if subscribe.NetworkType != "Fibre" {
+		log.Debugf("nothing to do here")
+		return "", false
+	}
+	return subscribe.AccountCode + "-" + subscribe.SubscribeCode, true
+}
+
+// The services and DHCP addresses UnProvisionServices would remove
+func PlanUnProvision(request telmaxprovision.ProvisionRequest) {
+	result := request.NewResult()
+	subscriber, ok := planSubscriber(request, result)
+	if !ok {
+		return
+	}
+	circuit, err := netdb.GetSubscriberCircuit(NetDB, subscriber)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Problem getting subscriber circuit (%s) - %v", subscriber, err)
+		return
+	}
+	for _, product := range request.Products {
+		productData, err := maxbill.GetProduct(CoreDB, "product_code", product.ProductCode)
+		if err != nil {
+			Bus.SubmitPlannedFailure(result, "Problem getting maxbill product (%s) - %v", product.ProductCode, err)
+			continue
+		}
+		if productData.NetworkProfile != nil && productData.NetworkProfile.AddressPool != "" {
+			pool := productData.NetworkProfile.AddressPool
+			reservation, existing, err := dhcpdb.DhcpPlan(circuit.RoutingNode, pool, subscriber)
+			if err == nil && existing {
+				Bus.SubmitPlanned(result, "Would release address (%s) in pool (%s)", reservation.V4Addr, pool)
+			} else {
+				Bus.SubmitPlanned(result, "No address to release in pool (%s)", pool)
+			}
+		}
+		Bus.SubmitPlanned(result, "Would delete service (%s-%s)", subscriber, product.SubProductCode)
+	}
+	if !removesVoice(request) {
+		return
+	}
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		return
+	}
+	voice, err := voiceRemovals(request, subscribe)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Would fail to check voice services (%s) - %v", subscriber, err)
+	}
+	for _, change := range voice {
+		planVoice(result, change)
+	}
+}
+
+// The ONT and circuit DeleteONT would remove
+func PlanDeleteONT(request telmaxprovision.ProvisionRequest) {
+	result := request.NewResult()
+	subscriber, ok := planSubscriber(request, result)
+	if !ok {
+		return
+	}
+	circuit, err := netdb.GetSubscriberCircuit(NetDB, subscriber)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Problem getting subscriber circuit (%s) - %v", subscriber, err)
+		return
+	}
+	Bus.SubmitPlanned(result, "Would delete ONT (%s-ONT) and release circuit (%s)", subscriber, circuit.ID)
+}
+
+// The ONT updates DeviceSwap would make
+func PlanDeviceSwap(request telmaxprovision.ProvisionRequest) {
+	result := request.NewResult()
+	subscriber, ok := planSubscriber(request, result)
+	if !ok {
+		return
+	}
+	for _, device := range request.Devices {
+		if device.DeviceType != "AccessTerminal" {
+			continue
+		}
+		definition, err := devices.GetDeviceDefinition(CoreDB, "devicedefinition_code", device.DefinitionCode)
+		if err != nil {
+			Bus.SubmitPlannedFailure(result, "Problem getting device definition (%s) - %v", device.DefinitionCode, err)
+			continue
+		}
+		if definition.Vendor != "AdTran" || (definition.Upstream != "XGSPON" && definition.Upstream != "GPON") {
+			continue
+		}
+		ont, err := devices.GetDevice(CoreDB, "device_code", device.DeviceCode)
+		if err != nil {
+			Bus.SubmitPlannedFailure(result, "Problem getting device (%s) - %v", definition.Model, err)
+			continue
+		}
+		Bus.SubmitPlanned(result, "Would update ONT (%s-ONT) to model (%s) serial (%s) and queue a re-flow job", subscriber, definition.Model, ont.Serial)
+	}
+}
+
+// The services SuspendServices would stop or start
+func PlanSuspend(request telmaxprovision.ProvisionRequest, suspend bool) {
+	result := request.NewResult()
+	subscriber, ok := planSubscriber(request, result)
+	if !ok {
+		return
+	}
+	phone := false
+	for _, product := range request.Products {
+		productData, err := maxbill.GetProduct(CoreDB, "product_code", product.ProductCode)
+		if err != nil {
+			Bus.SubmitPlannedFailure(result, "Problem getting maxbill product (%s) - %v", product.ProductCode, err)
+			continue
+		}
+		if productData.Category == telmaxprovision.CategoryPhone {
+			phone = true
+			continue
+		}
+		if productData.NetworkProfile == nil {
+			continue
+		}
+		name := subscriber + "-" + product.SubProductCode
+		switch {
+		case *WalledGarden != "" && productData.Category == telmaxprovision.CategoryInternet && suspend:
+			Bus.SubmitPlanned(result, "Would move service (%s) to profile (%s)", name, *WalledGarden)
+		case *WalledGarden != "" && productData.Category == telmaxprovision.CategoryInternet:
+			Bus.SubmitPlanned(result, "Would move service (%s) back to profile (%s)", name, productData.NetworkProfile.ProfileName)
+		case suspend:
+			Bus.SubmitPlanned(result, "Would deactivate service (%s)", name)
+		default:
+			Bus.SubmitPlanned(result, "Would activate service (%s)", name)
+		}
+	}
+	if !phone {
+		return
+	}
+	lines, err := knownLines(subscriber)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Problem getting voice lines (%s) - %v", subscriber, err)
+		return
+	}
+	for _, line := range lines {
+		if suspend {
+			Bus.SubmitPlanned(result, "Would deactivate voice service (%s-%s)", subscriber, line.Username)
+		} else {
+			Bus.SubmitPlanned(result, "Would activate voice service (%s-%s)", subscriber, line.Username)
+		}
+	}
+}
+
+// The changes UpdateServices would make
+func PlanUpdate(request telmaxprovision.ProvisionRequest) {
+	order, ok, _ := resolveUpdate(request)
+	if !ok {
+		return
+	}
+	result := request.NewResult()
+	if len(order.changes) == 0 {
+		Bus.SubmitPlanned(result, "Services are up to date - nothing would change")
+	}
+	for _, change := range order.changes {
+		switch change.action {
+		case ChangeCreate:
+			Bus.SubmitPlanned(result, "Would create data service (%s) with profile (%s) on VLAN (%d)", change.name, change.profile, change.vlan)
+		case ChangeProfile:
+			Bus.SubmitPlanned(result, "Would change service (%s) from profile (%s) to (%s)", change.name, change.oldProfile, change.profile)
+		case ChangeMove:
+			Bus.SubmitPlanned(result, "Would re-create service (%s) on VLAN (%d), moving it from VLAN (%d), with profile (%s)", change.name, change.vlan, change.oldVlan, change.profile)
+		case ChangeDelete:
+			if change.pool != "" {
+				Bus.SubmitPlanned(result, "Would delete service (%s) and release its address in pool (%s)", change.name, change.pool)
+			} else {
+				Bus.SubmitPlanned(result, "Would delete service (%s)", change.name)
+			}
+		case ChangeVoice, ChangeVoiceMove, ChangeVoiceDelete:
+			planVoice(result, change)
+		}
+	}
+}
+
+// The services and ONTs ReturnONT would remove
+func PlanReturn(request telmaxprovision.ProvisionRequest) {
+	result := request.NewResult()
+	orders, _ := resolveReturn(request)
+	for _, order := range orders {
+		serial := order.ont.Device.Serial
+		if !order.bound {
+			Bus.SubmitPlanned(result, "ONT with serial (%s) is not provisioned for (%s) in MCP - would only mark it as %s", serial, order.subscriber, ReturnedLocation)
+			continue
+		}
+		for _, name := range order.services {
+			Bus.SubmitPlanned(result, "Would delete service (%s)", name)
+		}
+		for _, username := range order.voice {
+			Bus.SubmitPlanned(result, "Would delete voice service (%s-%s)", order.subscriber, username)
+		}
+		Bus.SubmitPlanned(result, "Would delete ONT (%s-ONT) with serial (%s) and its interfaces, keeping the circuit, and mark it as %s",
+			order.subscriber, serial, ReturnedLocation)
+	}
+}
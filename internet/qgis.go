@@ -8,11 +8,13 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 )
 
 var (
-	QGISAPI    = "http://qgis.api.telmax.ca:5008/"
-	QGISAPIKey = "098g5467o456n78s8e5878c8ty4578uihdsrc"
+	QGISAPI = "http://qgis.api.telmax.ca:5008/"
 )
 
 type Site struct {
@@ -34,12 +36,13 @@ type Site struct {
 }
 
 func GetSite(ID string) (site Site, err error) {
+	defer metrics.Backend("qgis", "getsite").Done(&err)
 	client := http.Client{
 		Timeout: time.Second * 4,
 	}
 	url := QGISAPI + "/getsite/" + ID
 	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("api-key", QGISAPIKey)
+	req.Header.Set("api-key", secrets.Get("qgis.apikey", ""))
 	var response *http.Response
 	response, err = client.Do(req)
 	if err != nil {
@@ -0,0 +1,216 @@
+package main
+
+/*
+	Device returns.  A returned ONT is taken out of MCP - the services on it, its interfaces and the device object
+	holding its serial - so it can be re-used for another subscriber.  The circuit, ONU ID and DHCP reservations stay
+	with the subscriber, so a replacement ONT can be dropped in with a New or DeviceSwap request and get the same ones.
+*/
+
+import (
+	"fmt"
+
+	"bitbucket.org/telmaxdc/telmax-common"
+	"bitbucket.org/telmaxdc/telmax-common/devices"
+	"bitbucket.org/telmaxdc/telmax-common/maxbill"
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/mcp"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// Where a returned device is, once it is back from the customer
+const ReturnedLocation = "Returned"
+
+// An ONT being returned, and the MCP objects that go with it
+type returnOrder struct {
+	subscriber string
+	ont        mcp.ONTData
+	bound      bool     // MCP has the ONT on the subscriber's device object - nothing to remove if not
+	services   []string // MCP data services on the ONT
+	voice      []string // DIDs of the MCP voice services on the ONT
+}
+
+// Find the returned ONTs on a request and what MCP has for them.  Problems are sent as results, and failed is the
+// last of them.
+func resolveReturn(request telmaxprovision.ProvisionRequest) (orders []returnOrder, failed error) {
+	result := request.NewResult()
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		log.Errorf("getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
+		result.Result = fmt.Sprintf("Problem getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
+		Bus.SubmitResult(result)
+		return nil, err
+	}
+	if subscribe.NetworkType != "Fibre" {
+		log.Debugf("nothing to do here")
+		return
+	}
+	subscriber := subscribe.AccountCode + "-" + subscribe.SubscribeCode
+	var token string
+	for _, device := range request.Devices {
+		if device.DeviceType != "AccessTerminal" {
+			continue
+		}
+		definition, err := devices.GetDeviceDefinition(CoreDB, "devicedefinition_code", device.DefinitionCode)
+		if err != nil {
+			log.Errorf("getting device definition (%s) - %v", device.DefinitionCode, err)
+			result.Result = fmt.Sprintf("Problem getting device definition (%s) - %v", device.DefinitionCode, err)
+			Bus.SubmitResult(result)
+			failed = err
+			continue
+		}
+		if definition.Vendor != "AdTran" {
+			continue
+		}
+		order := returnOrder{subscriber: subscriber}
+		order.ont.Definition = definition
+		order.ont.Device, err = devices.GetDevice(CoreDB, "device_code", device.DeviceCode)
+		if err != nil {
+			log.Errorf("getting device (%s) - %v", device.DeviceCode, err)
+			result.Result = fmt.Sprintf("Problem getting device (%s) - %v", device.DeviceCode, err)
+			Bus.SubmitResult(result)
+			failed = err
+			continue
+		}
+		if token == "" {
+			token, err = mcp.MCPAuth()
+			if err != nil {
+				log.Errorf("Could not authenticate to MCP %v", err)
+				result.Result = fmt.Sprintf("Problem authenticating to MCP - %v", err)
+				Bus.SubmitResult(result)
+				return nil, err
+			}
+		}
+		// A replacement may already be on the device object, and it must not be touched
+		deviceInfo, err := mcp.GetDevice(token, subscriber+"-ONT")
+		if err != nil {
+			// Without knowing what is on the device object, leave the ONT where it is
+			log.Errorf("getting device (%s-ONT) from MCP - %v", subscriber, err)
+			result.Result = fmt.Sprintf("Problem getting device (%s-ONT) from MCP - %v", subscriber, err)
+			Bus.SubmitResult(result)
+			failed = transient(err)
+			continue
+		}
+		order.bound = deviceInfo.State != "" && deviceInfo.Parameters.Serial == order.ont.Device.Serial
+		if order.bound {
+			order.services, order.voice = returnServices(token, subscribe, order.ont.Device)
+		} else {
+			log.Infof("ONT (%s) is not on (%s-ONT) in MCP", order.ont.Device.Serial, subscriber)
+		}
+		orders = append(orders, order)
+	}
+	return
+}
+
+// The MCP services on a subscriber's ONT - the data services for their Internet products, and the DIDs of the voice
+// services for the phone lines on the device
+func returnServices(token string, subscribe maxbill.Subscribe, ont devices.Device) (services []string, voice []string) {
+	subscriber := subscribe.AccountCode + "-" + subscribe.SubscribeCode
+	var names []string
+	subscribed, err := maxbill.GetServices(CoreDB, []telmax.Filter{
+		telmax.Filter{Key: "account_code", Value: subscribe.AccountCode},
+		telmax.Filter{Key: "subscribe_code", Value: subscribe.SubscribeCode},
+	})
+	if err != nil {
+		log.Errorf("getting subscribed products (%s) - %v", subscriber, err)
+	}
+	for _, product := range subscribed {
+		productData, err := maxbill.GetProduct(CoreDB, "product_code", product.ProductCode)
+		if err == nil && productData.NetworkProfile != nil && productData.Category == telmaxprovision.CategoryInternet {
+			names = append(names, subscriber+"-"+product.SubProductCode)
+		}
+	}
+	exists := func(name string) bool {
+		info, err := mcp.GetService(token, name)
+		return err == nil && info.Exists()
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !seen[name] && exists(name) {
+			services = append(services, name)
+		}
+		seen[name] = true
+	}
+	for _, voicesvc := range ont.VoiceServices {
+		name := subscriber + "-" + voicesvc.Username
+		if voicesvc.Username != "" && !seen[name] && exists(name) {
+			voice = append(voice, voicesvc.Username)
+		}
+		seen[name] = true
+	}
+	return
+}
+
+// Take returned ONTs out of MCP, keeping the circuit, and mark them as returned.  Every ONT is tried - the last
+// problem is returned.
+func ReturnONT(request telmaxprovision.ProvisionRequest) (failed error) {
+	result := request.NewResult()
+	orders, failed := resolveReturn(request)
+	for _, order := range orders {
+		serial := order.ont.Device.Serial
+		result.Reference = order.ont.Device.DeviceCode
+		result.ReferenceType = "DeviceCode"
+		if order.bound {
+			// The services go first, as MCP won't delete interfaces that are in use
+			for _, name := range order.services {
+				err := mcp.DeleteService(name)
+				if err != nil {
+					log.Errorf("deleting service (%s) - %v", name, err)
+					result.Result = fmt.Sprintf("Problem deleting service (%s) - %v", name, err)
+					result.Success = false
+					failed = err
+				} else {
+					result.Result = fmt.Sprintf("Removed service (%s)", name)
+					result.Success = true
+				}
+				Bus.SubmitResult(result)
+			}
+			for _, username := range order.voice {
+				name := order.subscriber + "-" + username
+				err := deleteVoice(order.subscriber, username)
+				if err != nil {
+					log.Errorf("deleting voice service (%s) - %v", name, err)
+					result.Result = fmt.Sprintf("Problem deleting voice service (%s) - %v", name, err)
+					result.Success = false
+					failed = err
+				} else {
+					result.Result = fmt.Sprintf("Removed voice service (%s)", name)
+					result.Success = true
+				}
+				Bus.SubmitResult(result)
+			}
+			err := mcp.DeleteONT(order.subscriber, order.ont)
+			if err != nil {
+				log.Errorf("deleting ONT (%s-ONT) - %v", order.subscriber, err)
+				result.Result = fmt.Sprintf("Problem deleting ONT (%s-ONT) with serial (%s) - %v", order.subscriber, serial, err)
+				result.Success = false
+				Bus.SubmitResult(result)
+				failed = err
+				// Still with the customer as far as MCP is concerned
+				continue
+			}
+			result.Result = fmt.Sprintf("Removed ONT (%s-ONT) with serial (%s) and its interfaces - the circuit is kept for a replacement", order.subscriber, serial)
+			result.Success = true
+			Bus.SubmitResult(result)
+		} else {
+			result.Result = fmt.Sprintf("ONT with serial (%s) is not provisioned for (%s) in MCP - nothing to remove", serial, order.subscriber)
+			result.Success = true
+			Bus.SubmitResult(result)
+		}
+
+		device := order.ont.Device
+		device.Location = ReturnedLocation
+		err := device.Update(CoreDB)
+		if err != nil {
+			log.Errorf("Problem updating device record (%s) - %v", device.DeviceCode, err)
+			result.Result = fmt.Sprintf("Problem updating device record for ONT (%s) - %v", serial, err)
+			result.Success = false
+			failed = err
+		} else {
+			result.Result = fmt.Sprintf("Marked ONT (%s) as %s", serial, ReturnedLocation)
+			result.Success = true
+		}
+		Bus.SubmitResult(result)
+	}
+	return
+}
@@ -0,0 +1,266 @@
+package main
+
+/*
+	Provisioning a new subscriber is a list of steps - circuit, ONT, DHCP addresses, then the data and voice services.
+	Each step that changes something knows how to undo it.  If a step fails, the request's OnFailure policy decides
+	what happens to the ones already done:
+
+	rollback	undo them, latest first, so nothing is left half built
+	checkpoint	leave them, and record how far we got.  Re-driving the request from the dead letter topic carries on
+			from the step that failed.
+
+	A retryable failure always leaves a checkpoint, so the retry carries on too.  The checkpoint is written after
+	every step, so a request that was cut off part way is picked up where it stopped when it is delivered again.
+	Every step, skip and undo is sent as a result.
+*/
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/mcp"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+const CheckpointCollection = "provision_checkpoints"
+
+var (
+	FailurePolicy = flag.String("failure.policy", string(telmaxprovision.FailureRollback), "What to do when a new request fails part way, for requests that don't say - rollback or checkpoint")
+
+	Checkpoints *mongo.Collection
+)
+
+// A change to the network, and how to put it back
+type Step struct {
+	Name   string                                        // Unique within the request - a checkpoint finds the step by it
+	Repeat bool                                          // Run it again when resuming, because later steps need what it finds.  It must be safe to repeat.
+	Do     func() (text string, changed bool, err error) // Make the change.  Changed is false if it was already done, so there is nothing to undo.
+	Undo   func() (string, error)                        // Undo the change - nil if it can't be undone
+}
+
+// A step that is done, as it is kept in a checkpoint
+type DoneStep struct {
+	Name    string `bson:"name"`
+	Changed bool   `bson:"changed"` // Undone on a rollback
+}
+
+// How far a request got
+type Checkpoint struct {
+	RequestID     string     `bson:"request_id"`
+	AccountCode   string     `bson:"account_code"`
+	SubscribeCode string     `bson:"subscribe_code"`
+	Done          []DoneStep `bson:"done"`
+	Failed        string     `bson:"failed,omitempty"` // The step that failed
+	Error         string     `bson:"error,omitempty"`
+	Updated       time.Time  `bson:"updated"`
+}
+
+// The steps of one request
+type Run struct {
+	request    telmaxprovision.ProvisionRequest
+	result     telmaxprovision.ProvisionResult
+	checkpoint Checkpoint
+	resumed    map[string]bool // Steps done before this delivery, by whether they changed anything
+	done       []Step
+	changed    []bool
+	failed     error
+}
+
+func InitCheckpoints(db *mongo.Database) {
+	Checkpoints = db.Collection(CheckpointCollection)
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{"request_id", 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{"account_code", 1}, {"subscribe_code", 1}}},
+	}
+	_, err := Checkpoints.Indexes().CreateMany(context.TODO(), indexes)
+	if err != nil {
+		log.Errorf("Problem creating checkpoint indexes - %v", err)
+	}
+}
+
+// Start the steps for a request, carrying on from its checkpoint if it has one
+func StartRun(request telmaxprovision.ProvisionRequest) *Run {
+	run := &Run{
+		request: request,
+		result:  request.NewResult(),
+		checkpoint: Checkpoint{
+			RequestID:     request.RequestID,
+			AccountCode:   request.AccountCode,
+			SubscribeCode: request.SubscribeCode,
+		},
+		resumed: map[string]bool{},
+	}
+	var saved Checkpoint
+	err := Checkpoints.FindOne(context.TODO(), bson.D{{"request_id", request.RequestID}}).Decode(&saved)
+	if err == nil {
+		log.Infof("Resuming request %v from its checkpoint - %d steps done, %v failed", request.RequestID, len(saved.Done), saved.Failed)
+		for _, step := range saved.Done {
+			run.resumed[step.Name] = step.Changed
+		}
+	} else if err != mongo.ErrNoDocuments {
+		log.Errorf("Problem reading checkpoint for %v - %v", request.RequestID, err)
+	}
+	return run
+}
+
+// The policy for this request
+func (run *Run) Policy() telmaxprovision.FailurePolicy {
+	if run.request.OnFailure != "" {
+		return run.request.OnFailure
+	}
+	return telmaxprovision.FailurePolicy(*FailurePolicy)
+}
+
+// Do a step, unless an earlier one failed.  Returns false once a step has failed, so the caller can stop.
+func (run *Run) Step(step Step) bool {
+	if run.failed != nil {
+		return false
+	}
+	changedBefore, resumed := run.resumed[step.Name]
+	if resumed && !step.Repeat {
+		log.Infof("Skipping step %v of %v - done before", step.Name, run.request.RequestID)
+		run.report(true, fmt.Sprintf("Already done (%s) - carrying on from the checkpoint", step.Name))
+		run.record(step, changedBefore)
+		return true
+	}
+
+	text, changed, err := step.Do()
+	if err != nil {
+		log.Errorf("Step %v of %v failed - %v", step.Name, run.request.RequestID, err)
+		run.failed = transient(err)
+		run.checkpoint.Failed = step.Name
+		run.checkpoint.Error = err.Error()
+		run.report(false, text)
+		run.save()
+		return false
+	}
+	run.report(true, text)
+	run.record(step, changed || changedBefore)
+	run.save()
+	return true
+}
+
+// Mark the errors we get when MCP or the DHCP database can't be reached or doesn't answer in time as retryable, so
+// the request is tried again later instead of parked
+func transient(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, mcp.ErrGaveUp):
+		return kafka.Retryable(err)
+	}
+	return err
+}
+
+// Keep a step that is done, so it can be undone
+func (run *Run) record(step Step, changed bool) {
+	run.done = append(run.done, step)
+	run.changed = append(run.changed, changed)
+	run.checkpoint.Done = append(run.checkpoint.Done, DoneStep{Name: step.Name, Changed: changed})
+}
+
+// Clear the checkpoint once every step is done, or deal with the steps that were done if one failed.  Returns the
+// failure, so the request is parked or retried.
+func (run *Run) Finish() error {
+	if run.failed == nil {
+		run.clear()
+		return nil
+	}
+	if kafka.IsRetryable(run.failed) {
+		log.Warnf("Request %v will be retried from step %v", run.request.RequestID, run.checkpoint.Failed)
+		return run.failed
+	}
+	exception := run.request.NewException(Service.Name)
+	exception.Reference = run.request.RequestID
+	exception.ReferenceType = "RequestID"
+	if run.Policy() == telmaxprovision.FailureCheckpoint {
+		exception.Tag = "Provisioning Checkpointed"
+		exception.Error = fmt.Sprintf("Stopped at (%s) - %v.  %d steps were left in place - re-drive the request to carry on from there.",
+			run.checkpoint.Failed, run.failed, len(run.done))
+		Bus.SubmitException(exception)
+		return run.failed
+	}
+
+	undone, problems := run.rollback()
+	exception.Tag = "Provisioning Rolled Back"
+	exception.Error = fmt.Sprintf("Stopped at (%s) - %v.  Undid %d steps.", run.checkpoint.Failed, run.failed, undone)
+	if len(problems) > 0 {
+		exception.Tag = "Rollback Failed"
+		exception.Alert = true
+		exception.Error += "  Could not undo " + strings.Join(problems, ", ") + " - they need to be cleaned up by hand."
+		// Only what is still in place counts as done if the request is re-driven
+		var left []DoneStep
+		for _, step := range run.checkpoint.Done {
+			for _, problem := range problems {
+				if step.Name == problem {
+					left = append(left, step)
+				}
+			}
+		}
+		run.checkpoint.Done = left
+		run.save()
+	} else {
+		run.clear()
+	}
+	Bus.SubmitException(exception)
+	return run.failed
+}
+
+// Undo the steps that changed something, latest first
+func (run *Run) rollback() (undone int, problems []string) {
+	for i := len(run.done) - 1; i >= 0; i-- {
+		step := run.done[i]
+		if !run.changed[i] || step.Undo == nil {
+			continue
+		}
+		text, err := step.Undo()
+		if err != nil {
+			log.Errorf("Could not undo step %v of %v - %v", step.Name, run.request.RequestID, err)
+			run.report(false, fmt.Sprintf("Problem rolling back (%s) - %v", step.Name, err))
+			problems = append(problems, step.Name)
+			continue
+		}
+		run.report(true, "Rolled back - "+text)
+		undone++
+	}
+	return
+}
+
+func (run *Run) report(success bool, text string) {
+	run.result.Success = success
+	run.result.Result = text
+	run.result.Time = time.Now()
+	Bus.SubmitResult(run.result)
+}
+
+func (run *Run) save() {
+	run.checkpoint.Updated = time.Now()
+	filter := bson.D{{"request_id", run.request.RequestID}}
+	_, err := Checkpoints.ReplaceOne(context.TODO(), filter, run.checkpoint, options.Replace().SetUpsert(true))
+	if err != nil {
+		log.Errorf("Problem saving checkpoint for %v - %v", run.request.RequestID, err)
+	}
+}
+
+func (run *Run) clear() {
+	_, err := Checkpoints.DeleteOne(context.TODO(), bson.D{{"request_id", run.request.RequestID}})
+	if err != nil {
+		log.Errorf("Problem clearing checkpoint for %v - %v", run.request.RequestID, err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+
+	"bitbucket.org/telmaxdc/telmax-common/devices"
+
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/mcp"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+func TestTransient(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "https://mcp", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{"MCP unreachable", refused, true},
+		{"MCP still working", fmt.Errorf("%w after 60 seconds", mcp.ErrGaveUp), true},
+		{"timed out", context.DeadlineExceeded, true},
+		{"DHCP connection dropped", driver.ErrBadConn, true},
+		{"MCP said no", errors.New("Subscriber ACCT0001-SUBS001 ONT already deployed with serial number ABC"), false},
+		{"no addresses", errors.New("No addresses available in pool Residential on node Brooklin"), false},
+	}
+	for _, test := range tests {
+		err := transient(test.err)
+		if kafka.IsRetryable(err) != test.retryable {
+			t.Errorf("%s: retryable = %v, want %v", test.name, kafka.IsRetryable(err), test.retryable)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: lost the original error", test.name)
+		}
+	}
+}
+
+// An ONT or service the subscriber already had isn't the request's to take away when it is rolled back
+func TestExistingNotUndone(t *testing.T) {
+	Bus = kafka.NewClient(kafka.NewMemoryBroker())
+	deployed := func(serial string) func(name string) (mcp.MCPDeviceInfo, error) {
+		return func(name string) (info mcp.MCPDeviceInfo, err error) {
+			info.State = "deployed"
+			info.Parameters.Serial = serial
+			return
+		}
+	}
+	deployedService := func(name string) (info mcp.MCPServiceInfo, err error) {
+		info.State = "deployed"
+		info.Uplink.InterfaceEndpoint.OuterTagVlanID = float64(100)
+		return
+	}
+	ont := mcp.ONTData{Device: devices.Device{Serial: "ADTN1234"}}
+	service := mcp.OLTService{Name: "ACCT0001-SUBS001-PROD0001", Vlan: 100}
+
+	run := &Run{request: telmaxprovision.ProvisionRequest{RequestID: "req-1"}}
+	for _, step := range []Step{
+		ontStep("ACCT0001-SUBS001", ont, "PON1", 3, deployed("ADTN1234")),
+		serviceStep(service, "ACCT0001-SUBS001", "OLT1-cp", deployedService),
+	} {
+		text, changed, err := step.Do()
+		if err != nil || changed {
+			t.Errorf("%s: Do = %q, changed %v, %v", step.Name, text, changed, err)
+		}
+		run.record(step, changed)
+	}
+	undone, problems := run.rollback()
+	if undone != 0 || len(problems) > 0 {
+		t.Errorf("rollback undid %d, problems %v", undone, problems)
+	}
+
+	// Someone else's ONT on the device object is a failure, not something to re-use
+	_, changed, err := ontStep("ACCT0001-SUBS001", ont, "PON1", 3, deployed("ADTN9999")).Do()
+	if err == nil || changed {
+		t.Errorf("ONT with another serial: changed %v, %v", changed, err)
+	}
+}
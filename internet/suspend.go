@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"bitbucket.org/telmaxdc/telmax-common/maxbill"
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/mcp"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+var WalledGarden = flag.String("suspend.profile", "", "MCP profile to move suspended Internet services to, such as a walled garden - they are deactivated instead when empty")
+
+// Stop or start the services in a request, keeping the ONT, circuit and DHCP reservations so nothing has to be
+// assigned again.  Services are deactivated in MCP, or for Internet services with a walled garden profile set,
+// moved to that profile in place.  A Phone product stops or starts the voice services of every line we created for
+// the subscriber, since those are named by DID rather than by product.
+func SuspendServices(request telmaxprovision.ProvisionRequest, suspend bool) (failed error) {
+	result := request.NewResult()
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		log.Errorf("getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
+		result.Result = fmt.Sprintf("Problem getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
+		Bus.SubmitResult(result)
+		return err
+	}
+	if subscribe.NetworkType != "Fibre" {
+		log.Debugf("nothing to do here")
+		return
+	}
+	subscriber := subscribe.AccountCode + "-" + subscribe.SubscribeCode
+	phone := false
+	for _, product := range request.Products {
+		productData, err := maxbill.GetProduct(CoreDB, "product_code", product.ProductCode)
+		if err != nil {
+			log.Errorf("getting maxbill product (%s) - %v", product.ProductCode, err)
+			result.Result = fmt.Sprintf("Problem getting maxbill product (%s) - %v", product.ProductCode, err)
+			result.Success = false
+			Bus.SubmitResult(result)
+			failed = err
+			continue
+		}
+		if productData.Category == telmaxprovision.CategoryPhone {
+			phone = true
+			continue
+		}
+		if productData.NetworkProfile == nil {
+			continue
+		}
+		network := productData.NetworkProfile
+		name := subscriber + "-" + product.SubProductCode
+		var text string
+		if *WalledGarden != "" && productData.Category == telmaxprovision.CategoryInternet {
+			profile := network.ProfileName
+			if suspend {
+				profile = *WalledGarden
+			}
+			err = mcp.ModifyServiceProfile(name, subscriber, profile)
+			text = fmt.Sprintf("Moved service (%s) to profile (%s)", name, profile)
+		} else {
+			text, err = suspendService(name, suspend)
+		}
+		if err != nil {
+			log.Errorf("changing service (%s) - %v", name, err)
+			result.Result = fmt.Sprintf("Problem changing service (%s) for %s - %v", name, request.RequestType, err)
+			result.Success = false
+			failed = err
+		} else {
+			result.Result = text
+			result.Success = true
+		}
+		Bus.SubmitResult(result)
+	}
+	if phone {
+		if err := suspendVoice(request, subscriber, suspend); err != nil {
+			failed = err
+		}
+	}
+	return
+}
+
+// Stop or start the voice services for the lines we created for a subscriber
+func suspendVoice(request telmaxprovision.ProvisionRequest, subscriber string, suspend bool) (failed error) {
+	result := request.NewResult()
+	lines, err := knownLines(subscriber)
+	if err != nil {
+		log.Errorf("getting voice lines (%s) - %v", subscriber, err)
+		result.Result = fmt.Sprintf("Problem getting voice lines (%s) - %v", subscriber, err)
+		Bus.SubmitResult(result)
+		return err
+	}
+	for _, line := range lines {
+		name := subscriber + "-" + line.Username
+		result.Result, err = suspendService(name, suspend)
+		result.Success = err == nil
+		if err != nil {
+			log.Errorf("changing voice service (%s) - %v", name, err)
+			result.Result = fmt.Sprintf("Problem changing voice service (%s) for %s - %v", name, request.RequestType, err)
+			failed = err
+		}
+		Bus.SubmitResult(result)
+	}
+	return
+}
+
+// Deactivate a service for a suspend, or activate it again for a resume
+func suspendService(name string, suspend bool) (string, error) {
+	if suspend {
+		return fmt.Sprintf("Deactivated service (%s)", name), mcp.DeactivateService(name)
+	}
+	return fmt.Sprintf("Activated service (%s)", name), mcp.ActivateService(name)
+}
@@ -0,0 +1,365 @@
+package main
+
+/*
+	Updates.  An Update carries the products the subscription should have now.  Rather than provisioning it again, we
+	compare it with the services MCP has and the addresses the DHCP database holds for the subscriber, and only change
+	the difference:
+
+	- a product with no service gets one, with an address from its pool if it needs one
+	- a service on the wrong profile is modified in place, such as for a speed upgrade or downgrade
+	- a service on the wrong VLAN is re-created on the right one
+	- a service for a product the subscription had, that is not on the request and has ended or been cancelled in
+	  billing, is deleted and its address released.  Anything else not on the request is left alone.
+	- voice services follow the phone lines on the ONT - see voice.go
+*/
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"bitbucket.org/telmaxdc/telmax-common"
+	"bitbucket.org/telmaxdc/telmax-common/devices"
+	"bitbucket.org/telmaxdc/telmax-common/maxbill"
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/dhcpdb"
+	"bitbucket.org/telmaxdc/telmax-provision/mcp"
+	"bitbucket.org/telmaxdc/telmax-provision/netdb"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+var EndedStatuses = flag.String("update.ended", "Cancel,Cancelled,Ended", "Billing statuses of subscribed products whose services an Update deletes")
+
+// Whether a subscribed product has ended or been cancelled in billing, so its service can go
+func productEnded(status string) bool {
+	for _, ended := range strings.Split(*EndedStatuses, ",") {
+		if strings.EqualFold(strings.TrimSpace(ended), status) {
+			return true
+		}
+	}
+	return false
+}
+
+// What an Update has to do to one service
+type ChangeAction string
+
+const (
+	ChangeCreate      ChangeAction = "create"
+	ChangeProfile     ChangeAction = "profile"
+	ChangeMove        ChangeAction = "move"
+	ChangeDelete      ChangeAction = "delete"
+	ChangeVoice       ChangeAction = "voice"
+	ChangeVoiceMove   ChangeAction = "voice move"
+	ChangeVoiceDelete ChangeAction = "voice delete"
+)
+
+// One difference between a request and the network
+type serviceChange struct {
+	action     ChangeAction
+	name       string
+	profile    string // The profile the service should have
+	oldProfile string // The profile it has now
+	pool       string // DHCP pool, if the service takes an address from one
+	vlan       int
+	oldVlan    int
+	voice      devices.VoiceService
+	oldLine    int // The FXS port a voice service is on now
+}
+
+// The subscriber, circuit and changes an Update needs
+type updateOrder struct {
+	subscriber string
+	circuit    netdb.Circuit
+	changes    []serviceChange
+}
+
+// Compare the services on a request with MCP and DHCP.  Problems are sent as results, and ok is false if there is
+// nothing to compare with.  Failed is the last problem, even one that only left a service out of the changes.
+func resolveUpdate(request telmaxprovision.ProvisionRequest) (order updateOrder, ok bool, failed error) {
+	result := request.NewResult()
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		log.Errorf("getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
+		result.Result = fmt.Sprintf("Problem getting subscriber (%s)(%s) - %v", request.AccountCode, request.SubscribeCode, err)
+		Bus.SubmitResult(result)
+		return order, false, err
+	}
+	if subscribe.NetworkType != "Fibre" {
+		log.Debugf("nothing to do here")
+		return order, false, nil
+	}
+	subscriber := subscribe.AccountCode + "-" + subscribe.SubscribeCode
+	circuit, err := netdb.GetSubscriberCircuit(NetDB, subscriber)
+	if err != nil {
+		log.Errorf("getting subscriber circuit (%s) - %v", subscriber, err)
+		result.Result = fmt.Sprintf("Subscriber (%s) has no circuit to update - %v", subscriber, err)
+		Bus.SubmitResult(result)
+		return order, false, err
+	}
+	token, err := mcp.MCPAuth()
+	if err != nil {
+		log.Errorf("Could not authenticate to MCP %v", err)
+		result.Result = fmt.Sprintf("Problem authenticating to MCP - %v", err)
+		Bus.SubmitResult(result)
+		return order, false, err
+	}
+	order = updateOrder{subscriber: subscriber, circuit: circuit}
+
+	// The data services the request wants, by name
+	wanted := map[string]bool{}
+	pools := map[string]bool{}
+	for _, product := range request.Products {
+		productData, err := maxbill.GetProduct(CoreDB, "product_code", product.ProductCode)
+		if err != nil {
+			log.Errorf("getting maxbill product (%s) - %v", product.ProductCode, err)
+			result.Result = fmt.Sprintf("Problem getting maxbill product (%s) - %v", product.ProductCode, err)
+			Bus.SubmitResult(result)
+			return order, false, err
+		}
+		if productData.NetworkProfile == nil || productData.Category != telmaxprovision.CategoryInternet || product.SubProductCode == "" {
+			continue
+		}
+		network := productData.NetworkProfile
+		change := serviceChange{
+			name:    subscriber + "-" + product.SubProductCode,
+			profile: network.ProfileName,
+			pool:    network.AddressPool,
+			vlan:    network.Vlan,
+		}
+		wanted[change.name] = true
+		if change.pool != "" {
+			pools[change.pool] = true
+			reservation, _, err := dhcpdb.DhcpPlan(circuit.RoutingNode, change.pool, subscriber)
+			if err != nil {
+				result.Result = fmt.Sprintf("Problem finding address in pool (%s) for service (%s) - %v", change.pool, change.name, err)
+				Bus.SubmitResult(result)
+				failed = err
+				continue
+			}
+			change.vlan = reservation.VlanID
+		}
+		info, err := mcp.GetService(token, change.name)
+		if err != nil {
+			result.Result = fmt.Sprintf("Problem getting service (%s) from MCP - %v", change.name, err)
+			Bus.SubmitResult(result)
+			failed = err
+			continue
+		}
+		change, changed := dataChange(change, info)
+		if !changed {
+			log.Debugf("Service (%s) is up to date", change.name)
+			continue
+		}
+		order.changes = append(order.changes, change)
+	}
+
+	// Services for products the subscription has had, that the request no longer wants and billing has ended
+	subscribed, err := maxbill.GetServices(CoreDB, []telmax.Filter{
+		telmax.Filter{Key: "account_code", Value: subscribe.AccountCode},
+		telmax.Filter{Key: "subscribe_code", Value: subscribe.SubscribeCode},
+	})
+	if err != nil {
+		log.Errorf("getting subscribed products (%s) - %v", subscriber, err)
+		result.Result = fmt.Sprintf("Problem getting subscribed products (%s) - %v", subscriber, err)
+		Bus.SubmitResult(result)
+		return order, false, err
+	}
+	for _, product := range subscribed {
+		name := subscriber + "-" + product.SubProductCode
+		if wanted[name] || !productEnded(product.Status) {
+			continue
+		}
+		productData, err := maxbill.GetProduct(CoreDB, "product_code", product.ProductCode)
+		if err != nil || productData.NetworkProfile == nil || productData.Category != telmaxprovision.CategoryInternet {
+			continue
+		}
+		info, err := mcp.GetService(token, name)
+		if err != nil || !info.Exists() {
+			continue
+		}
+		change := serviceChange{
+			action:     ChangeDelete,
+			name:       name,
+			oldProfile: info.ProfileName,
+			oldVlan:    info.Vlan(),
+		}
+		// Another service may still use the address
+		if pool := productData.NetworkProfile.AddressPool; pool != "" && !pools[pool] {
+			change.pool = pool
+		}
+		wanted[name] = true // Only once, if the product is listed more than once
+		order.changes = append(order.changes, change)
+	}
+
+	// Phone lines on the ONT.  Without an ONT record there is nothing to compare the voice services with.
+	onts := subscriberONTs(request, subscribe)
+	if len(onts) > 0 {
+		var lines []devices.VoiceService
+		for _, ont := range onts {
+			lines = append(lines, ont.VoiceServices...)
+		}
+		voice, err := voiceChanges(subscriber, lines, nil)
+		if err != nil {
+			log.Errorf("checking voice services (%s) - %v", subscriber, err)
+			result.Result = fmt.Sprintf("Problem checking voice services (%s) - %v", subscriber, err)
+			Bus.SubmitResult(result)
+			failed = err
+		}
+		order.changes = append(order.changes, voice...)
+	}
+	return order, true, failed
+}
+
+// What to do to bring a data service MCP has in line with the one wanted.  Ok is false if it is up to date.
+func dataChange(change serviceChange, info mcp.MCPServiceInfo) (serviceChange, bool) {
+	change.oldProfile = info.ProfileName
+	change.oldVlan = info.Vlan()
+	switch {
+	case !info.Exists():
+		change.action = ChangeCreate
+	case change.vlan != change.oldVlan:
+		change.action = ChangeMove
+	case change.profile != change.oldProfile:
+		change.action = ChangeProfile
+	default:
+		return change, false
+	}
+	return change, true
+}
+
+// The ONT records for a request - the ones on the request, or the subscription's if it doesn't list any
+func subscriberONTs(request telmaxprovision.ProvisionRequest, subscribe maxbill.Subscribe) (onts []devices.Device) {
+	for _, device := range request.Devices {
+		if device.DeviceType != "AccessTerminal" {
+			continue
+		}
+		ont, err := devices.GetDevice(CoreDB, "device_code", device.DeviceCode)
+		if err != nil {
+			log.Errorf("getting device (%s) - %v", device.DeviceCode, err)
+			continue
+		}
+		onts = append(onts, ont)
+	}
+	if len(onts) > 0 {
+		return
+	}
+	found, err := devices.GetDevices(CoreDB, []telmax.Filter{
+		telmax.Filter{Key: "account_code", Value: subscribe.AccountCode},
+		telmax.Filter{Key: "subscribe_code", Value: subscribe.SubscribeCode},
+	})
+	if err != nil {
+		log.Errorf("getting devices for (%s-%s) - %v", subscribe.AccountCode, subscribe.SubscribeCode, err)
+		return
+	}
+	for _, device := range found {
+		if len(device.VoiceServices) > 0 {
+			onts = append(onts, device)
+		}
+	}
+	return
+}
+
+// Bring the subscriber's services in line with an Update request, reporting each change.  Every change is tried -
+// the last problem is returned.
+func UpdateServices(request telmaxprovision.ProvisionRequest) (failed error) {
+	order, ok, failed := resolveUpdate(request)
+	if !ok {
+		return
+	}
+	result := request.NewResult()
+	if len(order.changes) == 0 {
+		result.Success = true
+		result.Result = "Services are up to date - nothing to change"
+		Bus.SubmitResult(result)
+		return
+	}
+	subscriber := order.subscriber
+	circuit := order.circuit
+	CP := circuit.AccessNode + "-cp"
+	for _, change := range order.changes {
+		var (
+			text string
+			err  error
+		)
+		switch change.action {
+		case ChangeCreate:
+			if change.pool != "" {
+				var reservation dhcpdb.Reservation
+				reservation, err = dhcpdb.DhcpAssign(circuit.RoutingNode, change.pool, subscriber)
+				if err == nil && reservation.HostID == 0 {
+					err = fmt.Errorf("no address available on (%s)", circuit.RoutingNode)
+				}
+				if err != nil {
+					break
+				}
+				change.vlan = reservation.VlanID
+			}
+			// HARDCODED PORT NUMBER..?  The same as NewRequest
+			err = mcp.CreateDataService(change.name, subscriber+"-ONT", subscriber, change.profile, CP, change.vlan, 1)
+			text = fmt.Sprintf("Created service (%s) with profile (%s) on VLAN (%d)", change.name, change.profile, change.vlan)
+
+		case ChangeProfile:
+			err = mcp.ModifyServiceProfile(change.name, subscriber, change.profile)
+			text = fmt.Sprintf("Changed service (%s) from profile (%s) to (%s)", change.name, change.oldProfile, change.profile)
+
+		case ChangeMove:
+			text, err = moveService(change, subscriber, circuit)
+
+		case ChangeDelete:
+			err = mcp.DeleteService(change.name)
+			text = fmt.Sprintf("Removed service (%s)", change.name)
+			if err == nil && change.pool != "" {
+				var released bool
+				released, err = dhcpdb.DhcpRelease(circuit.RoutingNode, change.pool, subscriber)
+				if released {
+					text += " and released DHCP binding."
+				}
+			}
+
+		case ChangeVoice, ChangeVoiceMove, ChangeVoiceDelete:
+			text, err = applyVoice(request, change, subscriber, CP)
+		}
+		if err != nil {
+			log.Errorf("updating service (%s) - %v", change.name, err)
+			text = fmt.Sprintf("Problem with %s of service (%s) - %v", change.action, change.name, err)
+			result.Success = false
+			failed = err
+		} else {
+			result.Success = true
+		}
+		result.Result = text
+		Bus.SubmitResult(result)
+	}
+	return
+}
+
+// Re-create a data service on another VLAN, on the same port it had.  If it can't be created there, it is put back
+// on the profile and VLAN it had, so the subscriber isn't left without a service.
+func moveService(change serviceChange, subscriber string, circuit netdb.Circuit) (string, error) {
+	vlan := change.vlan
+	if change.pool != "" {
+		reservation, existing, err := dhcpdb.DhcpPlan(circuit.RoutingNode, change.pool, subscriber)
+		if err != nil {
+			return "", err
+		}
+		if !existing {
+			return "", fmt.Errorf("no address reserved in pool (%s)", change.pool)
+		}
+		vlan = reservation.VlanID
+	}
+	if err := mcp.DeleteService(change.name); err != nil {
+		return "", err
+	}
+	CP := circuit.AccessNode + "-cp"
+	// HARDCODED PORT NUMBER..?  The same as NewRequest
+	err := mcp.CreateDataService(change.name, subscriber+"-ONT", subscriber, change.profile, CP, vlan, 1)
+	if err != nil {
+		rerr := mcp.CreateDataService(change.name, subscriber+"-ONT", subscriber, change.oldProfile, CP, change.oldVlan, 1)
+		if rerr != nil {
+			return "", fmt.Errorf("%w - could not put it back on profile (%s) VLAN (%d) either - %v", err, change.oldProfile, change.oldVlan, rerr)
+		}
+		return "", fmt.Errorf("%w - put it back on profile (%s) VLAN (%d)", err, change.oldProfile, change.oldVlan)
+	}
+	return fmt.Sprintf("Moved service (%s) to profile (%s) on VLAN (%d)", change.name, change.profile, vlan), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"bitbucket.org/telmaxdc/telmax-provision/mcp"
+)
+
+// An MCP data service on a profile and VLAN
+func dataService(profile string, vlan int) mcp.MCPServiceInfo {
+	var info mcp.MCPServiceInfo
+	info.State = "deployed"
+	info.ProfileName = profile
+	info.Uplink.InterfaceEndpoint.OuterTagVlanID = float64(vlan)
+	return info
+}
+
+func TestDataChange(t *testing.T) {
+	wanted := serviceChange{name: "ACCT0001-SUBS001-SP0001", profile: "res-1g", vlan: 100}
+	tests := []struct {
+		name    string
+		info    mcp.MCPServiceInfo
+		changed bool
+		action  ChangeAction
+	}{
+		{"missing", mcp.MCPServiceInfo{}, true, ChangeCreate},
+		{"up to date", dataService("res-1g", 100), false, ""},
+		{"speed change", dataService("res-500m", 100), true, ChangeProfile},
+		{"other vlan", dataService("res-1g", 200), true, ChangeMove},
+		{"other vlan and profile", dataService("res-500m", 200), true, ChangeMove},
+	}
+	for _, test := range tests {
+		change, changed := dataChange(wanted, test.info)
+		if changed != test.changed || change.action != test.action {
+			t.Errorf("%s: dataChange = %v %q, want %v %q", test.name, changed, change.action, test.changed, test.action)
+		}
+		if changed && (change.oldProfile != test.info.ProfileName || change.oldVlan != test.info.Vlan()) {
+			t.Errorf("%s: old profile and VLAN = %s %d", test.name, change.oldProfile, change.oldVlan)
+		}
+	}
+}
+
+func TestProductEnded(t *testing.T) {
+	tests := []struct {
+		status string
+		ended  bool
+	}{
+		{"Cancelled", true},
+		{"ended", true},
+		{"Activate", false},
+		{"New", false},
+		{"Suspend", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if ended := productEnded(test.status); ended != test.ended {
+			t.Errorf("productEnded(%q) = %v, want %v", test.status, ended, test.ended)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+/*
+	Voice lines.  The phone lines on an ONT are on its device record, as a DID and the FXS port it is on, and each one
+	is a "<subscriber>-<DID>" voice service in MCP.  The DIDs on the record are compared with the voice services MCP has:
+
+	- a DID with no service gets one
+	- a DID on a different port is moved - its service is deleted and created again on the new port, or on the old
+	  one if that fails
+	- a service for a DID that is no longer on the record is deleted
+
+	MCP can't be asked which voice services a subscriber has, so the lines we create are kept in provision_voice_lines,
+	and checked along with the DIDs on the record.  A service created before we kept them is only found while its DID
+	is still on the record.
+*/
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/telmaxdc/telmax-common/devices"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"bitbucket.org/telmaxdc/telmax-provision/mcp"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+const VoiceLineCollection = "provision_voice_lines"
+
+var VoiceLines *mongo.Collection
+
+// A voice service we created
+type VoiceLine struct {
+	Subscriber string    `bson:"subscriber"`
+	Username   string    `bson:"username"` // The DID
+	Domain     string    `bson:"domain"`
+	Line       int       `bson:"line"` // FXS port
+	Updated    time.Time `bson:"updated"`
+}
+
+func InitVoiceLines(db *mongo.Database) {
+	VoiceLines = db.Collection(VoiceLineCollection)
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{"subscriber", 1}, {"username", 1}}, Options: options.Index().SetUnique(true)},
+	}
+	_, err := VoiceLines.Indexes().CreateMany(context.TODO(), indexes)
+	if err != nil {
+		log.Errorf("Problem creating voice line indexes - %v", err)
+	}
+}
+
+// Keep a voice service we created, so it can be found if its DID is taken off the device record
+func rememberLine(subscriber string, voicesvc devices.VoiceService) {
+	filter := bson.D{{"subscriber", subscriber}, {"username", voicesvc.Username}}
+	update := bson.D{{"$set", bson.D{
+		{"domain", voicesvc.Domain},
+		{"line", int(voicesvc.Line)},
+		{"updated", time.Now()},
+	}}}
+	_, err := VoiceLines.UpdateOne(context.TODO(), filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.Errorf("Problem saving voice line (%s) for %v - %v", voicesvc.Username, subscriber, err)
+	}
+}
+
+func forgetLine(subscriber string, username string) {
+	_, err := VoiceLines.DeleteOne(context.TODO(), bson.D{{"subscriber", subscriber}, {"username", username}})
+	if err != nil {
+		log.Errorf("Problem removing voice line (%s) for %v - %v", username, subscriber, err)
+	}
+}
+
+// The voice services we created for a subscriber
+func knownLines(subscriber string) (lines []VoiceLine, err error) {
+	cursor, err := VoiceLines.Find(context.TODO(), bson.D{{"subscriber", subscriber}})
+	if err != nil {
+		return
+	}
+	err = cursor.All(context.TODO(), &lines)
+	return
+}
+
+// The FXS port a voice service is on - 0 if MCP doesn't say
+func servicePort(subscriber string, info mcp.MCPServiceInfo) int {
+	port, err := strconv.Atoi(strings.TrimPrefix(info.Downlink.InterfaceEndpoint.InterfaceName, subscriber+"-fxs"))
+	if err != nil {
+		return 0
+	}
+	return port
+}
+
+// The changes that bring a subscriber's voice services in line with the phone lines they should have.  Others are
+// lines that may have a service but shouldn't, such as the ones on a record being unprovisioned.  Removals come
+// first, so a port is free before another DID is put on it.
+func voiceChanges(subscriber string, wanted []devices.VoiceService, others []devices.VoiceService) (changes []serviceChange, err error) {
+	known, err := knownLines(subscriber)
+	if err != nil {
+		return nil, fmt.Errorf("problem getting voice lines - %v", err)
+	}
+	token, err := mcp.MCPAuth()
+	if err != nil {
+		return nil, err
+	}
+	return diffVoice(subscriber, wanted, others, known, func(name string) (mcp.MCPServiceInfo, error) {
+		return mcp.GetService(token, name)
+	})
+}
+
+// Compare the phone lines with the voice services lookup finds in MCP, given the lines we created before
+func diffVoice(subscriber string, wanted []devices.VoiceService, others []devices.VoiceService, known []VoiceLine, lookup func(name string) (mcp.MCPServiceInfo, error)) (changes []serviceChange, err error) {
+	want := map[string]devices.VoiceService{}
+	for _, voicesvc := range wanted {
+		if voicesvc.Username != "" {
+			want[voicesvc.Username] = voicesvc
+		}
+	}
+	// Every DID that may have a service, with the port we last put it on
+	lines := map[string]int{}
+	for _, line := range known {
+		lines[line.Username] = line.Line
+	}
+	for _, voicesvc := range others {
+		if _, ok := lines[voicesvc.Username]; !ok && voicesvc.Username != "" {
+			lines[voicesvc.Username] = int(voicesvc.Line)
+		}
+	}
+	for username := range want {
+		if _, ok := lines[username]; !ok {
+			lines[username] = 0
+		}
+	}
+	usernames := make([]string, 0, len(lines))
+	for username := range lines {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var removals, moves, creates []serviceChange
+	for _, username := range usernames {
+		name := subscriber + "-" + username
+		info, err := lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("problem getting voice service (%s) from MCP - %v", name, err)
+		}
+		voicesvc, wanted := want[username]
+		oldLine := servicePort(subscriber, info)
+		if oldLine == 0 {
+			oldLine = lines[username]
+		}
+		change := serviceChange{name: name, voice: voicesvc, oldLine: oldLine}
+		change.voice.Username = username
+		switch {
+		case !info.Exists() && wanted:
+			change.action = ChangeVoice
+			creates = append(creates, change)
+		case !info.Exists():
+			// Nothing to remove
+		case !wanted:
+			change.action = ChangeVoiceDelete
+			removals = append(removals, change)
+		case oldLine != 0 && oldLine != int(voicesvc.Line):
+			change.action = ChangeVoiceMove
+			moves = append(moves, change)
+		}
+	}
+	changes = append(removals, moves...)
+	return append(changes, creates...), nil
+}
+
+// Make one voice change
+func applyVoice(request telmaxprovision.ProvisionRequest, change serviceChange, subscriber string, CP string) (string, error) {
+	switch change.action {
+	case ChangeVoice:
+		return createVoice(request, change.name, subscriber, CP, change.voice)
+
+	case ChangeVoiceMove:
+		// Don't take the DID off its old port if it can't go on the new one - createVoice raises the exception
+		if _, ok := voiceProfile(change.voice.Domain); !ok {
+			return createVoice(request, change.name, subscriber, CP, change.voice)
+		}
+		// MCP has one service per DID, so the old one has to go first.  If the new one can't be created, the DID is
+		// put back on its old port rather than left without a service.
+		if err := deleteVoice(subscriber, change.voice.Username); err != nil {
+			return fmt.Sprintf("Problem moving DID (%s) off FXS port (%d) - %v", change.voice.Username, change.oldLine, err), err
+		}
+		text, err := createVoice(request, change.name, subscriber, CP, change.voice)
+		if err != nil {
+			old := change.voice
+			old.Line = int32(change.oldLine)
+			if _, rerr := createVoice(request, change.name, subscriber, CP, old); rerr != nil {
+				return fmt.Sprintf("%s - could not put DID (%s) back on FXS port (%d) either - %v", text, change.voice.Username, change.oldLine, rerr), err
+			}
+			return fmt.Sprintf("%s - put DID (%s) back on FXS port (%d)", text, change.voice.Username, change.oldLine), err
+		}
+		return fmt.Sprintf("Moved DID (%s) from FXS port (%d) to (%d)", change.voice.Username, change.oldLine, int(change.voice.Line)), nil
+
+	case ChangeVoiceDelete:
+		if err := deleteVoice(subscriber, change.voice.Username); err != nil {
+			return fmt.Sprintf("Problem removing voice service (%s) - %v", change.name, err), err
+		}
+		return fmt.Sprintf("Removed voice service (%s) from FXS port (%d)", change.name, change.oldLine), nil
+	}
+	return "", fmt.Errorf("not a voice change - %s", change.action)
+}
+
+// Delete the voice service for a DID
+func deleteVoice(subscriber string, username string) error {
+	err := mcp.DeleteService(subscriber + "-" + username)
+	if err == nil {
+		forgetLine(subscriber, username)
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"bitbucket.org/telmaxdc/telmax-common/devices"
+
+	"bitbucket.org/telmaxdc/telmax-provision/mcp"
+)
+
+// An MCP voice service on an FXS port of the test subscriber's ONT
+func voiceService(port string) mcp.MCPServiceInfo {
+	var info mcp.MCPServiceInfo
+	info.State = "deployed"
+	info.Downlink.InterfaceEndpoint.InterfaceName = "ACCT0001-SUBS001-fxs" + port
+	return info
+}
+
+func TestDiffVoice(t *testing.T) {
+	const subscriber = "ACCT0001-SUBS001"
+	line := func(did string, port int32) devices.VoiceService {
+		return devices.VoiceService{Username: did, Domain: "res.telmax.ca", Line: port}
+	}
+	type change struct {
+		action  ChangeAction
+		did     string
+		oldLine int
+	}
+	tests := []struct {
+		name    string
+		wanted  []devices.VoiceService
+		others  []devices.VoiceService
+		known   []VoiceLine
+		mcp     map[string]mcp.MCPServiceInfo // By DID
+		changes []change
+	}{
+		{
+			name:    "new line",
+			wanted:  []devices.VoiceService{line("9055550001", 1)},
+			changes: []change{{ChangeVoice, "9055550001", 0}},
+		},
+		{
+			name:   "up to date",
+			wanted: []devices.VoiceService{line("9055550001", 1)},
+			mcp:    map[string]mcp.MCPServiceInfo{"9055550001": voiceService("1")},
+		},
+		{
+			name:    "moved to another port",
+			wanted:  []devices.VoiceService{line("9055550001", 2)},
+			mcp:     map[string]mcp.MCPServiceInfo{"9055550001": voiceService("1")},
+			changes: []change{{ChangeVoiceMove, "9055550001", 1}},
+		},
+		{
+			name:    "port from the lines we keep when MCP doesn't say",
+			wanted:  []devices.VoiceService{line("9055550001", 2)},
+			known:   []VoiceLine{{Subscriber: subscriber, Username: "9055550001", Line: 1}},
+			mcp:     map[string]mcp.MCPServiceInfo{"9055550001": voiceService("")},
+			changes: []change{{ChangeVoiceMove, "9055550001", 1}},
+		},
+		{
+			name:    "line we created taken off the record",
+			known:   []VoiceLine{{Subscriber: subscriber, Username: "9055550002", Line: 2}},
+			mcp:     map[string]mcp.MCPServiceInfo{"9055550002": voiceService("2")},
+			changes: []change{{ChangeVoiceDelete, "9055550002", 2}},
+		},
+		{
+			name:   "line already gone from MCP",
+			known:  []VoiceLine{{Subscriber: subscriber, Username: "9055550002", Line: 2}},
+			others: []devices.VoiceService{line("9055550003", 1)},
+		},
+		{
+			name:    "removals before moves before new lines",
+			wanted:  []devices.VoiceService{line("9055550001", 1), line("9055550002", 1), line("9055550003", 2)},
+			others:  []devices.VoiceService{line("9055550004", 2)},
+			mcp:     map[string]mcp.MCPServiceInfo{"9055550002": voiceService("2"), "9055550004": voiceService("2")},
+			changes: []change{{ChangeVoiceDelete, "9055550004", 2}, {ChangeVoiceMove, "9055550002", 2}, {ChangeVoice, "9055550001", 0}, {ChangeVoice, "9055550003", 0}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lookup := func(name string) (mcp.MCPServiceInfo, error) {
+				return test.mcp[name[len(subscriber)+1:]], nil
+			}
+			changes, err := diffVoice(subscriber, test.wanted, test.others, test.known, lookup)
+			if err != nil {
+				t.Fatalf("diffVoice: %v", err)
+			}
+			var got []change
+			for _, c := range changes {
+				if c.name != subscriber+"-"+c.voice.Username {
+					t.Errorf("service name %s for DID %s", c.name, c.voice.Username)
+				}
+				got = append(got, change{c.action, c.voice.Username, c.oldLine})
+			}
+			if !reflect.DeepEqual(got, test.changes) {
+				t.Errorf("changes = %v, want %v", got, test.changes)
+			}
+		})
+	}
+}
+
+func TestDiffVoiceLookupFails(t *testing.T) {
+	lookup := func(name string) (mcp.MCPServiceInfo, error) {
+		return mcp.MCPServiceInfo{}, errors.New("connection refused")
+	}
+	wanted := []devices.VoiceService{{Username: "9055550001", Line: 1}}
+	if _, err := diffVoice("ACCT0001-SUBS001", wanted, nil, nil, lookup); err == nil {
+		t.Error("expected an error when MCP can't be asked")
+	}
+}
@@ -2,184 +2,109 @@ package kafka
 
 import (
 	"context"
-	//	"flag"
-	log "github.com/sirupsen/logrus"
-	"os"
-	"os/signal"
+	"errors"
+	"flag"
 	"time"
-	//	"strings"
-	"github.com/Shopify/sarama"
-	"sync"
-	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
 )
 
-// Sarama configuration options
 var (
-	//	brokers  = ""
-	version = "2.1.1"
-	//	group    = ""
-	//	topics   = ""
-	assignor       = "roundrobin"
-	oldest         = true
-	verbose        = false
-	Client         sarama.ConsumerGroup
-	WG             *sync.WaitGroup
-	StopClient     = make(chan bool)
-	MessageHandler HandlerFunc
+	DrainTimeout = flag.Duration("kafka.drain", 30*time.Second, "How long messages in progress get to finish on shutdown before they are cancelled")
+	DrainGrace   = 5 * time.Second // How long cancelled handlers get to return before Consume gives up on them
 )
 
-type HandlerFunc func(string, time.Time, []byte)
-
-func init() {
-	//	flag.StringVar(&brokers, "brokers", "", "Kafka bootstrap brokers to connect to, as a comma separated list")
-	//	flag.StringVar(&group, "group", "", "Kafka consumer group definition")
-	//	flag.StringVar(&version, "version", "2.1.1", "Kafka cluster version")
-	//	flag.StringVar(&topics, "topics", "", "Kafka topics to be consumed, as a comma separated list")
-	//	flag.StringVar(&assignor, "assignor", "range", "Consumer group partition assignment strategy (range, roundrobin, sticky)")
-	//	flag.BoolVar(&oldest, "oldest", true, "Kafka consumer consume initial offset from oldest")
-	//	flag.BoolVar(&verbose, "verbose", false, "Sarama logging")
-	//	flag.Parse()
-	/*
-		if len(brokers) == 0 {
-			panic("no Kafka bootstrap brokers defined, please set the -brokers flag")
-		}
-
-		if len(topics) == 0 {
-			panic("no topics given to be consumed, please set the -topics flag")
-		}
-
-		if len(group) == 0 {
-			panic("no Kafka consumer group defined, please set the -group flag")
-		}
-	*/
-}
-
-func StartConsumer(brokers []string, topics []string, group string, handler func(string, time.Time, []byte)) error {
-	log.Info("Starting a new Sarama consumer")
-	var err error
-	MessageHandler = handler
-	/*
-		if verbose {
-			sarama.Logger = log.New(os.Stdout, "[sarama] ", log.LstdFlags)
-		}
-	*/
-	var kafkaversion sarama.KafkaVersion
-	kafkaversion, err = sarama.ParseKafkaVersion(version)
-	if err != nil {
-		log.Panicf("Error parsing Kafka version: %v", err)
-	}
-
-	/**
-	 * Construct a new Sarama configuration.
-	 * The Kafka cluster version has to be defined before the consumer/producer is initialized.
-	 */
-	config := sarama.NewConfig()
-	config.Version = kafkaversion
-
-	switch assignor {
-	case "sticky":
-		config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
-	case "roundrobin":
-		config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRoundRobin
-	case "range":
-		config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
-	default:
-		log.Panicf("Unrecognized consumer group partition assignor: %s", assignor)
-	}
-
-	if oldest {
-		config.Consumer.Offsets.Initial = sarama.OffsetOldest
-	}
-
-	/**
-	 * Setup a new Sarama consumer group
-	 */
-	consumer := Consumer{
-		ready: make(chan bool),
+// A message handler is given the topic, timestamp and value of each message.  Returning an error sends the message
+// to the dead letter topic, or to the next retry tier if the error is Retryable.  Retried messages are handed back
+// with the topic they were first consumed from, and replayed ones with the provision topic.  The context is only
+// cancelled if the handler is still running when the drain deadline passes during shutdown.
+type HandlerFunc func(context.Context, string, time.Time, []byte) error
+
+// Consume the topics, and any retry and replay topics, as a member of the group.  Blocks until ctx is done, then
+// stops fetching and waits for messages in progress to finish.  Returns nil on a clean stop.
+func (client *Client) Consume(ctx context.Context, topics []string, group string, handler HandlerFunc) error {
+	topics = append(topics, client.RetryTopics()...)
+	if client.ReplayTopic != "" {
+		topics = append(topics, client.ReplayTopic)
 	}
-
-	ctx, cancel := context.WithCancel(context.Background())
-	Client, err = sarama.NewConsumerGroup(brokers, group, config)
-	if err != nil {
-		log.Panicf("Error creating consumer group client: %v", err)
-	}
-
-	WG = &sync.WaitGroup{}
-	WG.Add(1)
-
+	work, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
+	done := make(chan error, 1)
 	go func() {
-		defer WG.Done()
-		for {
-			// `Consume` should be called inside an infinite loop, when a
-			// server-side rebalance happens, the consumer session will need to be
-			// recreated to get the new claims
-			if err = Client.Consume(ctx, topics, &consumer); err != nil {
-				log.Panicf("Error from consumer: %v", err)
-			}
-			// check if context was cancelled, signaling that the consumer should stop
-			if ctx.Err() != nil {
-				return
-			}
-			consumer.ready = make(chan bool)
-		}
-		cancel()
+		done <- client.Transport.Subscribe(ctx, topics, group, func(delivery context.Context, message *Message) error {
+			return client.dispatch(delivery, work, message, group, handler)
+		})
 	}()
 
-	<-consumer.ready // Await till the consumer has been set up
-	log.Info("Sarama consumer up and running!...")
-
-	sigterm := make(chan os.Signal, 1)
-	signal.Notify(sigterm, syscall.SIGINT, syscall.SIGTERM)
 	select {
+	case err := <-done:
+		return err
 	case <-ctx.Done():
-		log.Println("terminating: context cancelled")
-	//	case <-sigterm:
-	//		log.Println("terminating: via signal")
-	case <-StopClient:
+	}
+	log.Warnf("Stopping consumer - waiting up to %v for messages in progress", *DrainTimeout)
+	drain := time.NewTimer(*DrainTimeout)
+	defer drain.Stop()
+	select {
+	case err := <-done:
 		return err
+	case <-drain.C:
 	}
-	return err
-}
-
-func StopConsumer() {
-	//	cancel()
-	log.Error("Shutting down consumer")
-	StopClient <- true
-	WG.Wait()
-	if err := Client.Close(); err != nil {
-		log.Errorf("Error closing client: %v", err)
+	log.Errorf("Messages still in progress after %v - cancelling them", *DrainTimeout)
+	stopWork()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(DrainGrace):
 	}
+	return errors.New("gave up waiting for messages in progress")
 }
 
-// Consumer represents a Sarama consumer group consumer
-type Consumer struct {
-	ready chan bool
-}
-
-// Setup is run at the beginning of a new session, before ConsumeClaim
-func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
-	// Mark the consumer as ready
-	close(consumer.ready)
-	return nil
-}
-
-// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
-func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
-	return nil
-}
-
-// ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
-func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-
-	// NOTE:
-	// Do not move the code below to a goroutine.
-	// The `ConsumeClaim` itself is called within a goroutine, see:
-	// https://github.com/Shopify/sarama/blob/master/consumer_group.go#L27-L29
-	for message := range claim.Messages() {
-		log.Debugf("Message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
-		MessageHandler(message.Topic, message.Timestamp, message.Value)
-		session.MarkMessage(message, "")
+// Hand a message to the handler, taking care of retries, the ledger and the dead letter topic.  Only returns an error
+// if the message should be left uncommitted.
+func (client *Client) dispatch(delivery context.Context, work context.Context, message *Message, group string, handler HandlerFunc) error {
+	log.Debugf("Message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
+	topic := message.Topic
+	if client.isRetryTopic(message.Topic) {
+		// The retry topics are shared, so only take our own group's retries
+		if message.Header(HeaderConsumerGroup) != group {
+			return nil
+		}
+		if !waitUntilDue(delivery, message) {
+			// Stopping - leave it uncommitted to pick up again
+			return delivery.Err()
+		}
+		topic = message.Header(HeaderOriginalTopic)
+	}
+	if client.ReplayTopic != "" && topic == client.ReplayTopic {
+		topic = client.ProvisionTopic
+	}
+	if work.Err() != nil {
+		return work.Err()
+	}
+	requestID, skip, err := client.ledgerCheck(message, topic, group)
+	if skip {
+		return nil
+	}
+	if err == nil {
+		metrics.InFlight.Inc()
+		err = handler(work, topic, message.Timestamp, message.Value)
+		metrics.InFlight.Dec()
+	}
+	if err != nil && work.Err() != nil && errors.Is(err, work.Err()) {
+		// Cut off by shutdown rather than failed - leave it to be handled again
+		log.Warnf("Handler cancelled on %v/%v/%v", message.Topic, message.Partition, message.Offset)
+		return err
+	}
+	client.ledgerRecord(message, requestID, group, err)
+	if err != nil {
+		log.Errorf("Handler failed on %v/%v/%v - %v", message.Topic, message.Partition, message.Offset, err)
+		if IsRetryable(err) {
+			return client.Reschedule(message, group, err)
+		}
+		// Leave the message uncommitted if we can't park it, so it comes around again
+		return client.DeadLetter(message, group, err)
 	}
-
 	return nil
 }
@@ -0,0 +1,59 @@
+package kafka
+
+import (
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers added to a message when it is parked on the dead letter topic
+const (
+	HeaderOriginalTopic     = "x-original-topic"
+	HeaderOriginalPartition = "x-original-partition"
+	HeaderOriginalOffset    = "x-original-offset"
+	HeaderError             = "x-error"
+	HeaderConsumerGroup     = "x-consumer-group"
+	HeaderFailedTime        = "x-failed-time"
+	HeaderRedriven          = "x-redriven-from"
+)
+
+// Park a message that could not be handled on the dead letter topic, recording where it came from and why it failed
+func (client *Client) DeadLetter(message *Message, group string, cause error) error {
+	if client.DeadLetterTopic == "" {
+		log.Warnf("No dead letter topic - dropping %v/%v/%v", message.Topic, message.Partition, message.Offset)
+		return nil
+	}
+	// Keep anything the original producer attached, but retried messages keep pointing at the topic they were
+	// first consumed from
+	dead := Message{
+		Topic:   client.DeadLetterTopic,
+		Key:     message.Key,
+		Value:   message.Value,
+		Headers: originHeaders(message),
+	}
+	dead.SetHeader(HeaderError, cause.Error())
+	dead.SetHeader(HeaderConsumerGroup, group)
+	dead.SetHeader(HeaderFailedTime, time.Now().Format(time.RFC3339))
+	err := client.Transport.Publish(&dead)
+	if err != nil {
+		log.Errorf("Problem sending dead letter %v", err)
+		return err
+	}
+	log.Warnf("Parked %v/%v/%v on %v partition %v offset %v", message.Topic, message.Partition, message.Offset, client.DeadLetterTopic, dead.Partition, dead.Offset)
+	return nil
+}
+
+// Copy the headers of a consumed message, adding where it was first consumed from if it isn't already there
+func originHeaders(message *Message) map[string]string {
+	headers := map[string]string{}
+	for key, value := range message.Headers {
+		headers[key] = value
+	}
+	if headers[HeaderOriginalTopic] == "" {
+		headers[HeaderOriginalTopic] = message.Topic
+		headers[HeaderOriginalPartition] = strconv.Itoa(int(message.Partition))
+		headers[HeaderOriginalOffset] = strconv.FormatInt(message.Offset, 10)
+	}
+	return headers
+}
@@ -0,0 +1,203 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// Ledger status for a request in a consumer group
+const (
+	LedgerStarted   = "started"   // Handler is running, or the consumer died part way through
+	LedgerCompleted = "completed" // Handled - redeliveries are skipped
+	LedgerRetrying  = "retrying"  // Failed with a retryable error and is waiting on a retry topic
+	LedgerFailed    = "failed"    // Parked on the dead letter topic - only a re-drive is handled again
+)
+
+// Set this header on a request to have it handled again even if the ledger says it is done
+const HeaderReprocess = "x-reprocess"
+
+const LedgerCollection = "provision_ledger"
+
+// One record per request per consumer group
+type LedgerEntry struct {
+	RequestID  string    `bson:"request_id"`
+	Group      string    `bson:"group"`
+	Subscriber string    `bson:"subscriber,omitempty"` // ACCT-SUBS the request was for
+	Sequence   int64     `bson:"sequence,omitempty"`   // The subscriber sequence number of the request
+	Status     string    `bson:"status"`
+	Attempts   int       `bson:"attempts"`        // How many times the handler has been started
+	Error      string    `bson:"error,omitempty"` // Why the last attempt failed
+	Started    time.Time `bson:"started"`         // When the last attempt started
+	Completed  time.Time `bson:"completed,omitempty"`
+}
+
+// Keep the ledger in a collection of this database
+func (client *Client) UseLedger(db *mongo.Database) {
+	client.Ledger = db.Collection(LedgerCollection)
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{"request_id", 1}, {"group", 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{"group", 1}, {"subscriber", 1}, {"sequence", -1}}},
+	}
+	_, err := client.Ledger.Indexes().CreateMany(context.TODO(), indexes)
+	if err != nil {
+		log.Errorf("Problem creating ledger index - %v", err)
+	}
+}
+
+// Get the ledger record for a request in a group
+func (client *Client) LedgerLookup(requestID string, group string) (entry LedgerEntry, found bool, err error) {
+	filter := bson.D{{"request_id", requestID}, {"group", group}}
+	err = client.Ledger.FindOne(context.TODO(), filter).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return entry, false, nil
+	}
+	return entry, err == nil, err
+}
+
+// The ledger record a request is kept under.  A dry run gets its own, so planning a request doesn't mark it handled.
+func ledgerID(request telmaxprovision.ProvisionRequest) string {
+	if request.DryRun {
+		return request.RequestID + ":plan"
+	}
+	return request.RequestID
+}
+
+// Record that a group has started handling a request
+func (client *Client) LedgerStart(request telmaxprovision.ProvisionRequest, group string) error {
+	// A dry run changes nothing, so it mustn't make the requests before it look stale
+	sequence := request.Sequence
+	if request.DryRun {
+		sequence = 0
+	}
+	filter := bson.D{{"request_id", ledgerID(request)}, {"group", group}}
+	update := bson.D{
+		{"$set", bson.D{
+			{"status", LedgerStarted},
+			{"started", time.Now()},
+			{"subscriber", request.Key()},
+			{"sequence", sequence},
+		}},
+		{"$inc", bson.D{{"attempts", 1}}},
+		{"$unset", bson.D{{"error", ""}, {"completed", ""}}},
+	}
+	_, err := client.Ledger.UpdateOne(context.TODO(), filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// Find a request for the same subscriber with a later sequence number that the group has handled, or is handling
+func (client *Client) LedgerNewer(request telmaxprovision.ProvisionRequest, group string) (entry LedgerEntry, found bool, err error) {
+	filter := bson.D{
+		{"group", group},
+		{"subscriber", request.Key()},
+		{"sequence", bson.D{{"$gt", request.Sequence}}},
+		{"status", bson.D{{"$ne", LedgerFailed}}},
+	}
+	opts := options.FindOne().SetSort(bson.D{{"sequence", -1}})
+	err = client.Ledger.FindOne(context.TODO(), filter, opts).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return entry, false, nil
+	}
+	return entry, err == nil, err
+}
+
+// Record how an attempt at a request finished
+func (client *Client) LedgerFinish(requestID string, group string, status string, cause error) error {
+	filter := bson.D{{"request_id", requestID}, {"group", group}}
+	set := bson.D{{"status", status}}
+	if status == LedgerCompleted {
+		set = append(set, bson.E{"completed", time.Now()})
+	}
+	if cause != nil {
+		set = append(set, bson.E{"error", cause.Error()})
+	}
+	_, err := client.Ledger.UpdateOne(context.TODO(), filter, bson.D{{"$set", set}})
+	return err
+}
+
+// Check the ledger before handling a request.  Returns the ledger ID to record the outcome against, or an empty
+// string if the ledger doesn't apply, and whether the request has already been handled and should be skipped.
+// Returns an error instead of handling a request that is older than one already handled for the same subscriber.
+func (client *Client) ledgerCheck(message *Message, topic string, group string) (requestID string, skip bool, stale error) {
+	if client.Ledger == nil || topic != client.ProvisionTopic {
+		return "", false, nil
+	}
+	request, _, err := telmaxprovision.OpenRequest(message.Value)
+	if err != nil || request.RequestID == "" {
+		// Let the handler deal with it
+		return "", false, nil
+	}
+	requestID = ledgerID(request)
+	reprocess := client.ForceReprocess || message.Header(HeaderReprocess) != ""
+	entry, found, err := client.LedgerLookup(requestID, group)
+	if err != nil {
+		log.Errorf("Problem reading ledger for %v - %v", requestID, err)
+	}
+	if found {
+		skip, reason := ledgerSkip(entry, reprocess, message.Header(HeaderRedriven) != "", client.isRetryTopic(message.Topic))
+		if skip {
+			log.Infof("Skipping request %v - %s", requestID, reason)
+			return requestID, true, nil
+		}
+		if reason != "" {
+			log.Warnf("Handling request %v again - %s", requestID, reason)
+		}
+	}
+	err = client.LedgerStart(request, group)
+	if err != nil {
+		log.Errorf("Problem recording start of %v in ledger - %v", requestID, err)
+	}
+	// Requests from before sequence numbers can't be checked
+	if request.Sequence > 0 && !reprocess && !request.DryRun {
+		newer, found, err := client.LedgerNewer(request, group)
+		if err != nil {
+			log.Errorf("Problem checking ledger for newer requests than %v - %v", requestID, err)
+		} else if found {
+			stale = fmt.Errorf("stale request - sequence %d for %v is older than %d from request %v", request.Sequence, request.Key(), newer.Sequence, newer.RequestID)
+		}
+	}
+	return requestID, false, stale
+}
+
+// Whether a request the group already has a ledger entry for should be skipped, and why.  The reason is also set
+// when it is handled again.
+func ledgerSkip(entry LedgerEntry, reprocess bool, redriven bool, retry bool) (skip bool, reason string) {
+	switch {
+	case reprocess:
+		return false, fmt.Sprintf("reprocessing, last attempt was %v at %v", entry.Status, entry.Started)
+	case entry.Status == LedgerCompleted:
+		return true, fmt.Sprintf("already completed at %v", entry.Completed)
+	case entry.Status == LedgerFailed && !redriven:
+		return true, "already parked on the dead letter topic"
+	case entry.Status == LedgerRetrying && !retry:
+		return true, "already waiting on a retry topic"
+	case entry.Status == LedgerStarted:
+		return false, fmt.Sprintf("attempt %d started at %v did not finish", entry.Attempts, entry.Started)
+	}
+	return false, ""
+}
+
+// Record the outcome of handling a request
+func (client *Client) ledgerRecord(message *Message, requestID string, group string, cause error) {
+	if client.Ledger == nil || requestID == "" {
+		return
+	}
+	status := LedgerCompleted
+	if cause != nil {
+		status = LedgerFailed
+		if IsRetryable(cause) && client.canRetry(message) {
+			status = LedgerRetrying
+		}
+	}
+	err := client.LedgerFinish(requestID, group, status, cause)
+	if err != nil {
+		log.Errorf("Problem recording %v for %v in ledger - %v", status, requestID, err)
+	}
+}
@@ -0,0 +1,53 @@
+package kafka
+
+import (
+	"testing"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+func TestLedgerSkip(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    string
+		reprocess bool
+		redriven  bool
+		retry     bool // Came from a retry topic
+		skip      bool
+	}{
+		{"completed", LedgerCompleted, false, false, false, true},
+		{"completed, reprocess", LedgerCompleted, true, false, false, false},
+		{"failed", LedgerFailed, false, false, false, true},
+		{"failed, redriven", LedgerFailed, false, true, false, false},
+		{"retrying, redelivered", LedgerRetrying, false, false, false, true},
+		{"retrying, from retry topic", LedgerRetrying, false, false, true, false},
+		{"started", LedgerStarted, false, false, false, false},
+	}
+	for _, test := range tests {
+		skip, reason := ledgerSkip(LedgerEntry{Status: test.status}, test.reprocess, test.redriven, test.retry)
+		if skip != test.skip {
+			t.Errorf("%s: skip = %v (%s), want %v", test.name, skip, reason, test.skip)
+		}
+	}
+}
+
+// A dry run is kept apart from the real request, so planning it doesn't mark it done
+func TestLedgerID(t *testing.T) {
+	request := telmaxprovision.ProvisionRequest{RequestID: "req-1"}
+	if id := ledgerID(request); id != "req-1" {
+		t.Errorf("ledgerID = %q", id)
+	}
+	request.DryRun = true
+	if id := ledgerID(request); id != "req-1:plan" {
+		t.Errorf("ledgerID for a dry run = %q", id)
+	}
+}
+
+// Without a ledger every message is handled
+func TestLedgerCheckWithoutLedger(t *testing.T) {
+	client := NewClient(NewMemoryBroker())
+	requestID, skip, err := client.ledgerCheck(&Message{Topic: client.ProvisionTopic}, client.ProvisionTopic, "internet")
+	if requestID != "" || skip || err != nil {
+		t.Errorf("ledgerCheck = %q, %v, %v", requestID, skip, err)
+	}
+}
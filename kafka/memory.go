@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// An in-process broker for running handlers without Kafka, mostly for tests.  Each topic is a single partition log
+// and each group keeps its own committed offset, so several subscribers in different groups all see every message.
+type MemoryBroker struct {
+	mu      sync.Mutex
+	topics  map[string][]*Message
+	offsets map[string]map[string]int64 // group -> topic -> next offset
+	wake    chan struct{}               // Closed and replaced whenever something is published
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MemoryBroker{
+		topics:  map[string][]*Message{},
+		offsets: map[string]map[string]int64{},
+		wake:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (broker *MemoryBroker) Publish(message *Message) error {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	stored := *message
+	stored.Headers = map[string]string{}
+	for key, value := range message.Headers {
+		stored.Headers[key] = value
+	}
+	stored.Timestamp = time.Now()
+	stored.Offset = int64(len(broker.topics[message.Topic]))
+	broker.topics[message.Topic] = append(broker.topics[message.Topic], &stored)
+	message.Partition, message.Offset = stored.Partition, stored.Offset
+	close(broker.wake)
+	broker.wake = make(chan struct{})
+	return nil
+}
+
+// Deliver messages in order until the context is done or Close is called, or until the handler fails.  A failed
+// message is left uncommitted, so subscribing again starts from it.
+func (broker *MemoryBroker) Subscribe(ctx context.Context, topics []string, group string, handler DeliveryFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-broker.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for {
+		message, wake := broker.next(topics, group)
+		if message == nil {
+			select {
+			case <-wake:
+				continue
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		err := handler(ctx, message)
+		if err != nil && ctx.Err() != nil {
+			// Left uncommitted because we are stopping, not because it failed
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		broker.commit(group, message)
+	}
+}
+
+// The next uncommitted message for a group, oldest topic first.  Returns nil and a channel to wait on if there isn't
+// one.
+func (broker *MemoryBroker) next(topics []string, group string) (*Message, chan struct{}) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for _, topic := range topics {
+		offset := broker.offsets[group][topic]
+		if offset < int64(len(broker.topics[topic])) {
+			return broker.topics[topic][offset], nil
+		}
+	}
+	return nil, broker.wake
+}
+
+func (broker *MemoryBroker) commit(group string, message *Message) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if broker.offsets[group] == nil {
+		broker.offsets[group] = map[string]int64{}
+	}
+	broker.offsets[group][message.Topic] = message.Offset + 1
+}
+
+// Everything published to a topic so far
+func (broker *MemoryBroker) Messages(topic string) []*Message {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	return append([]*Message{}, broker.topics[topic]...)
+}
+
+// Wait until a group has committed everything on the topics, or the timeout passes.  Returns false on timeout.
+func (broker *MemoryBroker) WaitIdle(topics []string, group string, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		message, wake := broker.next(topics, group)
+		if message == nil {
+			return true
+		}
+		select {
+		case <-wake:
+		case <-deadline:
+			return false
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Stop all subscribers
+func (broker *MemoryBroker) Close() error {
+	broker.cancel()
+	return nil
+}
+
+// The broker can be reached until it is closed
+func (broker *MemoryBroker) Ping() error {
+	return broker.ctx.Err()
+}
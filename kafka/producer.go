@@ -1,117 +1,182 @@
 package kafka
 
 import (
-	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
-	//"flag"
-	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
 
-	"github.com/Shopify/sarama"
 	"github.com/google/uuid"
-
-	//cluster "github.com/bsm/sarama-cluster"
 	log "github.com/sirupsen/logrus"
-	//"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+	"bitbucket.org/telmaxdc/telmax-provision/tickets"
 )
 
 var (
-	ProvisionProducer sarama.SyncProducer
-	ProvisionTopic    = "provisionrequest"
-	KafkaBrokers      = []string{"kf01.dc1.osh.telmax.ca:9092", "kf02.dc1.osh.telmax.ca:9092", "kf03.dc1.osh.telmax.ca:9092"}
+	KafkaBrokers = []string{"kf01.dc1.osh.telmax.ca:9092", "kf02.dc1.osh.telmax.ca:9092", "kf03.dc1.osh.telmax.ca:9092"}
+	ProducerName = filepath.Base(os.Args[0]) // Recorded in the envelope of every message we send
 )
 
-/*
-func init() {
-	// Set up the connection to Kafka
-	ProvisionProducer = NewProducer(KafkaBrokers)
-	sarama.Logger = log.New()
+// A client for the provisioning topics.  Services create one in main and hand it to their handlers, so the handlers
+// can run against a MemoryBroker as easily as against Kafka.
+type Client struct {
+	Transport      Transport
+	Producer       string // Recorded in the envelope of every message we send
+	ProvisionTopic string
+	ResultTopic    string
+	ExceptionTopic string
+	ScheduleTopic  string // Requests with a future EffectiveAt, for the scheduler to hold until they are due
 
+	DeadLetterTopic  string            // Messages that fail to parse or handle are parked here.  Disabled when empty.
+	RetryTiers       []RetryTier       // Tried in order, one per attempt.  Retries are disabled when empty.
+	RetryMaxAttempts int               // Total attempts before giving up - defaults to one more than the number of tiers
+	Ledger           *mongo.Collection // Requests each group has handled.  The ledger is not used when nil.
+	Sequences        *mongo.Collection // Sequence counters per subscriber.  The clock is used when nil.
+	ForceReprocess   bool              // Handle every request again, whatever the ledger says
+	ReplayTopic      string            // Replayed requests, handled as if they came from ProvisionTopic.  Not consumed when empty.
+	Tickets          *tickets.Writer   // Adds results and exceptions to the ticket of their request.  Not used when nil.
 }
-*/
-func StartProducer(brokers []string) {
-	ProvisionProducer = NewProducer(brokers)
-	if ProvisionProducer != nil {
-		log.Info("Connected to Kafka cluster!")
+
+// Create a client with the usual topic names
+func NewClient(transport Transport) *Client {
+	return &Client{
+		Transport:      transport,
+		Producer:       ProducerName,
+		ProvisionTopic: "provisionrequest",
+		ResultTopic:    "provisionresult",
+		ExceptionTopic: "provisionexception",
+		ScheduleTopic:  "provisionrequest.scheduled",
 	}
 }
 
-func SubmitRequest(request telmaxprovision.ProvisionRequest) (id string, err error) {
-	request.RequestID = uuid.New().String()
-	data, err := json.Marshal(request)
-	//	request.Create()
-	// Submit the request to the topic
-	message := sarama.ProducerMessage{
-		Topic: ProvisionTopic,
-		Value: sarama.ByteEncoder(data),
-	}
-	partition, offset, err := ProvisionProducer.SendMessage(&message)
-	log.Infof("Partition is %v and offset is %v", partition, offset)
+// Connect to Kafka, secured as set on the command line, and create a client for it
+func Connect(brokers []string) (*Client, error) {
+	transport, err := NewSaramaTransport(brokers, SecurityFromFlags())
 	if err != nil {
-		log.Errorf("Kafka producer error %v", err)
+		return nil, err
 	}
-	//id = partition + offset
+	return NewClient(transport), nil
+}
+
+// Send a new request, returning the RequestID it was given.  Everything for a subscriber is keyed the same so it is
+// consumed in the order it was sent.
+func (client *Client) SubmitRequest(request telmaxprovision.ProvisionRequest) (id string, err error) {
+	request.RequestID = uuid.New().String()
+	if request.Sequence == 0 {
+		request.Sequence, err = client.NextSequence(request.Key())
+		if err != nil {
+			log.Errorf("Problem getting sequence number for %v - %v", request.Key(), err)
+			return
+		}
+	}
+	err = client.PublishRequest(request)
 	id = request.RequestID
 	return
 }
 
-// Use an existing producer and send a provision result
-func SubmitResult(result telmaxprovision.ProvisionResult) error {
-	data, err := json.Marshal(result)
+// Send a request that already has its RequestID and sequence number.  Requests that aren't due yet go to the
+// schedule topic instead of the provision topic.
+func (client *Client) PublishRequest(request telmaxprovision.ProvisionRequest) error {
+	data, err := telmaxprovision.Seal(telmaxprovision.MessageRequest, client.Producer, request)
 	if err != nil {
-		log.Errorf("Problem unmarshalling result message %v", err)
+		log.Errorf("Problem marshalling request message %v", err)
 		return err
 	}
-	message := sarama.ProducerMessage{
-		Topic: "provisionresult",
-		Value: sarama.ByteEncoder(data),
+	topic := client.ProvisionTopic
+	if client.ScheduleTopic != "" && !request.Due(time.Now()) {
+		log.Infof("Scheduling request %v for %v", request.RequestID, request.EffectiveAt)
+		topic = client.ScheduleTopic
 	}
-	partition, offset, err := ProvisionProducer.SendMessage(&message)
-	log.Infof("Partition is %v and offset is %v", partition, offset)
+	return client.Transport.Publish(&Message{
+		Topic: topic,
+		Key:   []byte(request.Key()),
+		Value: data,
+	})
+}
+
+// Send a held request on to the provision topic once it is due.  It is marked as re-driven, so a subsystem that
+// parked it for coming in early handles it this time instead of skipping it.
+func (client *Client) ReleaseRequest(request telmaxprovision.ProvisionRequest) error {
+	data, err := telmaxprovision.Seal(telmaxprovision.MessageRequest, client.Producer, request)
 	if err != nil {
-		log.Errorf("Kafka producer error %v", err)
+		log.Errorf("Problem marshalling request message %v", err)
+		return err
 	}
-	return err
+	message := Message{
+		Topic: client.ProvisionTopic,
+		Key:   []byte(request.Key()),
+		Value: data,
+	}
+	message.SetHeader(HeaderRedriven, client.ScheduleTopic)
+	return client.Transport.Publish(&message)
 }
 
-// Use an existing producer and send a provision result
-func SubmitException(result telmaxprovision.ProvisionException) error {
-	data, err := json.Marshal(result)
-	message := sarama.ProducerMessage{
-		Topic: "provisionexception",
-		Value: sarama.ByteEncoder(data),
-	}
-	partition, offset, err := ProvisionProducer.SendMessage(&message)
-	log.Debugf("Partition is %v and offset is %v", partition, offset)
+// Send a provision result
+func (client *Client) SubmitResult(result telmaxprovision.ProvisionResult) error {
+	data, err := telmaxprovision.Seal(telmaxprovision.MessageResult, client.Producer, result)
 	if err != nil {
-		log.Errorf("Kafka producer error %v", err)
+		log.Errorf("Problem marshalling result message %v", err)
+		return err
+	}
+	err = client.Transport.Publish(&Message{
+		Topic: client.ResultTopic,
+		Key:   []byte(result.Key()),
+		Value: data,
+	})
+	if err == nil {
+		metrics.Result(result.Success)
+		client.Tickets.Result(result)
 	}
 	return err
 }
 
-func NewProducer(brokers []string) sarama.SyncProducer {
-	config := sarama.NewConfig()
-	log.Infof("Brokers list is %v", brokers)
-	config.Producer.Retry.Max = 10 // Retry up to 10 times to produce the message
-	config.Producer.Return.Successes = true
-	/*
-		tlsConfig := createTlsConfiguration()
-		if tlsConfig != nil {
-			config.Net.TLS.Config = tlsConfig
-			config.Net.TLS.Enable = true
-		}
-	*/
-	// On the broker side, you may want to change the following settings to get
-	// stronger consistency guarantees:
-	// - For your broker, set `unclean.leader.election.enable` to false
-	// - For the topic, you could increase `min.insync.replicas`.
+// Send a step a dry run would take as a result
+func (client *Client) SubmitPlanned(result telmaxprovision.ProvisionResult, format string, args ...interface{}) error {
+	result.Success = true
+	result.Result = fmt.Sprintf(format, args...)
+	return client.SubmitResult(result)
+}
 
-	producer, err := sarama.NewSyncProducer(brokers, config)
+// Send a step a dry run would fail at as a result
+func (client *Client) SubmitPlannedFailure(result telmaxprovision.ProvisionResult, format string, args ...interface{}) error {
+	result.Success = false
+	result.Result = fmt.Sprintf(format, args...)
+	return client.SubmitResult(result)
+}
+
+// Send a provision exception
+func (client *Client) SubmitException(result telmaxprovision.ProvisionException) error {
+	data, err := telmaxprovision.Seal(telmaxprovision.MessageException, client.Producer, result)
 	if err != nil {
-		log.Fatalf("Failed to start Sarama producer:", err)
+		log.Errorf("Problem marshalling exception message %v", err)
+		return err
 	}
+	err = client.Transport.Publish(&Message{
+		Topic: client.ExceptionTopic,
+		Key:   []byte(result.Key()),
+		Value: data,
+	})
+	if err == nil {
+		metrics.Exceptions.Inc()
+		client.Tickets.Exception(result)
+	}
+	return err
+}
 
-	return producer
+// Check the broker can be reached, if the transport knows how
+func (client *Client) Ping() error {
+	if pinger, ok := client.Transport.(Pinger); ok {
+		return pinger.Ping()
+	}
+	return nil
 }
 
-func Shutdown() {
-	ProvisionProducer.Close()
+// Stop consuming and disconnect
+func (client *Client) Close() {
+	if err := client.Transport.Close(); err != nil {
+		log.Errorf("Problem closing transport %v", err)
+	}
 }
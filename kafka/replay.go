@@ -0,0 +1,9 @@
+package kafka
+
+// Set on requests the replay tool republishes, to where the original was read from
+const HeaderReplayed = "x-replayed-from"
+
+// The topic requests from a topic are replayed to for one subsystem, such as provisionrequest.replay.internet
+func ReplayTopic(topic string, subsystem string) string {
+	return topic + ".replay." + subsystem
+}
@@ -0,0 +1,157 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers used to schedule a retry
+const (
+	HeaderRetryAttempt = "x-retry-attempt" // How many times the message has been tried
+	HeaderRetryAfter   = "x-retry-after"   // Don't try again before this time
+)
+
+// A retry tier is a topic that holds failed messages until they are due to be tried again
+type RetryTier struct {
+	Topic string
+	Delay time.Duration
+}
+
+// Handlers return a retryable error when the problem is expected to clear up on its own, instead of sleeping
+type RetryableError struct {
+	Err error
+}
+
+func (e RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// Mark an error as worth retrying later
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return RetryableError{Err: err}
+}
+
+func IsRetryable(err error) bool {
+	var retryable RetryableError
+	return errors.As(err, &retryable)
+}
+
+// Build the retry tiers for a topic from a list of delays.  "1m,5m,30m" gives provisionrequest.retry.1m,
+// provisionrequest.retry.5m and provisionrequest.retry.30m
+func ParseRetryTiers(topic string, delays string) (tiers []RetryTier, err error) {
+	for _, delay := range strings.Split(delays, ",") {
+		delay = strings.TrimSpace(delay)
+		if delay == "" {
+			continue
+		}
+		var duration time.Duration
+		duration, err = time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("bad retry delay %s - %v", delay, err)
+		}
+		tiers = append(tiers, RetryTier{
+			Topic: topic + ".retry." + delay,
+			Delay: duration,
+		})
+	}
+	return
+}
+
+// The topics a consumer needs to subscribe to for its retries
+func (client *Client) RetryTopics() (topics []string) {
+	for _, tier := range client.RetryTiers {
+		topics = append(topics, tier.Topic)
+	}
+	return
+}
+
+func (client *Client) isRetryTopic(topic string) bool {
+	for _, tier := range client.RetryTiers {
+		if tier.Topic == topic {
+			return true
+		}
+	}
+	return false
+}
+
+func (client *Client) maxAttempts() int {
+	if client.RetryMaxAttempts > 0 {
+		return client.RetryMaxAttempts
+	}
+	return len(client.RetryTiers) + 1
+}
+
+// How many times a message has been tried, including this time
+func attempts(message *Message) int {
+	attempt, _ := strconv.Atoi(message.Header(HeaderRetryAttempt))
+	return attempt + 1
+}
+
+// Whether a failed message has any retries left
+func (client *Client) canRetry(message *Message) bool {
+	return len(client.RetryTiers) > 0 && attempts(message) < client.maxAttempts()
+}
+
+// Send a failed message to the next retry tier, or to the dead letter topic once it is out of attempts
+func (client *Client) Reschedule(message *Message, group string, cause error) error {
+	attempt := attempts(message)
+	if !client.canRetry(message) {
+		return client.DeadLetter(message, group, fmt.Errorf("gave up after %d attempts - %v", attempt, cause))
+	}
+	// Once past the last tier, keep using it until we run out of attempts
+	tier := client.RetryTiers[len(client.RetryTiers)-1]
+	if attempt-1 < len(client.RetryTiers) {
+		tier = client.RetryTiers[attempt-1]
+	}
+	retry := Message{
+		Topic:   tier.Topic,
+		Key:     message.Key,
+		Value:   message.Value,
+		Headers: originHeaders(message),
+	}
+	retry.SetHeader(HeaderRetryAttempt, strconv.Itoa(attempt))
+	retry.SetHeader(HeaderRetryAfter, time.Now().Add(tier.Delay).Format(time.RFC3339Nano))
+	retry.SetHeader(HeaderConsumerGroup, group)
+	retry.SetHeader(HeaderError, cause.Error())
+	err := client.Transport.Publish(&retry)
+	if err != nil {
+		log.Errorf("Problem scheduling retry on %v - %v", tier.Topic, err)
+		return err
+	}
+	log.Warnf("Attempt %d failed for %v/%v/%v, retrying in %v - %v", attempt, message.Topic, message.Partition, message.Offset, tier.Delay, cause)
+	return nil
+}
+
+// Hold a retried message until it is due.  Returns false if the context ended first.
+func waitUntilDue(ctx context.Context, message *Message) bool {
+	due, err := time.Parse(time.RFC3339Nano, message.Header(HeaderRetryAfter))
+	if err != nil {
+		return true
+	}
+	wait := time.Until(due)
+	if wait <= 0 {
+		return true
+	}
+	log.Debugf("Holding retry %v/%v/%v for %v", message.Topic, message.Partition, message.Offset, wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
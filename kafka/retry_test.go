@@ -0,0 +1,112 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetryTiers(t *testing.T) {
+	tests := []struct {
+		delays string
+		tiers  []RetryTier
+		err    bool
+	}{
+		{"", nil, false},
+		{"1m", []RetryTier{{"provisionrequest.retry.1m", time.Minute}}, false},
+		{"1m, 5m,,30m", []RetryTier{
+			{"provisionrequest.retry.1m", time.Minute},
+			{"provisionrequest.retry.5m", 5 * time.Minute},
+			{"provisionrequest.retry.30m", 30 * time.Minute},
+		}, false},
+		{"1m,soon", nil, true},
+	}
+	for _, test := range tests {
+		tiers, err := ParseRetryTiers("provisionrequest", test.delays)
+		if (err != nil) != test.err {
+			t.Errorf("%q: error = %v", test.delays, err)
+			continue
+		}
+		if !reflect.DeepEqual(tiers, test.tiers) {
+			t.Errorf("%q: tiers = %v, want %v", test.delays, tiers, test.tiers)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	cause := errors.New("timeout")
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{cause, false},
+		{Retryable(cause), true},
+		{fmt.Errorf("wrapped - %w", Retryable(cause)), true},
+	}
+	for _, test := range tests {
+		if got := IsRetryable(test.err); got != test.want {
+			t.Errorf("IsRetryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+	if Retryable(nil) != nil {
+		t.Error("Retryable(nil) should be nil")
+	}
+}
+
+// Each attempt goes to the next tier, the last tier is re-used, and the message is parked once out of attempts
+func TestReschedule(t *testing.T) {
+	tiers, _ := ParseRetryTiers("provisionrequest", "1m,5m")
+	tests := []struct {
+		attempt string // The attempt header on the failed message
+		max     int
+		topic   string // Where it should end up
+	}{
+		{"", 0, "provisionrequest.retry.1m"},
+		{"1", 0, "provisionrequest.retry.5m"},
+		{"2", 0, "dlq"},
+		{"2", 5, "provisionrequest.retry.5m"},
+		{"4", 5, "dlq"},
+	}
+	for _, test := range tests {
+		broker := NewMemoryBroker()
+		client := NewClient(broker)
+		client.DeadLetterTopic = "dlq"
+		client.RetryTiers = tiers
+		client.RetryMaxAttempts = test.max
+		message := &Message{Topic: "provisionrequest", Value: []byte("{}"), Offset: 7}
+		if test.attempt != "" {
+			message.Topic = "provisionrequest.retry.1m"
+			message.SetHeader(HeaderOriginalTopic, "provisionrequest")
+			message.SetHeader(HeaderRetryAttempt, test.attempt)
+		}
+		if err := client.Reschedule(message, "internet", errors.New("busy")); err != nil {
+			t.Fatalf("Reschedule: %v", err)
+		}
+		sent := broker.Messages(test.topic)
+		if len(sent) != 1 {
+			t.Errorf("attempt %q max %d: nothing on %v", test.attempt, test.max, test.topic)
+			continue
+		}
+		if sent[0].Header(HeaderOriginalTopic) != "provisionrequest" || sent[0].Header(HeaderConsumerGroup) != "internet" {
+			t.Errorf("attempt %q max %d: headers = %v", test.attempt, test.max, sent[0].Headers)
+		}
+	}
+}
+
+func TestWaitUntilDue(t *testing.T) {
+	message := &Message{}
+	message.SetHeader(HeaderRetryAfter, time.Now().Add(time.Hour).Format(time.RFC3339Nano))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if waitUntilDue(ctx, message) {
+		t.Error("a retry due in an hour should not be released")
+	}
+	message.SetHeader(HeaderRetryAfter, time.Now().Add(-time.Second).Format(time.RFC3339Nano))
+	if !waitUntilDue(context.Background(), message) {
+		t.Error("a retry that is due should be released")
+	}
+}
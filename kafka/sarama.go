@@ -0,0 +1,357 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"sync"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+)
+
+// Sarama configuration options
+var (
+	version  = "2.1.1"
+	assignor = "roundrobin"
+	oldest   = true
+
+	Workers = flag.Int("kafka.workers", 1, "Messages handled at once per partition - messages with the same key are still handled in order")
+)
+
+// The Kafka transport, using Sarama for both the producer and the consumer group
+type SaramaTransport struct {
+	brokers  []string
+	security Security
+	Workers  int // Messages handled at once per partition
+	client   sarama.Client
+	producer sarama.SyncProducer
+	group    sarama.ConsumerGroup
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// Connect a producer to the brokers.  The consumer group is only set up when Subscribe is called.
+func NewSaramaTransport(brokers []string, security Security) (*SaramaTransport, error) {
+	log.Infof("Brokers list is %v", brokers)
+	config, err := producerConfig(security)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	log.Info("Connected to Kafka cluster!")
+	return &SaramaTransport{
+		brokers:  brokers,
+		security: security,
+		Workers:  *Workers,
+		client:   client,
+		producer: producer,
+	}, nil
+}
+
+func newConfig(security Security) (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	// Message headers need a broker version of at least 0.11
+	config.Version, _ = sarama.ParseKafkaVersion(version)
+	return config, security.Apply(config)
+}
+
+func producerConfig(security Security) (*sarama.Config, error) {
+	config, err := newConfig(security)
+	if err != nil {
+		return nil, err
+	}
+	config.Producer.Retry.Max = 10 // Retry up to 10 times to produce the message
+	config.Producer.Return.Successes = true
+	// On the broker side, you may want to change the following settings to get
+	// stronger consistency guarantees:
+	// - For your broker, set `unclean.leader.election.enable` to false
+	// - For the topic, you could increase `min.insync.replicas`.
+	return config, nil
+}
+
+func consumerConfig(security Security) (*sarama.Config, error) {
+	config, err := newConfig(security)
+	if err != nil {
+		return nil, err
+	}
+	switch assignor {
+	case "sticky":
+		config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategySticky
+	case "roundrobin":
+		config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRoundRobin
+	case "range":
+		config.Consumer.Group.Rebalance.Strategy = sarama.BalanceStrategyRange
+	default:
+		log.Panicf("Unrecognized consumer group partition assignor: %s", assignor)
+	}
+	if oldest {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	}
+	return config, nil
+}
+
+func (transport *SaramaTransport) Publish(message *Message) error {
+	produce := sarama.ProducerMessage{
+		Topic: message.Topic,
+		Value: sarama.ByteEncoder(message.Value),
+	}
+	if message.Key != nil {
+		produce.Key = sarama.ByteEncoder(message.Key)
+	}
+	for key, value := range message.Headers {
+		produce.Headers = append(produce.Headers, sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+	partition, offset, err := transport.producer.SendMessage(&produce)
+	if err != nil {
+		log.Errorf("Kafka producer error %v", err)
+		return err
+	}
+	log.Debugf("Sent to %v partition %v offset %v", message.Topic, partition, offset)
+	message.Partition = partition
+	message.Offset = offset
+	return nil
+}
+
+func (transport *SaramaTransport) Subscribe(ctx context.Context, topics []string, group string, handler DeliveryFunc) error {
+	if transport.group != nil {
+		return errors.New("already subscribed")
+	}
+	log.Info("Starting a new Sarama consumer")
+	config, err := consumerConfig(transport.security)
+	if err != nil {
+		return err
+	}
+	transport.group, err = sarama.NewConsumerGroup(transport.brokers, group, config)
+	if err != nil {
+		log.Errorf("Error creating consumer group client: %v", err)
+		return err
+	}
+	consumer := Consumer{
+		ready:   make(chan bool),
+		handler: handler,
+		workers: transport.Workers,
+	}
+	ctx, transport.cancel = context.WithCancel(ctx)
+
+	transport.wg.Add(1)
+	go func() {
+		defer transport.wg.Done()
+		for {
+			// `Consume` should be called inside an infinite loop, when a
+			// server-side rebalance happens, the consumer session will need to be
+			// recreated to get the new claims
+			if err := transport.group.Consume(ctx, topics, &consumer); err != nil {
+				log.Panicf("Error from consumer: %v", err)
+			}
+			// check if context was cancelled, signaling that the consumer should stop
+			if ctx.Err() != nil {
+				return
+			}
+			consumer.ready = make(chan bool)
+		}
+	}()
+
+	select {
+	case <-consumer.ready: // Await till the consumer has been set up
+		log.Info("Sarama consumer up and running!...")
+	case <-ctx.Done():
+	}
+	<-ctx.Done()
+	// Consume returns once every claim has finished the message it was on, and the session commits what was marked
+	transport.wg.Wait()
+	log.Info("Sarama consumer stopped")
+	return nil
+}
+
+// Stop consuming and close the producer
+func (transport *SaramaTransport) Close() error {
+	if transport.group != nil {
+		log.Error("Shutting down consumer")
+		transport.cancel()
+		transport.wg.Wait()
+		if err := transport.group.Close(); err != nil {
+			log.Errorf("Error closing client: %v", err)
+		}
+	}
+	if err := transport.producer.Close(); err != nil {
+		return err
+	}
+	return transport.client.Close()
+}
+
+// Check the brokers can be reached by refreshing the cluster metadata
+func (transport *SaramaTransport) Ping() error {
+	return transport.client.RefreshMetadata()
+}
+
+// Consumer represents a Sarama consumer group consumer
+type Consumer struct {
+	ready   chan bool
+	handler DeliveryFunc
+	workers int
+}
+
+// Setup is run at the beginning of a new session, before ConsumeClaim
+func (consumer *Consumer) Setup(sarama.ConsumerGroupSession) error {
+	// Mark the consumer as ready
+	close(consumer.ready)
+	return nil
+}
+
+// Cleanup is run at the end of a session, once all ConsumeClaim goroutines have exited
+func (consumer *Consumer) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim must start a consumer loop of ConsumerGroupClaim's Messages().
+func (consumer *Consumer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	if consumer.workers > 1 {
+		return consumer.consumeKeyed(session, claim)
+	}
+
+	// NOTE:
+	// Do not move the code below to a goroutine.
+	// The `ConsumeClaim` itself is called within a goroutine, see:
+	// https://github.com/Shopify/sarama/blob/master/consumer_group.go#L27-L29
+	for {
+		select {
+		case message, ok := <-claim.Messages():
+			if !ok || session.Context().Err() != nil {
+				return nil
+			}
+			metrics.Lag(message.Topic, message.Partition, claim.HighWaterMarkOffset()-message.Offset-1)
+			log.Debugf("Message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
+			err := consumer.handler(session.Context(), fromSarama(message))
+			if err != nil {
+				// Leave the message unmarked so it comes around again on the next session
+				return err
+			}
+			session.MarkMessage(message, "")
+		case <-session.Context().Done():
+			// Don't start on anything already fetched once the session is ending
+			return nil
+		}
+	}
+}
+
+// A message being handled by the worker pool
+type inflight struct {
+	message *sarama.ConsumerMessage
+	done    bool          // Handled, and can be marked once everything before it is
+	next    chan struct{} // Closed when the next message with the same key can start
+	failed  bool          // Set before next is closed if this message, or one before it with the same key, failed
+}
+
+// Handle up to workers messages at once.  Messages with the same ordering key wait for the one before them, and
+// offsets are only marked up to the oldest message that hasn't finished, so a crash never skips anything.
+func (consumer *Consumer) consumeKeyed(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		queue    []*inflight              // Oldest first, waiting to be marked
+		last     = map[string]*inflight{} // The latest message started for each key
+		firstErr error
+		stopOnce sync.Once
+	)
+	slots := make(chan struct{}, consumer.workers)
+	stop := make(chan struct{})
+	fail := func(err error) {
+		stopOnce.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+
+loop:
+	for {
+		var message *sarama.ConsumerMessage
+		var ok bool
+		select {
+		case message, ok = <-claim.Messages():
+			if !ok || session.Context().Err() != nil {
+				break loop
+			}
+		case <-stop:
+			break loop
+		case <-session.Context().Done():
+			break loop
+		}
+		metrics.Lag(message.Topic, message.Partition, claim.HighWaterMarkOffset()-message.Offset-1)
+		select {
+		case slots <- struct{}{}:
+		case <-stop:
+			break loop
+		}
+		log.Debugf("Message claimed: value = %s, timestamp = %v, topic = %s", string(message.Value), message.Timestamp, message.Topic)
+		converted := fromSarama(message)
+		key := OrderingKey(converted)
+		current := &inflight{message: message, next: make(chan struct{})}
+		mu.Lock()
+		queue = append(queue, current)
+		previous := last[key]
+		last[key] = current
+		mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			defer close(current.next)
+			if previous != nil {
+				<-previous.next
+				if previous.failed {
+					// Don't run ahead of a message for the same customer that will be handled again
+					current.failed = true
+					return
+				}
+			}
+			err := consumer.handler(session.Context(), converted)
+			mu.Lock()
+			defer mu.Unlock()
+			if last[key] == current {
+				delete(last, key)
+			}
+			if err != nil {
+				current.failed = true
+				fail(err)
+				return
+			}
+			current.done = true
+			for len(queue) > 0 && queue[0].done {
+				session.MarkMessage(queue[0].message, "")
+				queue = queue[1:]
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func fromSarama(message *sarama.ConsumerMessage) *Message {
+	converted := Message{
+		Topic:     message.Topic,
+		Key:       message.Key,
+		Value:     message.Value,
+		Headers:   map[string]string{},
+		Timestamp: message.Timestamp,
+		Partition: message.Partition,
+		Offset:    message.Offset,
+	}
+	for _, header := range message.Headers {
+		if header != nil {
+			converted.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	return &converted
+}
@@ -0,0 +1,122 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+// A consumer group session that records the offsets marked
+type testSession struct {
+	ctx    context.Context
+	mu     sync.Mutex
+	marked []int64
+}
+
+func (session *testSession) Claims() map[string][]int32                                        { return nil }
+func (session *testSession) MemberID() string                                                  { return "test" }
+func (session *testSession) GenerationID() int32                                               { return 1 }
+func (session *testSession) MarkOffset(topic string, partition int32, offset int64, _ string)  {}
+func (session *testSession) Commit()                                                           {}
+func (session *testSession) ResetOffset(topic string, partition int32, offset int64, _ string) {}
+func (session *testSession) Context() context.Context                                          { return session.ctx }
+
+func (session *testSession) MarkMessage(message *sarama.ConsumerMessage, _ string) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.marked = append(session.marked, message.Offset)
+}
+
+// A claim on one partition holding the given keys, one message each
+type testClaim struct {
+	messages chan *sarama.ConsumerMessage
+}
+
+func newTestClaim(keys ...string) *testClaim {
+	claim := &testClaim{messages: make(chan *sarama.ConsumerMessage, len(keys))}
+	for offset, key := range keys {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "provisionrequest", Key: []byte(key), Offset: int64(offset)}
+	}
+	close(claim.messages)
+	return claim
+}
+
+func (claim *testClaim) Topic() string                            { return "provisionrequest" }
+func (claim *testClaim) Partition() int32                         { return 0 }
+func (claim *testClaim) InitialOffset() int64                     { return 0 }
+func (claim *testClaim) HighWaterMarkOffset() int64               { return int64(cap(claim.messages)) }
+func (claim *testClaim) Messages() <-chan *sarama.ConsumerMessage { return claim.messages }
+
+func TestConsumeKeyed(t *testing.T) {
+	keys := []string{"a", "b", "a", "c", "b", "a", "c", "a"}
+	tests := []struct {
+		name   string
+		fail   int64   // Offset that fails, or -1
+		ran    []int64 // Offsets that should never run
+		marked int     // How many offsets should be marked
+	}{
+		{"all succeed", -1, nil, len(keys)},
+		// The a's after offset 2 wait for it, so they never run, and nothing from offset 2 on is marked
+		{"one fails", 2, []int64{5, 7}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var (
+				mu   sync.Mutex
+				seen = map[string][]int64{}
+				busy = map[string]bool{}
+			)
+			consumer := &Consumer{workers: 4, handler: func(ctx context.Context, message *Message) error {
+				key := string(message.Key)
+				mu.Lock()
+				if busy[key] {
+					t.Errorf("two messages for %s at once", key)
+				}
+				busy[key] = true
+				seen[key] = append(seen[key], message.Offset)
+				mu.Unlock()
+				// Later messages finish first, to catch them being marked ahead of earlier ones
+				time.Sleep(time.Duration(len(keys)-int(message.Offset)) * time.Millisecond)
+				mu.Lock()
+				busy[key] = false
+				mu.Unlock()
+				if message.Offset == test.fail {
+					return errors.New("failed")
+				}
+				return nil
+			}}
+			session := &testSession{ctx: context.Background()}
+			err := consumer.consumeKeyed(session, newTestClaim(keys...))
+			if (err != nil) != (test.fail >= 0) {
+				t.Fatalf("consumeKeyed error = %v", err)
+			}
+			for key, offsets := range seen {
+				for i := 1; i < len(offsets); i++ {
+					if offsets[i] < offsets[i-1] {
+						t.Errorf("%s handled out of order - %v", key, offsets)
+					}
+				}
+				for _, offset := range offsets {
+					for _, never := range test.ran {
+						if offset == never {
+							t.Errorf("offset %d ran after the one before it for %s failed", offset, key)
+						}
+					}
+				}
+			}
+			if len(session.marked) != test.marked {
+				t.Fatalf("marked %v, want %d offsets", session.marked, test.marked)
+			}
+			for i, offset := range session.marked {
+				if offset != int64(i) {
+					t.Errorf("marked %v - should be in order from 0", session.marked)
+					break
+				}
+			}
+		})
+	}
+}
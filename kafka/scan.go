@@ -0,0 +1,62 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// Read every message currently on a topic, partition by partition, oldest first.  Stops at the end of each partition
+// rather than waiting for new messages, so it is suited to tools rather than services.  Returning an error from fn
+// stops the scan.
+func ScanTopic(brokers []string, topic string, fn func(*Message) error) error {
+	config, err := newConfig(SecurityFromFlags())
+	if err != nil {
+		return err
+	}
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return err
+	}
+	for _, partition := range partitions {
+		var oldest, newest int64
+		oldest, err = client.GetOffset(topic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		newest, err = client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+		log.Debugf("Scanning %v partition %v offsets %v to %v", topic, partition, oldest, newest)
+		if oldest >= newest {
+			continue
+		}
+		var pc sarama.PartitionConsumer
+		pc, err = consumer.ConsumePartition(topic, partition, oldest)
+		if err != nil {
+			return err
+		}
+		for message := range pc.Messages() {
+			err = fn(fromSarama(message))
+			if err != nil || message.Offset >= newest-1 {
+				break
+			}
+		}
+		pc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package kafka
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+	"github.com/xdg-go/scram"
+
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+)
+
+var (
+	TLSEnable     = flag.Bool("kafka.tls.enable", false, "Use TLS to connect to the Kafka brokers")
+	TLSCA         = flag.String("kafka.tls.ca", "", "CA certificate to verify the Kafka brokers with - system roots if empty")
+	TLSCert       = flag.String("kafka.tls.cert", "", "Client certificate for Kafka - only needed if the brokers ask for one")
+	TLSKey        = flag.String("kafka.tls.key", "", "Client private key for Kafka")
+	TLSInsecure   = flag.Bool("kafka.tls.insecure", false, "Don't verify the Kafka broker certificates")
+	SASLMechanism = flag.String("kafka.sasl.mechanism", "", "SASL mechanism - PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512.  Disabled when empty.")
+	SASLUser      = flag.String("kafka.sasl.user", "", "SASL username")
+	SASLPass      = flag.String("kafka.sasl.pass", "", "SASL password - deprecated, use the kafka.sasl.password secret")
+)
+
+// How to secure the connection to the brokers
+type Security struct {
+	TLS           bool
+	CAFile        string
+	CertFile      string
+	KeyFile       string
+	Insecure      bool
+	SASLMechanism string
+	SASLUser      string
+	SASLPassword  string
+}
+
+// The security settings from the command line
+func SecurityFromFlags() Security {
+	security := Security{
+		TLS:           *TLSEnable,
+		CAFile:        *TLSCA,
+		CertFile:      *TLSCert,
+		KeyFile:       *TLSKey,
+		Insecure:      *TLSInsecure,
+		SASLMechanism: *SASLMechanism,
+		SASLUser:      *SASLUser,
+	}
+	if security.SASLMechanism != "" {
+		security.SASLPassword = secrets.Get("kafka.sasl.password", *SASLPass)
+	}
+	return security
+}
+
+// Set up TLS and SASL on a Sarama config
+func (security Security) Apply(config *sarama.Config) error {
+	if security.TLS {
+		tlsConfig, err := security.tlsConfig()
+		if err != nil {
+			return err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+	if security.SASLMechanism == "" {
+		return nil
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.Handshake = true
+	config.Net.SASL.User = security.SASLUser
+	config.Net.SASL.Password = security.SASLPassword
+	switch security.SASLMechanism {
+	case sarama.SASLTypePlaintext:
+		config.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case sarama.SASLTypeSCRAMSHA256:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha256.New}
+		}
+	case sarama.SASLTypeSCRAMSHA512:
+		config.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: sha512.New}
+		}
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %s", security.SASLMechanism)
+	}
+	if !security.TLS && security.SASLMechanism == sarama.SASLTypePlaintext {
+		log.Warn("SASL PLAIN without TLS sends the Kafka password in the clear")
+	}
+	return nil
+}
+
+func (security Security) tlsConfig() (*tls.Config, error) {
+	tlsConfig := tls.Config{
+		InsecureSkipVerify: security.Insecure,
+	}
+	if security.CAFile != "" {
+		pem, err := ioutil.ReadFile(security.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", security.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if security.CertFile != "" || security.KeyFile != "" {
+		if security.CertFile == "" || security.KeyFile == "" {
+			return nil, errors.New("a Kafka client certificate needs both a cert and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(security.CertFile, security.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &tlsConfig, nil
+}
+
+// SCRAM conversation for Sarama, from the Sarama examples
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+func (client *scramClient) Begin(userName, password, authzID string) (err error) {
+	client.Client, err = client.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	client.ClientConversation = client.Client.NewConversation()
+	return nil
+}
+
+func (client *scramClient) Step(challenge string) (string, error) {
+	return client.ClientConversation.Step(challenge)
+}
+
+func (client *scramClient) Done() bool {
+	return client.ClientConversation.Done()
+}
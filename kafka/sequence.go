@@ -0,0 +1,39 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const SequenceCollection = "provision_sequence"
+
+// Keep the sequence counters in a collection of this database
+func (client *Client) UseSequences(db *mongo.Database) {
+	client.Sequences = db.Collection(SequenceCollection)
+}
+
+// The next sequence number for a subscriber.  Sequence numbers are based on the clock, so they can be compared with
+// ones given out without a sequence collection.  Without the collection they only go up as long as every producer's
+// clock agrees - good enough for a single producer, but use the collection if there are more.
+func (client *Client) NextSequence(key string) (int64, error) {
+	now := time.Now().UnixNano()
+	if client.Sequences == nil {
+		return now, nil
+	}
+	filter := bson.D{{"_id", key}}
+	// Catch the counter up with the clock, then take the next number
+	_, err := client.Sequences.UpdateOne(context.TODO(), filter, bson.D{{"$max", bson.D{{"sequence", now}}}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return 0, err
+	}
+	var counter struct {
+		Sequence int64 `bson:"sequence"`
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = client.Sequences.FindOneAndUpdate(context.TODO(), filter, bson.D{{"$inc", bson.D{{"sequence", 1}}}}, opts).Decode(&counter)
+	return counter.Sequence, err
+}
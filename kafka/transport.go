@@ -0,0 +1,79 @@
+package kafka
+
+import (
+	"context"
+	"time"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// A message on the provisioning bus, independent of the broker that carries it
+type Message struct {
+	Topic     string
+	Key       []byte
+	Value     []byte
+	Headers   map[string]string
+	Timestamp time.Time // Set by the broker
+	Partition int32     // Set by the broker
+	Offset    int64     // Set by the broker
+}
+
+// Get the value of a header, or an empty string if it isn't set
+func (message *Message) Header(key string) string {
+	return message.Headers[key]
+}
+
+// Set a header, creating the header map if needed
+func (message *Message) SetHeader(key string, value string) {
+	if message.Headers == nil {
+		message.Headers = map[string]string{}
+	}
+	message.Headers[key] = value
+}
+
+// Handles a delivered message.  Returning nil commits the message; returning an error leaves it uncommitted so it is
+// delivered again.  The context ends when the subscriber is stopping or losing the message's partition.
+type DeliveryFunc func(ctx context.Context, message *Message) error
+
+// Sends messages to a topic
+type Publisher interface {
+	Publish(message *Message) error
+	Close() error
+}
+
+// Delivers messages from a set of topics to a handler, sharing them out between the members of a group
+type Subscriber interface {
+	// Blocks, delivering messages until the context is done.  Stops fetching straight away, then returns once the
+	// handlers already running have finished and their offsets are committed.
+	Subscribe(ctx context.Context, topics []string, group string, handler DeliveryFunc) error
+	Close() error
+}
+
+// A transport that can check whether the broker can be reached
+type Pinger interface {
+	Ping() error
+}
+
+// Both ends of a message broker
+type Transport interface {
+	Publisher
+	Subscriber
+}
+
+// Messages with the same ordering key are always handled in order.  This is the message key if the producer set one,
+// otherwise the account and subscribe code of a request, or the RequestID of anything else.
+func OrderingKey(message *Message) string {
+	if len(message.Key) > 0 {
+		return string(message.Key)
+	}
+	if request, _, err := telmaxprovision.OpenRequest(message.Value); err == nil {
+		return request.AccountCode + "-" + request.SubscribeCode
+	}
+	if result, _, err := telmaxprovision.OpenResult(message.Value); err == nil {
+		return result.RequestID
+	}
+	if exception, _, err := telmaxprovision.OpenException(message.Value); err == nil {
+		return exception.RequestID
+	}
+	return ""
+}
@@ -13,15 +13,22 @@ import (
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 )
 
 var (
 	MCPURL      = flag.String("mcpurl", "https://mcp02.tor2.telmax.ca/api/restconf/", "URL and prefix for MCP Interaction")
 	MCPUsername = flag.String("mcpusername", "provision", "MCP Username")
-	MCPPassword = flag.String("mcppassword", "Pr0vision", "MCP Password")
+	MCPPassword = flag.String("mcppassword", "", "MCP Password - deprecated, use the mcp.password secret")
 )
 
+// MCPRequestWait stopped waiting for a transaction that was still in progress
+var ErrGaveUp = errors.New("Gave up on MCP request")
+
 func MCPAuth() (token string, err error) {
+	defer metrics.Backend("mcp", "auth").Done(&err)
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
@@ -37,9 +44,9 @@ func MCPAuth() (token string, err error) {
 		Password string `json:"password"`
 	}
 	authData.Username = *MCPUsername
-	authData.Password = *MCPPassword
+	authData.Password = secrets.Get("mcp.password", *MCPPassword)
 	jsonStr, err = json.Marshal(authData)
-	log.Debugf("Posted string is %v", string(jsonStr))
+	log.Debugf("Requesting MCP token for %v", authData.Username)
 	if err != nil {
 		log.Errorf("Problem marshalling JSON data", err)
 		return
@@ -86,6 +93,7 @@ func MCPAuth() (token string, err error) {
 }
 
 func MCPRequest(authtoken string, command string, data interface{}) (mcpresponse MCPResult, err error) {
+	defer metrics.Backend("mcp", command).Done(&err)
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
@@ -163,12 +171,13 @@ func MCPRequestWait(authtoken string, command string, data interface{}) (mcpresp
 			}
 			counter++
 		}
-		err = errors.New(fmt.Sprintf("Gave up on MCP request after %v seconds", wait*count))
+		err = fmt.Errorf("%w after %v seconds", ErrGaveUp, wait*count)
 	}
 	return
 }
 
 func MCPQuery(authtoken string, query string) (result []byte, err error) {
+	defer metrics.Backend("mcp", "query").Done(&err)
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
@@ -444,8 +453,8 @@ func CreateDataService(name string, device string, subscriberid string, profile
 	return err
 }
 
-// Create a voice service
-func CreatePhoneService(name string, device string, subscriberid string, profile string, contentprovider string, vlan int, number string, password string, port int) error {
+// Create a voice service.  Codec and sipserver override the profile's when they are set.
+func CreatePhoneService(name string, device string, subscriberid string, profile string, contentprovider string, vlan int, number string, password string, port int, codec string, sipserver string) error {
 	log.Infof("Adding phone service to %v on port %v", device, port)
 	if contentprovider == "" || vlan == 0 || profile == "" {
 		log.Errorf("This service is not properly configured %v", name)
@@ -479,6 +488,8 @@ func CreatePhoneService(name string, device string, subscriberid string, profile
 	service.ServiceContext.ObjectParameters.SIPIdentity = number
 	service.ServiceContext.ObjectParameters.SIPUser = number
 	service.ServiceContext.ObjectParameters.SIPPassword = password
+	service.ServiceContext.ObjectParameters.Codec = codec
+	service.ServiceContext.ObjectParameters.SIPServer = sipserver
 
 	var mcpresult MCPResult
 	log.Debugf("Service data for phone is %v", service)
@@ -513,6 +524,61 @@ func DeleteService(name string) error {
 	return err
 }
 
+// Change the profile of a service object in place, such as for a speed upgrade or downgrade
+func ModifyServiceProfile(name string, subscriberid string, profile string) error {
+	token, err := MCPAuth()
+	if err != nil {
+		log.Errorf("Could not authenticate to MCP %v", err)
+		return err
+	}
+	var mcpresult MCPResult
+	var service MCPService
+	service.ServiceContext.ServiceID = name
+	service.ServiceContext.RemoteID = subscriberid
+	service.ServiceContext.CircuitID = subscriberid
+	service.ServiceContext.ProfileName = profile
+
+	mcpresult, err = MCPRequestWait(token, "adtran-cloud-platform-orchestration:modify", service)
+	log.Debugf("MCP result is %v", mcpresult)
+	if err != nil {
+		log.Errorf("Problem modifying service %v", name)
+	} else {
+		log.Infof("Changed service %v to profile %v", name, profile)
+	}
+	return err
+}
+
+// Deactivate a service object - it stays configured on the ONT but passes no traffic until it is activated
+func DeactivateService(name string) error {
+	return serviceAction(name, "deactivate")
+}
+
+// Activate a service object that was deactivated
+func ActivateService(name string) error {
+	return serviceAction(name, "activate")
+}
+
+// Run an orchestration action on a service object by name
+func serviceAction(name string, action string) error {
+	token, err := MCPAuth()
+	if err != nil {
+		log.Errorf("Could not authenticate to MCP %v", err)
+		return err
+	}
+	var mcpresult MCPResult
+	var service MCPService
+	service.ServiceContext.ServiceID = name
+
+	mcpresult, err = MCPRequestWait(token, "adtran-cloud-platform-orchestration:"+action, service)
+	log.Debugf("MCP result is %v", mcpresult)
+	if err != nil {
+		log.Errorf("Problem with %v of service %v", action, name)
+	} else {
+		log.Infof("Service %v %vd", name, action)
+	}
+	return err
+}
+
 func GetDevice(token string, name string) (data MCPDeviceInfo, err error) {
 	query := "adtran-cloud-platform-uiworkflow-devices:devices/device=" + name
 	var result []byte
@@ -635,6 +701,7 @@ func ReflowDevice(token string, devices []string, jobname string) error {
 }
 
 func UIRunCommand(command string, context string, name string) (result UICommand, err error) {
+	defer metrics.Backend("mcp", "uicommand").Done(&err)
 	var authtoken string
 	authtoken, err = MCPAuth()
 	if err != nil {
@@ -59,6 +59,8 @@ type MCPService struct {
 			SIPIdentity string `json:"sip-identity"`
 			SIPUser     string `json:"sip-user-name"`
 			SIPPassword string `json:"sip-password"`
+			Codec       string `json:"codec,omitempty"`
+			SIPServer   string `json:"sip-server,omitempty"`
 		} `json:"object-parameters,omitempty"`
 		UplinkContext struct {
 			InterfaceEndpoint struct {
@@ -188,6 +190,7 @@ type MCPServiceInfo struct {
 	Downlink struct {
 		InterfaceEndpoint struct {
 			DeviceName     string      `json:"device-name"`
+			InterfaceName  string      `json:"interface-name"`
 			OuterTagVlanID interface{} `json:"outer-tag-vlan-id"`
 			InnerTagVlanID interface{} `json:"inner-tag-vlan-id"`
 			InterfaceID    string      `json:"interface-id"`
@@ -245,3 +248,16 @@ func (job *MCPJob) PopulateDevice(device []string) {
 	//		JobTriggerContext{},
 	//	}
 }
+
+// Whether MCP has the service - querying one that doesn't exist gives an empty state
+func (info MCPServiceInfo) Exists() bool {
+	return info.State != ""
+}
+
+// The VLAN the service is on towards the network - 0 if it is not a number
+func (info MCPServiceInfo) Vlan() int {
+	if vlan, ok := info.Uplink.InterfaceEndpoint.OuterTagVlanID.(float64); ok {
+		return int(vlan)
+	}
+	return 0
+}
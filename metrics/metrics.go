@@ -0,0 +1,103 @@
+package metrics
+
+/*
+	Prometheus metrics shared by the provisioning subsystems.  They are registered with the default registry, and
+	bootstrap serves them on /metrics.
+
+	Time a call to a backend system with a named error result:
+
+		defer metrics.Backend("mcp", "request").Done(&err)
+
+	or around a call:
+
+		timer := metrics.Backend("smartrg", "GetSubscriber")
+		acsacct, err = smartrg.GetSubscriber(id)
+		timer.Done(&err)
+*/
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "provision"
+
+var (
+	RequestsConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "requests_consumed_total",
+		Help:      "Provision requests consumed, by request type.  Requests that fail validation have the type invalid.",
+	}, []string{"type"})
+
+	Results = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "results_total",
+		Help:      "Provision results sent, by outcome - success or failure.",
+	}, []string{"outcome"})
+
+	Exceptions = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "exceptions_total",
+		Help:      "Provision exceptions sent.",
+	})
+
+	BackendLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_duration_seconds",
+		Help:      "Time taken by calls to backend systems, by backend, operation and outcome - ok or error.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30},
+	}, []string{"backend", "operation", "outcome"})
+
+	ConsumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "consumer_lag",
+		Help:      "Messages waiting behind the last one claimed, by topic and partition.",
+	}, []string{"topic", "partition"})
+
+	InFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "messages_in_flight",
+		Help:      "Messages being handled right now.",
+	})
+)
+
+// Times a call to a backend system
+type Timer struct {
+	backend   string
+	operation string
+	start     time.Time
+}
+
+// Start timing a call to a backend
+func Backend(backend string, operation string) Timer {
+	return Timer{backend: backend, operation: operation, start: time.Now()}
+}
+
+// Record the call, taking the error through a pointer so it can be deferred before the error is set
+func (timer Timer) Done(err *error) {
+	outcome := "ok"
+	if err != nil && *err != nil {
+		outcome = "error"
+	}
+	BackendLatency.WithLabelValues(timer.backend, timer.operation, outcome).Observe(time.Since(timer.start).Seconds())
+}
+
+// Record a result by whether it succeeded
+func Result(success bool) {
+	if success {
+		Results.WithLabelValues("success").Inc()
+	} else {
+		Results.WithLabelValues("failure").Inc()
+	}
+}
+
+// Record how far behind the end of a partition the consumer is
+func Lag(topic string, partition int32, lag int64) {
+	if lag < 0 {
+		lag = 0
+	}
+	ConsumerLag.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(lag))
+}
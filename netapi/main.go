@@ -16,6 +16,8 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 )
 
 var (
@@ -26,7 +28,7 @@ var (
 	TLSCert = flag.String("tls.cert", "/etc/ssl/netapi.crt", "LDAP Server Certificate")
 	TLSKey  = flag.String("tls.key", "/etc/ssl/private/netapi.key", "LDAP Server private key")
 
-	APIKey = flag.String("apikey", "098g5467o456n78s8e5878c8ty4578uihdsrc", "API Key used for simple authentication")
+	APIKey = flag.String("apikey", "", "API Key used for simple authentication - deprecated, use the netapi.apikey secret")
 
 	MongoURI     = flag.String("mongouri", "mongodb://coredb01.dc1.osh.telmax.ca:27017", "MongoDB URL for telephone database")
 	NetDatabase  = flag.String("netdatabase", "network", "Network database")
@@ -46,8 +48,11 @@ func init() {
 	flag.Parse()
 	lvl, _ := log.ParseLevel(*LogLevel)
 	log.SetLevel(lvl)
+	if err := secrets.Load(); err != nil {
+		log.Fatalf("Problem loading secrets - %v", err)
+	}
 
-	DBClient = telmax.DBConnect(*MongoURI, "maxcoredb", "coredbmax955TEL")
+	DBClient = telmax.DBConnect(*MongoURI, "maxcoredb", secrets.Get("mongo.password", ""))
 	if DBClient != nil {
 		NetDB = DBClient.Database(*NetDatabase)
 		CoreDB = DBClient.Database(*CoreDatabase)
@@ -73,7 +78,8 @@ func main() {
 					AppCleanup()
 					os.Exit(1)
 				} else if s == syscall.SIGHUP {
-					log.Warning("Re-running process routine")
+					log.Warning("Reloading secrets")
+					secrets.Reload()
 
 				} else {
 
@@ -129,7 +135,8 @@ func CORSHeaders(w http.ResponseWriter, r *http.Request) {
 
 // Check API Key Authorization
 func CheckAuth(w http.ResponseWriter, r *http.Request) bool {
-	if r.Header.Get("api-key") == *APIKey {
+	key := secrets.Get("netapi.apikey", *APIKey)
+	if key != "" && r.Header.Get("api-key") == key {
 		return true
 	}
 	http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bitbucket.org/telmaxdc/telmax-provision/netdb"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 	"context"
 	"flag"
 	"fmt"
@@ -34,11 +35,14 @@ func init() {
 	flag.Parse()
 	lvl, _ := log.ParseLevel(*LogLevel)
 	log.SetLevel(lvl)
+	if err := secrets.Load(); err != nil {
+		log.Fatalf("Problem loading secrets - %v", err)
+	}
 
 	clientOptions := options.Client().ApplyURI(*MongoURI)
 	clientOptions.SetAuth(options.Credential{
 		Username: "maxcoredb",
-		Password: "coredbmax955TEL",
+		Password: secrets.Get("mongo.password", ""),
 	})
 	client, err := mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
@@ -49,6 +49,16 @@ func AllocateCircuit(db *mongo.Database, wirecentre string, pon string, subscrib
 	return
 }
 
+// Find the circuit AllocateCircuit would give the subscriber, without assigning it
+func PlanCircuit(db *mongo.Database, pon string, subscriber string) (circuit Circuit, existing bool, err error) {
+	circuit, err = GetSubscriberCircuit(db, subscriber)
+	if circuit.ID != "" {
+		return circuit, true, nil
+	}
+	circuit, err = GetNextCircuit(db, pon)
+	return circuit, false, err
+}
+
 func GetSubscriberCircuit(db *mongo.Database, subscriber string) (circuit Circuit, err error) {
 	filter := bson.D{{"subscriber", subscriber}}
 	err = db.Collection("access_ports").FindOne(context.TODO(), filter).Decode(&circuit)
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// Destinations for requesting users are this followed by the user
+const UserPrefix = "user:"
+
+var (
+	webClient = &http.Client{Timeout: 15 * time.Second}
+	fileLock  sync.Mutex
+)
+
+// What we tell people about an exception
+type Notification struct {
+	Subject     string
+	Text        string
+	Time        time.Time
+	Fingerprint string                              // The same for repeats of the same problem
+	Exception   *telmaxprovision.ProvisionException `json:",omitempty"`
+}
+
+func NewNotification(exception telmaxprovision.ProvisionException) Notification {
+	subject := fmt.Sprintf("Provisioning exception from %s - %s", exception.System, exception.Tag)
+	if exception.Alert {
+		subject = "ALERT: " + subject
+	}
+	if exception.AccountCode != "" {
+		subject += fmt.Sprintf(" (%s)", telmaxprovision.SubscriberKey(exception.AccountCode, exception.SubscribeCode))
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "System:     %s\n", exception.System)
+	fmt.Fprintf(&text, "Tag:        %s\n", exception.Tag)
+	fmt.Fprintf(&text, "Account:    %s %s\n", exception.AccountCode, exception.SubscribeCode)
+	if exception.Reference != "" {
+		fmt.Fprintf(&text, "Reference:  %s %s\n", exception.ReferenceType, exception.Reference)
+	}
+	fmt.Fprintf(&text, "Request:    %s\n", exception.RequestID)
+	fmt.Fprintf(&text, "Time:       %s\n", exception.Time.In(TZLocation).Format(time.RFC1123))
+	fmt.Fprintf(&text, "\n%s\n", exception.Error)
+
+	// Leave out the request and time, so the same failure on a redelivery or the next request is a duplicate
+	sum := sha1.Sum([]byte(strings.Join([]string{exception.System, exception.Tag, exception.AccountCode,
+		exception.SubscribeCode, exception.Reference, exception.Error}, "\x00")))
+	return Notification{
+		Subject:     subject,
+		Text:        text.String(),
+		Time:        time.Now().In(TZLocation),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Exception:   &exception,
+	}
+}
+
+// Send a notification to a channel from the rules, or to a requesting user
+func Send(destination string, note Notification) error {
+	if strings.HasPrefix(destination, UserPrefix) {
+		return SendEmail([]string{UserAddress(strings.TrimPrefix(destination, UserPrefix))}, note)
+	}
+	channel, ok := CurrentRules().Channels[destination]
+	if !ok {
+		return fmt.Errorf("no channel named %s", destination)
+	}
+	switch channel.Type {
+	case ChannelEmail:
+		return SendEmail(channel.To, note)
+	case ChannelWebhook:
+		url := channel.URL
+		if channel.Secret != "" {
+			url = secrets.Get(channel.Secret, url)
+		}
+		return SendWebhook(url, note)
+	case ChannelFile:
+		return AppendFile(channel.Path, destination, note)
+	}
+	return fmt.Errorf("channel %s has unknown type %q", destination, channel.Type)
+}
+
+// The email address for a requesting user
+func UserAddress(user string) string {
+	if strings.Contains(user, "@") {
+		return user
+	}
+	return user + "@" + *UserDomain
+}
+
+func SendEmail(to []string, note Notification) (err error) {
+	defer metrics.Backend("smtp", "SendMail").Done(&err)
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", *SMTPFrom)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", note.Subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", note.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(note.Text, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if *SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(*SMTPServer)
+		auth = smtp.PlainAuth("", *SMTPUser, secrets.Get("smtp.password", ""), host)
+	}
+	return smtp.SendMail(*SMTPServer, auth, *SMTPFrom, to, message.Bytes())
+}
+
+// Post the notification as {"text": ...}, which Slack and Teams incoming webhooks both understand
+func SendWebhook(url string, note Notification) (err error) {
+	defer metrics.Backend("webhook", "Post").Done(&err)
+	body, err := json.Marshal(map[string]string{"text": "*" + note.Subject + "*\n" + note.Text})
+	if err != nil {
+		return err
+	}
+	rsp, err := webClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", rsp.Status)
+	}
+	return nil
+}
+
+// Append the notification to a file as a line of JSON
+func AppendFile(path string, destination string, note Notification) error {
+	line, err := json.Marshal(struct {
+		Destination string
+		Notification
+	}{destination, note})
+	if err != nil {
+		return err
+	}
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Why a notification wasn't sent
+const (
+	ReasonDuplicate = "duplicate"
+	ReasonLimited   = "limited"
+)
+
+var notified = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "provision",
+	Name:      "notifications_total",
+	Help:      "Exception notifications, by destination and outcome - sent, failed, duplicate or limited.",
+}, []string{"destination", "outcome"})
+
+// Keeps repeats and floods of notifications away from each destination
+type Limiter struct {
+	Dedup  time.Duration // How long the same notification isn't sent to a destination again
+	Rate   int           // Most notifications per window to a destination - 0 for no limit
+	Window time.Duration
+
+	lock    sync.Mutex
+	sent    map[string]time.Time // Last time each fingerprint went to each destination
+	windows map[string]*window
+}
+
+// Notifications to one destination in the current window
+type window struct {
+	start time.Time
+	sent  int
+	held  int // Held back since the last summary
+}
+
+func NewLimiter(dedup time.Duration, rate int, per time.Duration) *Limiter {
+	return &Limiter{
+		Dedup:   dedup,
+		Rate:    rate,
+		Window:  per,
+		sent:    map[string]time.Time{},
+		windows: map[string]*window{},
+	}
+}
+
+// Whether to send a notification to the destination, and the reason if not.  A notification that is allowed uses up
+// some of the destination's rate, whether or not it goes through.
+func (limiter *Limiter) Allow(destination string, fingerprint string, now time.Time) (bool, string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	if last, ok := limiter.sent[destination+"/"+fingerprint]; ok && now.Sub(last) < limiter.Dedup {
+		return false, ReasonDuplicate
+	}
+	current := limiter.windows[destination]
+	if current == nil {
+		current = &window{start: now}
+		limiter.windows[destination] = current
+	}
+	if now.Sub(current.start) >= limiter.Window {
+		current.start = now
+		current.sent = 0
+	}
+	if limiter.Rate > 0 && current.sent >= limiter.Rate {
+		current.held++
+		return false, ReasonLimited
+	}
+	current.sent++
+	return true, ""
+}
+
+// Record a notification that went through, so repeats of it are held back
+func (limiter *Limiter) Sent(destination string, fingerprint string, now time.Time) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	limiter.sent[destination+"/"+fingerprint] = now
+}
+
+// How many notifications were held back from each destination whose window has ended.  The counts start again.
+func (limiter *Limiter) Held(now time.Time) map[string]int {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+	held := map[string]int{}
+	for destination, current := range limiter.windows {
+		if now.Sub(current.start) < limiter.Window {
+			continue
+		}
+		if current.held > 0 {
+			held[destination] = current.held
+		}
+		delete(limiter.windows, destination)
+	}
+	for key, last := range limiter.sent {
+		if now.Sub(last) >= limiter.Dedup {
+			delete(limiter.sent, key)
+		}
+	}
+	return held
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	start := time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+	type step struct {
+		at          time.Duration // Since start
+		destination string
+		fingerprint string
+		allowed     bool
+		reason      string
+	}
+	tests := []struct {
+		name  string
+		rate  int
+		steps []step
+	}{
+		{"duplicates held for the dedup time", 0, []step{
+			{0, "oncall", "A", true, ""},
+			{time.Minute, "oncall", "A", false, ReasonDuplicate},
+			{time.Minute, "tickets", "A", true, ""},
+			{time.Minute, "oncall", "B", true, ""},
+			{15 * time.Minute, "oncall", "A", true, ""},
+		}},
+		{"rate per destination per window", 2, []step{
+			{0, "oncall", "A", true, ""},
+			{time.Second, "oncall", "B", true, ""},
+			{2 * time.Second, "oncall", "C", false, ReasonLimited},
+			{2 * time.Second, "tickets", "C", true, ""},
+			{10 * time.Minute, "oncall", "C", true, ""},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := NewLimiter(15*time.Minute, test.rate, 10*time.Minute)
+			for i, step := range test.steps {
+				now := start.Add(step.at)
+				allowed, reason := limiter.Allow(step.destination, step.fingerprint, now)
+				if allowed != step.allowed || reason != step.reason {
+					t.Errorf("step %d: Allow = %v %q, want %v %q", i, allowed, reason, step.allowed, step.reason)
+				}
+				if allowed {
+					limiter.Sent(step.destination, step.fingerprint, now)
+				}
+			}
+		})
+	}
+}
+
+func TestLimiterHeld(t *testing.T) {
+	start := time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(time.Minute, 1, 10*time.Minute)
+	for _, fingerprint := range []string{"A", "B", "C"} {
+		limiter.Allow("oncall", fingerprint, start)
+	}
+	if held := limiter.Held(start.Add(time.Minute)); len(held) != 0 {
+		t.Errorf("held %v before the window ended", held)
+	}
+	if held := limiter.Held(start.Add(10 * time.Minute)); !reflect.DeepEqual(held, map[string]int{"oncall": 2}) {
+		t.Errorf("held = %v, want 2 for oncall", held)
+	}
+	if held := limiter.Held(start.Add(20 * time.Minute)); len(held) != 0 {
+		t.Errorf("held %v again after the counts were reset", held)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+/*
+	The notifier tells people about provision exceptions.  The rules file routes each exception by its System, Tag and
+	Alert flag to email, webhooks (Slack and Teams both take the same JSON) and the user who made the request, or to
+	a file for testing.  See notifier.yaml.example.
+
+	The same exception is only sent to a destination once per -notify.dedup, and each destination gets at most
+	-notify.rate notifications per -notify.window.  Anything held back is counted and sent as a summary when the
+	window ends, so a backend that keeps failing doesn't flood whoever is on call.
+
+	The requesting user isn't on the exception, so we also consume provisionrequest and remember who sent each
+	request.  The rules file is read again on SIGHUP.
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"bitbucket.org/telmaxdc/telmax-provision/bootstrap"
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+var (
+	Service = bootstrap.New("notifier")
+
+	RulesFile  = flag.String("rules", "/etc/provision/notifier.yaml", "YAML file of notification channels and routes")
+	UserDomain = flag.String("notify.userdomain", "telmax.ca", "Email domain for requesting users that aren't already an address")
+	Dedup      = flag.Duration("notify.dedup", 15*time.Minute, "Don't send the same exception to a destination again within this time")
+	Rate       = flag.Int("notify.rate", 10, "Most notifications sent to one destination per window - 0 for no limit")
+	Window     = flag.Duration("notify.window", 10*time.Minute, "Rate limit window")
+
+	SMTPServer = flag.String("smtp.server", "localhost:25", "SMTP server address:port")
+	SMTPFrom   = flag.String("smtp.from", "provisioning@telmax.ca", "Sender address for email notifications")
+	SMTPUser   = flag.String("smtp.user", "", "SMTP user - the smtp.password secret is its password.  No authentication when empty.")
+
+	TZLocation *time.Location
+	CoreDB     *mongo.Database
+	Bus        *kafka.Client // Provisioning topics
+	Limits     *Limiter
+)
+
+func setup() {
+	bootstrap.Default("kafka.topic", "provisionexception,provisionrequest")
+	bootstrap.Default("health.listen", ":5026")
+	Service.OnSetup(func() error {
+		return LoadRules(*RulesFile)
+	})
+	Service.Init()
+	if Service.CoreDB == nil {
+		log.Fatal("Could not connect to the database")
+	}
+	Bus = Service.Bus
+	CoreDB = Service.CoreDB
+	TZLocation = Service.TZLocation
+	if TZLocation == nil {
+		TZLocation = time.Local
+	}
+	InitRequesters(CoreDB)
+	Limits = NewLimiter(*Dedup, *Rate, *Window)
+
+	secrets.OnReload(func() {
+		if err := LoadRules(*RulesFile); err != nil {
+			log.Errorf("Problem reloading %s, keeping the old rules - %v", *RulesFile, err)
+		}
+	})
+}
+
+func main() {
+	setup()
+	Service.HandleMessages(MessageHandler)
+	Service.OnStart(func(ctx context.Context) error {
+		go summaryLoop(ctx)
+		return nil
+	})
+	Service.Run()
+}
+
+func MessageHandler(ctx context.Context, topic string, timestamp time.Time, data []byte) error {
+	log.Debugf("Kafka message %v, %v, %v", topic, timestamp, string(data))
+	switch topic {
+	case Bus.ProvisionTopic:
+		request, _, err := telmaxprovision.OpenRequest(data)
+		if err != nil {
+			// The subsystems park bad requests - nothing for us to do
+			log.Debugf("Skipping unreadable request - %v", err)
+			return nil
+		}
+		return RememberRequester(request)
+	case Bus.ExceptionTopic:
+		exception, _, err := telmaxprovision.OpenException(data)
+		if err != nil {
+			return err
+		}
+		return Notify(exception)
+	}
+	return nil
+}
+
+// Send an exception everywhere the rules route it.  Deliveries that fail are retried without repeating the ones that
+// went through.
+func Notify(exception telmaxprovision.ProvisionException) error {
+	route := CurrentRules().Match(exception)
+	destinations := route.Notify
+	if route.User {
+		user, err := Requester(exception.RequestID)
+		if err != nil {
+			log.Errorf("Problem looking up the requester of %v - %v", exception.RequestID, err)
+		} else if user != "" {
+			destinations = append(destinations, UserPrefix+user)
+		}
+	}
+	if len(destinations) == 0 {
+		log.Debugf("No route for exception %v from %v (%v)", exception.RequestID, exception.System, exception.Tag)
+		return nil
+	}
+
+	note := NewNotification(exception)
+	var failed []string
+	for _, destination := range destinations {
+		if ok, reason := Limits.Allow(destination, note.Fingerprint, time.Now()); !ok {
+			log.Infof("Not sending exception %v to %v - %v", exception.RequestID, destination, reason)
+			notified.WithLabelValues(destination, reason).Inc()
+			continue
+		}
+		err := Send(destination, note)
+		if err != nil {
+			log.Errorf("Problem sending exception %v to %v - %v", exception.RequestID, destination, err)
+			notified.WithLabelValues(destination, "failed").Inc()
+			failed = append(failed, destination)
+			continue
+		}
+		Limits.Sent(destination, note.Fingerprint, time.Now())
+		notified.WithLabelValues(destination, "sent").Inc()
+	}
+	if len(failed) > 0 {
+		return kafka.Retryable(fmt.Errorf("could not notify %s", strings.Join(failed, ", ")))
+	}
+	return nil
+}
+
+// Tell each destination how many notifications the rate limit held back, once its window is over
+func summaryLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+		for destination, held := range Limits.Held(time.Now()) {
+			note := Notification{
+				Subject: fmt.Sprintf("%d provisioning exceptions held back", held),
+				Text:    fmt.Sprintf("%d more provisioning exceptions were not sent to %s in the last %v because of the rate limit.  The tracker has all of them.", held, destination, *Window),
+				Time:    time.Now().In(TZLocation),
+			}
+			if err := Send(destination, note); err != nil {
+				log.Errorf("Problem sending held back summary to %v - %v", destination, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+const RequesterCollection = "provision_requesters"
+
+// How long we remember who made a request
+const RequesterExpiry = 30 * 24 * time.Hour
+
+// Who made a request
+type RequesterEntry struct {
+	RequestID string    `bson:"request_id"`
+	User      string    `bson:"user"`
+	Created   time.Time `bson:"created"`
+}
+
+var Requesters *mongo.Collection
+
+func InitRequesters(db *mongo.Database) {
+	Requesters = db.Collection(RequesterCollection)
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{"request_id", 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{"created", 1}}, Options: options.Index().SetExpireAfterSeconds(int32(RequesterExpiry.Seconds()))},
+	}
+	_, err := Requesters.Indexes().CreateMany(context.TODO(), indexes)
+	if err != nil {
+		log.Errorf("Problem creating requester indexes - %v", err)
+	}
+}
+
+// Remember the user on a request, if it has one
+func RememberRequester(request telmaxprovision.ProvisionRequest) error {
+	if request.RequestUser == "" || request.RequestID == "" {
+		return nil
+	}
+	filter := bson.D{{"request_id", request.RequestID}}
+	update := bson.D{{"$set", bson.D{
+		{"user", request.RequestUser},
+		{"created", time.Now()},
+	}}}
+	_, err := Requesters.UpdateOne(context.TODO(), filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// The user who made a request - empty if we don't know
+func Requester(requestID string) (string, error) {
+	var entry RequesterEntry
+	err := Requesters.FindOne(context.TODO(), bson.D{{"request_id", requestID}}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return "", nil
+	}
+	return entry.User, err
+}
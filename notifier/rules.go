@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// Kinds of channel
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	ChannelFile    = "file"
+)
+
+// Where notifications can go, and which exceptions go where
+type Rules struct {
+	Channels map[string]ChannelConfig `yaml:"channels"`
+	Routes   []Route                  `yaml:"routes"`
+}
+
+// A named destination
+type ChannelConfig struct {
+	Type   string   `yaml:"type"`   // email, webhook or file
+	To     []string `yaml:"to"`     // Email addresses
+	URL    string   `yaml:"url"`    // Webhook URL
+	Secret string   `yaml:"secret"` // Name of a secret holding the webhook URL, for URLs with a token in them
+	Path   string   `yaml:"path"`   // File to append to
+}
+
+// Exceptions that match every field that is set go to the channels in Notify, and to the requesting user if User is
+// set.  Every matching route is used unless one has Stop set.
+type Route struct {
+	System string   `yaml:"system"` // The subsystem that raised it, such as internet or tv
+	Tag    string   `yaml:"tag"`    // The kind of problem, such as "Early Request"
+	Alert  *bool    `yaml:"alert"`  // Only alerts, or only exceptions that aren't alerts
+	Notify []string `yaml:"notify"` // Channel names
+	User   bool     `yaml:"user"`   // Also email the user who made the request
+	Stop   bool     `yaml:"stop"`   // Don't look at the routes after this one
+}
+
+var (
+	rules     Rules
+	rulesLock sync.RWMutex
+)
+
+// Read the rules file, and use it if every route names a channel that exists
+func LoadRules(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var loaded Rules
+	if err := yaml.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("problem reading %s - %v", path, err)
+	}
+	if err := loaded.Check(); err != nil {
+		return fmt.Errorf("problem in %s - %v", path, err)
+	}
+	rulesLock.Lock()
+	rules = loaded
+	rulesLock.Unlock()
+	log.Infof("Loaded %d notification channels and %d routes from %s", len(loaded.Channels), len(loaded.Routes), path)
+	return nil
+}
+
+func CurrentRules() Rules {
+	rulesLock.RLock()
+	defer rulesLock.RUnlock()
+	return rules
+}
+
+// Make sure every channel can be sent to and every route goes somewhere
+func (rules Rules) Check() error {
+	for name, channel := range rules.Channels {
+		if strings.HasPrefix(name, UserPrefix) {
+			return fmt.Errorf("channel %s - names starting with %s are for requesting users", name, UserPrefix)
+		}
+		switch channel.Type {
+		case ChannelEmail:
+			if len(channel.To) == 0 {
+				return fmt.Errorf("email channel %s has no addresses", name)
+			}
+		case ChannelWebhook:
+			if channel.URL == "" && channel.Secret == "" {
+				return fmt.Errorf("webhook channel %s needs a url or a secret", name)
+			}
+		case ChannelFile:
+			if channel.Path == "" {
+				return fmt.Errorf("file channel %s has no path", name)
+			}
+		default:
+			return fmt.Errorf("channel %s has unknown type %q", name, channel.Type)
+		}
+	}
+	for i, route := range rules.Routes {
+		if len(route.Notify) == 0 && !route.User {
+			return fmt.Errorf("route %d doesn't notify anyone", i+1)
+		}
+		for _, name := range route.Notify {
+			if _, ok := rules.Channels[name]; !ok {
+				return fmt.Errorf("route %d notifies unknown channel %s", i+1, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Whether the route applies to an exception.  System and Tag are not case sensitive.
+func (route Route) Matches(exception telmaxprovision.ProvisionException) bool {
+	if route.System != "" && !strings.EqualFold(route.System, exception.System) {
+		return false
+	}
+	if route.Tag != "" && !strings.EqualFold(route.Tag, exception.Tag) {
+		return false
+	}
+	if route.Alert != nil && *route.Alert != exception.Alert {
+		return false
+	}
+	return true
+}
+
+// Combine the routes that apply to an exception, with each channel listed once
+func (rules Rules) Match(exception telmaxprovision.ProvisionException) (matched Route) {
+	seen := map[string]bool{}
+	for _, route := range rules.Routes {
+		if !route.Matches(exception) {
+			continue
+		}
+		for _, name := range route.Notify {
+			if !seen[name] {
+				seen[name] = true
+				matched.Notify = append(matched.Notify, name)
+			}
+		}
+		matched.User = matched.User || route.User
+		if route.Stop {
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,228 @@
+package main
+
+/*
+	Replay provisioning requests to one subsystem, such as after fixing a bug that made it fail them.  Requests are
+	read from the provision topic, selected by the filters given, and republished to the subsystem's replay topic,
+	which it consumes when started with -kafka.replay.  Replayed requests are handled even if the ledger says they
+	were already done.
+
+	See what would be replayed:	replay -subsystem internet -from 2023-03-01 -to 2023-03-02 -dryrun
+	One account:			replay -subsystem rg -account 100234 -type New,Update
+	A list of requests:		replay -subsystem tv -requestid <id>,<id>
+	Requests from a file:		replay -subsystem eero -requestfile failed.txt
+*/
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	LogLevel    = flag.String("loglevel", "warn", "Log Level")
+	KafkaBrk    = flag.String("kafka.brokers", "kfk01.tor2.telmax.ca:9092", "Kafka brokers list separated by commas")
+	KafkaTopic  = flag.String("kafka.topic", "provisionrequest", "Topic to read the requests from")
+	Subsystem   = flag.String("subsystem", "", "Subsystem to replay to, such as internet, rg, tv or eero")
+	From        = flag.String("from", "", "Only requests sent at or after this time - RFC3339 or YYYY-MM-DD")
+	To          = flag.String("to", "", "Only requests sent before this time - RFC3339 or YYYY-MM-DD")
+	RequestIDs  = flag.String("requestid", "", "Only these RequestIDs, separated by commas")
+	RequestFile = flag.String("requestfile", "", "Only the RequestIDs in this file, one per line")
+	Account     = flag.String("account", "", "Only requests for this account code")
+	Types       = flag.String("type", "", "Only these request types, separated by commas")
+	DryRun      = flag.Bool("dryrun", false, "Print what would be replayed without sending anything")
+	ShowValue   = flag.Bool("value", false, "Print the message value")
+)
+
+// The parsed filters
+type filter struct {
+	from       time.Time
+	to         time.Time
+	requestIDs map[string]bool
+	types      map[telmaxprovision.RequestType]bool
+}
+
+func main() {
+	flag.Parse()
+	lvl, _ := log.ParseLevel(*LogLevel)
+	log.SetLevel(lvl)
+	if *Subsystem == "" {
+		log.Fatal("No subsystem to replay to - use -subsystem")
+	}
+	selection, err := parseFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := secrets.Load(); err != nil {
+		log.Fatalf("Problem loading secrets - %v", err)
+	}
+	brokers := strings.Split(*KafkaBrk, ",")
+	target := kafka.ReplayTopic(*KafkaTopic, *Subsystem)
+
+	var bus *kafka.Client
+	if !*DryRun {
+		bus, err = kafka.Connect(brokers)
+		if err != nil {
+			log.Fatalf("Failed to connect to Kafka - %v", err)
+		}
+		defer bus.Close()
+	}
+	var count, replayed int
+	err = kafka.ScanTopic(brokers, *KafkaTopic, func(message *kafka.Message) error {
+		request, ok := selection.match(message)
+		if !ok {
+			return nil
+		}
+		count++
+		printMessage(message, request)
+		if *DryRun {
+			return nil
+		}
+		err := replay(bus, message, target)
+		if err != nil {
+			return err
+		}
+		replayed++
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Problem replaying %v - %v", *KafkaTopic, err)
+	}
+	if *DryRun {
+		fmt.Printf("%d requests would be replayed to %s\n", count, target)
+	} else {
+		fmt.Printf("%d requests selected, %d replayed to %s\n", count, replayed, target)
+	}
+}
+
+// Check and parse the command line filters.  At least one is needed so a typo doesn't replay the whole topic.
+func parseFilter() (selection filter, err error) {
+	selection.from, err = parseTime(*From)
+	if err != nil {
+		return selection, fmt.Errorf("bad -from time - %v", err)
+	}
+	selection.to, err = parseTime(*To)
+	if err != nil {
+		return selection, fmt.Errorf("bad -to time - %v", err)
+	}
+	if *RequestIDs != "" || *RequestFile != "" {
+		selection.requestIDs = map[string]bool{}
+		for _, id := range strings.Split(*RequestIDs, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				selection.requestIDs[id] = true
+			}
+		}
+		if *RequestFile != "" {
+			err = readRequestFile(*RequestFile, selection.requestIDs)
+			if err != nil {
+				return selection, err
+			}
+		}
+	}
+	if *Types != "" {
+		selection.types = map[telmaxprovision.RequestType]bool{}
+		for _, requestType := range strings.Split(*Types, ",") {
+			selection.types[telmaxprovision.RequestType(strings.TrimSpace(requestType))] = true
+		}
+	}
+	if selection.from.IsZero() && selection.to.IsZero() && selection.requestIDs == nil && *Account == "" && selection.types == nil {
+		return selection, errors.New("no filters - give at least one of -from, -to, -requestid, -requestfile, -account or -type")
+	}
+	return selection, nil
+}
+
+// Read RequestIDs from a file, one per line, skipping blank lines and # comments
+func readRequestFile(name string, into map[string]bool) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		into[line] = true
+	}
+	return scanner.Err()
+}
+
+// Parse a time given on the command line, as RFC3339 or a local date
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.Local)
+}
+
+// Whether a message is a request the filters select
+func (selection filter) match(message *kafka.Message) (request telmaxprovision.ProvisionRequest, ok bool) {
+	if !selection.from.IsZero() && message.Timestamp.Before(selection.from) {
+		return request, false
+	}
+	if !selection.to.IsZero() && !message.Timestamp.Before(selection.to) {
+		return request, false
+	}
+	request, _, err := telmaxprovision.OpenRequest(message.Value)
+	if err != nil {
+		log.Debugf("Skipping %v/%v - not a request - %v", message.Partition, message.Offset, err)
+		return request, false
+	}
+	if selection.requestIDs != nil && !selection.requestIDs[request.RequestID] {
+		return request, false
+	}
+	if *Account != "" && request.AccountCode != *Account {
+		return request, false
+	}
+	if selection.types != nil && !selection.types[request.RequestType] {
+		return request, false
+	}
+	return request, true
+}
+
+func printMessage(message *kafka.Message, request telmaxprovision.ProvisionRequest) {
+	fmt.Printf("%d/%d\t%s\t%s\taccount=%s subscribe=%s request=%s\n",
+		message.Partition, message.Offset,
+		message.Timestamp.Format(time.RFC3339),
+		request.RequestType,
+		request.AccountCode,
+		request.SubscribeCode,
+		request.RequestID)
+	if *ShowValue {
+		fmt.Printf("\t%s\n", string(message.Value))
+	}
+}
+
+// Republish a request to the replay topic as it was sent, marked so the ledger lets it through again
+func replay(bus *kafka.Client, message *kafka.Message, target string) error {
+	republish := kafka.Message{
+		Topic: target,
+		Key:   message.Key,
+		Value: message.Value,
+	}
+	for key, value := range message.Headers {
+		republish.SetHeader(key, value)
+	}
+	republish.SetHeader(kafka.HeaderReplayed, message.Topic+"/"+strconv.Itoa(int(message.Partition))+"/"+strconv.FormatInt(message.Offset, 10))
+	republish.SetHeader(kafka.HeaderReprocess, "true")
+	err := bus.Transport.Publish(&republish)
+	if err != nil {
+		return err
+	}
+	log.Infof("Replayed %v/%v to %v partition %v offset %v", message.Partition, message.Offset, target, republish.Partition, republish.Offset)
+	return nil
+}
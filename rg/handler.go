@@ -1,49 +1,126 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	//	"go.mongodb.org/mongo-driver/bson"
 	"bitbucket.org/telmaxdc/smartrg"
 	//"strings"
 	"bitbucket.org/telmaxdc/telmax-common/maxbill"
 
-	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 	"bitbucket.org/telmaxdc/telmax-provision/structs"
 	"strconv"
 	"time"
 )
 
-func HandleProvision(request telmaxprovision.ProvisionRequest) {
+func HandleProvision(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
 	log.Infof("Got provision request %v", request)
 
 	switch request.RequestType {
-	case "New":
-		NewRequest(request)
+	case telmaxprovision.RequestNew:
+		return NewRequest(request)
 
-	case "Update":
-		NewRequest(request)
+	case telmaxprovision.RequestUpdate:
+		return NewRequest(request)
 
-	case "DeviceReturn":
+	case telmaxprovision.RequestDeviceReturn:
 		log.Info("Handling returned devices")
-		DeviceReturn(request)
+		return DeviceReturn(request)
 
-	case "Cancel":
+	case telmaxprovision.RequestCancel:
+
+	case telmaxprovision.RequestSuspend:
+		return SuspendSubscriber(request, true)
+
+	case telmaxprovision.RequestResume:
+		return SuspendSubscriber(request, false)
+	}
+	return nil
+}
+
+// The ACS label on suspended subscribers
+const SuspendedLabel = "Suspended"
+
+// Lock or unlock the subscriber's ACS subscriber, and label it so the suspension shows in the ACS.  Suspend and Resume
+// requests don't list devices, so it is found through the Subscribe record.  The devices themselves are left alone -
+// service is stopped at the OLT.
+func SuspendSubscriber(request telmaxprovision.ProvisionRequest, suspend bool) error {
+	result := request.NewResult()
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		log.Errorf("Problem getting subscriber %v", err)
+		result.Result = "Problem getting subscriber " + err.Error()
+		Bus.SubmitResult(result)
+		return err
+	}
+	if subscribe.ACSSubscriber == 0 {
+		log.Infof("Subscribe %v-%v has no ACS account - nothing to %v", request.AccountCode, request.SubscribeCode, request.RequestType)
+		return nil
+	}
+	timer := metrics.Backend("smartrg", "GetSubscriber")
+	acsacct, err := smartrg.GetSubscriber(subscribe.ACSSubscriber)
+	timer.Done(&err)
+	if err != nil {
+		log.Errorf("Problem getting subscriber for %v %v", request.RequestType, err)
+		result.Result = "Problem getting ACS Subscriber record" + err.Error()
+		Bus.SubmitResult(result)
+		return err
+	}
+	acsacct.Credentials.Locked = suspend
+	var labels []smartrg.ACSLabel
+	for _, label := range acsacct.Labels {
+		if label.Name != SuspendedLabel {
+			labels = append(labels, label)
+		}
+	}
+	if suspend {
+		labels = append(labels, smartrg.ACSLabel{
+			Name:     SuspendedLabel,
+			FGColour: "#fff",
+			BGColour: "#c00",
+		})
 	}
+	acsacct.Labels = labels
+	timer = metrics.Backend("smartrg", "PutSubscriber")
+	err = smartrg.PutSubscriber(acsacct)
+	timer.Done(&err)
+	if err != nil {
+		log.Errorf("Problem updating subscriber for %v %v", request.RequestType, err)
+		result.Result = "Problem updating ACS Subscriber record" + err.Error()
+	} else if suspend {
+		result.Success = true
+		result.Result = "Locked and labelled suspended ACS subscriber record " + strconv.Itoa(subscribe.ACSSubscriber)
+	} else {
+		result.Success = true
+		result.Result = "Unlocked ACS subscriber record " + strconv.Itoa(subscribe.ACSSubscriber)
+	}
+	Bus.SubmitResult(result)
+	return err
 }
 
-func DeviceReturn(request telmaxprovision.ProvisionRequest) {
+// Remove returned RGs from the ACS.  Returns the last problem, after trying every device.
+func DeviceReturn(request telmaxprovision.ProvisionRequest) (failed error) {
 	for _, device := range request.Devices {
 		if device.DeviceType == "RG" {
+			timer := metrics.Backend("smartrg", "GetDeviceRecord")
 			record, err := smartrg.GetDeviceRecord(device.Mac)
+			timer.Done(&err)
 			if err != nil {
 				log.Errorf("Problem getting smartRG record for device %s, %v", device.Mac, err)
+				failed = err
 			} else {
 				if len(record) == 1 {
 					devicecode, _ := strconv.ParseInt(record[0].Fields.DeviceID, 10, 32)
 					log.Infof("Deleting device %v from ACS", devicecode)
+					timer := metrics.Backend("smartrg", "RemoveDevice")
 					err = smartrg.RemoveDevice(int(devicecode))
+					timer.Done(&err)
 					if err != nil {
 						log.Errorf("Problem removing device %s - %v", record[0].Fields.DeviceID, err)
+						failed = err
 					}
 
 				}
@@ -51,39 +128,44 @@ func DeviceReturn(request telmaxprovision.ProvisionRequest) {
 
 		}
 	}
-
+	return
 }
 
-func NewRequest(request telmaxprovision.ProvisionRequest) {
-	var hasRG bool
-	var devices []string
-	var subscriberID int
+// The MACs of the SmartRG devices in a request
+func rgDevices(request telmaxprovision.ProvisionRequest) (devices []string) {
 	for _, device := range request.Devices {
 		if device.DeviceType == "RG" && device.Mac != "" && (device.DefinitionCode == "DEVIDEFI008" || device.DefinitionCode == "DEVIDEFI013" || device.DefinitionCode == "DEVIDEFI0034") {
-			hasRG = true
 			log.Infof("Found RG device %v", device.Mac)
 			devices = append(devices, device.Mac)
 		}
 	}
-	result := telmaxprovision.ProvisionResult{
-		RequestID: request.RequestID,
-		Time:      time.Now(),
-	}
+	return
+}
+
+// Create or update the ACS subscriber and add the request's RGs to it.  Every device is tried - the last problem is
+// returned.
+func NewRequest(request telmaxprovision.ProvisionRequest) (failed error) {
+	var subscriberID int
+	devices := rgDevices(request)
+	hasRG := len(devices) > 0
+	result := request.NewResult()
 	subscriberaccount := request.AccountCode + request.SubscribeCode
 	if hasRG {
 		subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
 		if err != nil {
 			log.Errorf("Problem getting subscriber %v", err)
-			return
+			return err
 		}
 		log.Warnf("Subscriber ACS account is %v", subscribe.ACSSubscriber)
 		name := subscribe.FirstName + " " + subscribe.LastName
 		if subscribe.ACSSubscriber == 0 {
 			log.Warn("Subscribe does not have ACS account")
+			timer := metrics.Backend("smartrg", "NewSubscriber")
 			subscribe.ACSSubscriber, err = smartrg.NewSubscriber(name, subscribe.Email, subscriberaccount)
+			timer.Done(&err)
 			if err != nil {
 				log.Errorf("Problem creating subscriber %v", err)
-				return
+				return err
 			}
 		} else {
 			log.Warn("Subscribe already has account - not creating")
@@ -94,21 +176,27 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 		if err != nil {
 			log.Errorf("Problem updating subscribe %v", err)
 			result.Result = "Problem creating ACS Subscriber record" + err.Error()
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
+			failed = err
 		} else {
 			var acsacct smartrg.ACSSubscriber
+			timer := metrics.Backend("smartrg", "GetSubscriber")
 			acsacct, err = smartrg.GetSubscriber(subscribe.ACSSubscriber)
+			timer.Done(&err)
 			if err != nil {
 				log.Errorf("Problem getting subscriber for update %v", err)
 				result.Result = "Problem getting ACS Subscriber record" + err.Error()
-				kafka.SubmitResult(result)
-
+				Bus.SubmitResult(result)
+				failed = err
 			} else {
 				log.Debugf("ACS Subscriber details are %v", acsacct)
 				acsacct.Attributes.Email = subscribe.Email
 				acsacct.Attributes.Name = name
 				acsacct.Credentials.Login = subscribe.Email
-				acsacct.Credentials.Password = "telMAXinc@5*"
+				// Keep the password ACS has if the secret went missing on a reload
+				if password, ok := secrets.Lookup(SubscriberPassword); ok {
+					acsacct.Credentials.Password = password
+				}
 				//acsacct.Credentials.Locked = false
 				acsacct.Labels = []smartrg.ACSLabel{
 					smartrg.ACSLabel{
@@ -117,17 +205,19 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 						BGColour: "#fff",
 					},
 				}
+				timer := metrics.Backend("smartrg", "PutSubscriber")
 				err = smartrg.PutSubscriber(acsacct)
+				timer.Done(&err)
 				if err != nil {
 					log.Errorf("Problem updating subscriber details")
 					result.Result = "Problem updating ACS Subscriber record" + err.Error()
-					kafka.SubmitResult(result)
-
+					Bus.SubmitResult(result)
+					failed = err
 				} else {
 					result.Success = true
 					result.Time = time.Now()
 					result.Result = "Updated ACS subscriber record " + strconv.Itoa(subscriberID)
-					kafka.SubmitResult(result)
+					Bus.SubmitResult(result)
 
 				}
 			}
@@ -136,39 +226,50 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 
 	for _, deviceMAC := range devices {
 		var devicecode int
+		timer := metrics.Backend("smartrg", "NewDevice")
 		devicecode, err := smartrg.NewDevice(deviceMAC, subscriberaccount, "")
+		timer.Done(&err)
 		if err != nil {
 			if err.Error() == "Problem adding device OUI/SN is used by a different device." {
 				log.Info("Device record exists - removing duplicate")
+				timer := metrics.Backend("smartrg", "GetDeviceRecord")
 				record, err := smartrg.GetDeviceRecord(deviceMAC)
+				timer.Done(&err)
 				log.Warnf("Duplicated device record is %v", record)
 				if err != nil {
 					log.Errorf("Problem getting smartRG record for device to delete duplicate %s, %v", deviceMAC, err)
 					result.Result = "Problem getting smartRG record for device to delete duplicate " + deviceMAC + " Error " + err.Error()
-					kafka.SubmitResult(result)
+					Bus.SubmitResult(result)
+					failed = err
 				} else {
 					if len(record) == 1 {
 						devicecode, _ := strconv.ParseInt(record[0].Fields.DeviceID, 10, 32)
 						deviceSubscriberID := record[0].Fields.SubscriberID
 						if deviceSubscriberID == "0" {
 							log.Infof("Deleting device %v from ACS", devicecode)
+							timer := metrics.Backend("smartrg", "RemoveDevice")
 							err = smartrg.RemoveDevice(int(devicecode))
+							timer.Done(&err)
 							if err != nil {
 								log.Errorf("Problem removing device %s - %v", record[0].Fields.DeviceID, err)
+								failed = err
 							} else {
+								timer := metrics.Backend("smartrg", "NewDevice")
 								devicecode, err := smartrg.NewDevice(deviceMAC, subscriberaccount, "")
-								if err != nil {
+								timer.Done(&err)
+								if err == nil {
 									log.Infof("Successfully added device %v to ACS - new code is %v", deviceMAC, devicecode)
 									result.Success = true
 									result.Time = time.Now()
 									result.Result = "Added device " + deviceMAC + " to ACS"
-									kafka.SubmitResult(result)
+									Bus.SubmitResult(result)
 
 								} else {
 									log.Errorf("Problem creating device entry for mac %v, %v", deviceMAC, err)
 									result.Result = "Problem creating device entry for mac " + deviceMAC + " " + err.Error()
 									result.Time = time.Now()
-									kafka.SubmitResult(result)
+									Bus.SubmitResult(result)
+									failed = err
 								}
 							}
 						} else if deviceSubscriberID == strconv.Itoa(subscriberID) {
@@ -176,13 +277,14 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 							result.Result = "Device " + deviceMAC + " already provisioned, skipping"
 							result.Success = true
 							result.Time = time.Now()
-							kafka.SubmitResult(result)
+							Bus.SubmitResult(result)
 
 						} else {
 							log.Errorf("Device with MAC %v is already assigned to subscriber %v", deviceMAC, deviceSubscriberID)
 							result.Result = "Device with MAC " + deviceMAC + " is already assigned to subscriber " + deviceSubscriberID
 							result.Time = time.Now()
-							kafka.SubmitResult(result)
+							Bus.SubmitResult(result)
+							failed = fmt.Errorf("device %v is already assigned to ACS subscriber %v", deviceMAC, deviceSubscriberID)
 						}
 
 					}
@@ -192,16 +294,17 @@ func NewRequest(request telmaxprovision.ProvisionRequest) {
 				log.Errorf("Problem creating device entry for mac %v, %v", deviceMAC, err)
 				result.Result = "Problem creating device entry for mac " + deviceMAC + " " + err.Error()
 				result.Time = time.Now()
-				kafka.SubmitResult(result)
+				Bus.SubmitResult(result)
+				failed = err
 			}
 		} else {
 			log.Infof("Successfully added device %v to ACS - new code is %v", deviceMAC, devicecode)
 			result.Success = true
 			result.Time = time.Now()
 			result.Result = "Added device " + deviceMAC + " to ACS"
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
 		}
 
 	}
-
+	return
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strconv"
+
+	"bitbucket.org/telmaxdc/smartrg"
+	"bitbucket.org/telmaxdc/telmax-common/maxbill"
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	"bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// Report what HandleProvision would do with a request, looking at the ACS without changing it
+func PlanProvision(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
+	log.Infof("Planning provision request %v", request)
+	switch request.RequestType {
+	case telmaxprovision.RequestNew, telmaxprovision.RequestUpdate:
+		PlanNew(request)
+
+	case telmaxprovision.RequestDeviceReturn:
+		PlanDeviceReturn(request)
+
+	case telmaxprovision.RequestSuspend, telmaxprovision.RequestResume:
+		PlanSuspend(request)
+	}
+	return nil
+}
+
+// The ACS subscriber and devices NewRequest would create or update
+func PlanNew(request telmaxprovision.ProvisionRequest) {
+	devices := rgDevices(request)
+	if len(devices) == 0 {
+		return
+	}
+	result := request.NewResult()
+	subscriberaccount := request.AccountCode + request.SubscribeCode
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Problem getting subscriber %v", err)
+		return
+	}
+	name := subscribe.FirstName + " " + subscribe.LastName
+	if subscribe.ACSSubscriber == 0 {
+		Bus.SubmitPlanned(result, "Would create ACS subscriber (%s) for (%s) with login (%s)", subscriberaccount, name, subscribe.Email)
+	} else {
+		Bus.SubmitPlanned(result, "Would update ACS subscriber (%d) with name (%s), login (%s) and label (%s)", subscribe.ACSSubscriber, name, subscribe.Email, subscribe.NetworkType)
+	}
+
+	for _, deviceMAC := range devices {
+		timer := metrics.Backend("smartrg", "GetDeviceRecord")
+		record, err := smartrg.GetDeviceRecord(deviceMAC)
+		timer.Done(&err)
+		if err != nil || len(record) != 1 {
+			Bus.SubmitPlanned(result, "Would add device %s to ACS", deviceMAC)
+			continue
+		}
+		deviceSubscriberID := record[0].Fields.SubscriberID
+		switch {
+		case deviceSubscriberID == "0":
+			Bus.SubmitPlanned(result, "Would replace unassigned ACS record (%s) and add device %s to ACS", record[0].Fields.DeviceID, deviceMAC)
+		case subscribe.ACSSubscriber != 0 && deviceSubscriberID == strconv.Itoa(subscribe.ACSSubscriber):
+			Bus.SubmitPlanned(result, "Device %s already provisioned, would skip", deviceMAC)
+		default:
+			Bus.SubmitPlannedFailure(result, "Would fail - device with MAC %s is already assigned to subscriber %s", deviceMAC, deviceSubscriberID)
+		}
+	}
+}
+
+// The ACS devices DeviceReturn would remove
+func PlanDeviceReturn(request telmaxprovision.ProvisionRequest) {
+	result := request.NewResult()
+	for _, device := range request.Devices {
+		if device.DeviceType != "RG" {
+			continue
+		}
+		timer := metrics.Backend("smartrg", "GetDeviceRecord")
+		record, err := smartrg.GetDeviceRecord(device.Mac)
+		timer.Done(&err)
+		if err != nil {
+			Bus.SubmitPlannedFailure(result, "Problem getting smartRG record for device %s, %v", device.Mac, err)
+		} else if len(record) == 1 {
+			Bus.SubmitPlanned(result, "Would delete device %s (ACS device %s) from ACS", device.Mac, record[0].Fields.DeviceID)
+		} else {
+			Bus.SubmitPlanned(result, "No ACS record for device %s, nothing to delete", device.Mac)
+		}
+	}
+}
+
+// The ACS subscriber SuspendSubscriber would lock or unlock
+func PlanSuspend(request telmaxprovision.ProvisionRequest) {
+	result := request.NewResult()
+	subscribe, err := maxbill.GetSubscribe(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		Bus.SubmitPlannedFailure(result, "Problem getting subscriber %v", err)
+		return
+	}
+	switch {
+	case subscribe.ACSSubscriber == 0:
+		Bus.SubmitPlanned(result, "No ACS subscriber, nothing to %s", request.RequestType)
+	case request.RequestType == telmaxprovision.RequestSuspend:
+		Bus.SubmitPlanned(result, "Would lock ACS subscriber (%d) and label it %s", subscribe.ACSSubscriber, SuspendedLabel)
+	default:
+		Bus.SubmitPlanned(result, "Would unlock ACS subscriber (%d) and remove the %s label", subscribe.ACSSubscriber, SuspendedLabel)
+	}
+}
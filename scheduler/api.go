@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+)
+
+// Consistent response structure - error only exists if there is an error.  Status is always "ok" or "error"
+type Response struct {
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Handle Options pre-flight requests
+func HandleOptions(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+}
+
+// Generate CORS headers for responses
+func CORSHeaders(w http.ResponseWriter, r *http.Request) {
+	headers := w.Header()
+	headers.Add("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, token, api-key")
+	headers.Add("Access-Control-Allow-Methods", "GET, PUT, DELETE, OPTIONS")
+	headers.Add("Access-Control-Allow-Origin", "*")
+}
+
+// Check API Key Authorization
+func CheckAuth(w http.ResponseWriter, r *http.Request) bool {
+	key := secrets.Get("scheduler.apikey", "")
+	if key != "" && r.Header.Get("api-key") == key {
+		return true
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func writeResponse(w http.ResponseWriter, data interface{}, err error) {
+	var response Response
+	if err != nil {
+		response.Status = "error"
+		response.Error = err.Error()
+	} else {
+		response.Status = "ok"
+		response.Data = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GET /scheduled?from=2021-06-01&to=2021-07-01&status=pending&account=ACCT0001&subscribe=SUBS001
+func HandleList(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+	if !CheckAuth(w, r) {
+		return
+	}
+	requestvars := r.URL.Query()
+	filter := bson.D{}
+	effective := bson.D{}
+	for _, bound := range []struct{ name, op string }{{"from", "$gte"}, {"to", "$lt"}} {
+		value := requestvars.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		when, err := parseTime(value)
+		if err != nil {
+			writeResponse(w, nil, err)
+			return
+		}
+		effective = append(effective, bson.E{bound.op, when})
+	}
+	if len(effective) > 0 {
+		filter = append(filter, bson.E{"effective_at", effective})
+	}
+	for param, field := range map[string]string{"status": "status", "account": "account_code", "subscribe": "subscribe_code", "ticket": "request_ticket"} {
+		if value := requestvars.Get(param); value != "" {
+			filter = append(filter, bson.E{field, value})
+		}
+	}
+	limit := int64(*Limit)
+	if value := requestvars.Get("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			writeResponse(w, nil, errors.New("limit must be a positive number"))
+			return
+		}
+		limit = parsed
+	}
+	list, err := FindScheduled(filter, limit)
+	if err != nil {
+		log.Errorf("Problem searching schedule %v - %v", filter, err)
+	}
+	writeResponse(w, list, err)
+}
+
+// GET /scheduled/{requestid}
+func HandleGet(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+	if !CheckAuth(w, r) {
+		return
+	}
+	requestID := mux.Vars(r)["requestid"]
+	scheduled, err := GetScheduled(requestID)
+	if err == mongo.ErrNoDocuments {
+		err = errors.New("No scheduled request with ID " + requestID)
+	}
+	writeResponse(w, scheduled, err)
+}
+
+// PUT /scheduled/{requestid}?at=2021-07-01T08:00:00-04:00
+func HandleReschedule(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+	if !CheckAuth(w, r) {
+		return
+	}
+	requestID := mux.Vars(r)["requestid"]
+	value := r.URL.Query().Get("at")
+	if value == "" {
+		writeResponse(w, nil, errors.New("at is required"))
+		return
+	}
+	when, err := parseTime(value)
+	if err != nil {
+		writeResponse(w, nil, err)
+		return
+	}
+	scheduled, err := Reschedule(requestID, when)
+	if err == nil {
+		log.Infof("Rescheduled request %v for %v", requestID, when)
+	}
+	writeResponse(w, scheduled, err)
+}
+
+// DELETE /scheduled/{requestid}
+func HandleCancel(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+	if !CheckAuth(w, r) {
+		return
+	}
+	requestID := mux.Vars(r)["requestid"]
+	scheduled, err := Cancel(requestID)
+	if err == nil {
+		log.Infof("Cancelled scheduled request %v", requestID)
+	}
+	writeResponse(w, scheduled, err)
+}
+
+// Accept either a full RFC3339 time or a date in local time
+func parseTime(value string) (time.Time, error) {
+	if when, err := time.Parse(time.RFC3339, value); err == nil {
+		return when, nil
+	}
+	when, err := time.ParseInLocation("2006-01-02", value, TZLocation)
+	if err != nil {
+		return when, errors.New("times must be RFC3339 or YYYY-MM-DD - " + value)
+	}
+	return when, nil
+}
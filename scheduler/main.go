@@ -0,0 +1,135 @@
+package main
+
+/*
+	The scheduler holds requests with an EffectiveAt in the future until they are due, then sends them on to
+	provisionrequest.  SubmitRequest sends those requests to provisionrequest.scheduled instead of provisionrequest,
+	and the scheduler keeps them in Mongo until then.  Billing publishes straight to provisionrequest, so the
+	scheduler reads that too and holds the requests there that aren't due yet.  The subsystems park those, and
+	handle them when they are released.  The HTTP API lists the held requests, and cancels or reschedules the ones
+	that haven't been sent yet.
+*/
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"bitbucket.org/telmaxdc/telmax-provision/bootstrap"
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+var (
+	Service = bootstrap.New("scheduler")
+
+	Listen   = flag.String("listen", ":5013", "HTTP API listen address:port")
+	UseTLS   = flag.Bool("tls.enable", false, "Enable TLS")
+	TLSCert  = flag.String("tls.cert", "/etc/ssl/scheduler.crt", "HTTP Server Certificate")
+	TLSKey   = flag.String("tls.key", "/etc/ssl/private/scheduler.key", "HTTP Server private key")
+	Limit    = flag.Int("limit", 100, "Most requests returned by a search unless the limit parameter is given")
+	Interval = flag.Duration("interval", 30*time.Second, "How often to look for requests that are due")
+
+	TZLocation *time.Location
+	CoreDB     *mongo.Database
+	Bus        *kafka.Client // Provisioning topics
+	server     *http.Server
+)
+
+func setup() {
+	bootstrap.Default("kafka.topic", "provisionrequest.scheduled,provisionrequest")
+	bootstrap.Default("health.listen", ":5025")
+	// Everything we consume is early - that's the point
+	Service.Early = true
+	Service.Init()
+	if Service.CoreDB == nil {
+		log.Fatal("Could not connect to the database")
+	}
+	Bus = Service.Bus
+	CoreDB = Service.CoreDB
+	TZLocation = Service.TZLocation
+	InitSchedule(CoreDB)
+}
+
+func main() {
+	setup()
+	Service.Handle(HandleScheduled, telmaxprovision.RequestTypes...)
+	// Dry runs are held like any other request, and planned by the subsystems once they are due
+	Service.HandlePlan(HandleScheduled)
+	Service.HandleMessages(HandleMessage)
+	Service.OnStart(startAPI)
+	Service.OnStart(func(ctx context.Context) error {
+		go releaseLoop(ctx)
+		return nil
+	})
+	Service.OnStop(stopAPI)
+	Service.Run()
+}
+
+// Leave the requests on provisionrequest that are due to the subsystems, and open the rest as usual
+func HandleMessage(ctx context.Context, topic string, timestamp time.Time, data []byte) error {
+	if topic == Bus.ProvisionTopic {
+		request, _, err := telmaxprovision.OpenRequest(data)
+		// The subsystems report requests they can't open or that aren't valid
+		if err != nil || len(request.Validate()) > 0 || request.Due(time.Now().Add(*bootstrap.EarlyTolerance)) {
+			return nil
+		}
+	}
+	return Service.MessageHandler(ctx, topic, timestamp, data)
+}
+
+// Hold a future request until it is due
+func HandleScheduled(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
+	return Hold(request)
+}
+
+// Send requests on as they come due, until the service stops
+func releaseLoop(ctx context.Context) {
+	for {
+		ReleaseDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(*Interval):
+		}
+	}
+}
+
+// Run the web server
+func startAPI(ctx context.Context) error {
+	router := mux.NewRouter().StrictSlash(false)
+	router.Methods("OPTIONS").HandlerFunc(HandleOptions)
+
+	router.HandleFunc("/scheduled", HandleList).Methods("GET")
+	router.HandleFunc("/scheduled/{requestid}", HandleGet).Methods("GET")
+	router.HandleFunc("/scheduled/{requestid}", HandleReschedule).Methods("PUT")
+	router.HandleFunc("/scheduled/{requestid}", HandleCancel).Methods("DELETE")
+
+	server = &http.Server{Addr: *Listen, Handler: router}
+	go func() {
+		var err error
+		if *UseTLS {
+			log.Warning("Listening on " + *Listen + " TLS")
+			err = server.ListenAndServeTLS(*TLSCert, *TLSKey)
+		} else {
+			log.Warning("Listening on " + *Listen)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	return nil
+}
+
+func stopAPI() {
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdown); err != nil {
+		log.Errorf("Problem stopping the web server - %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// Status of a held request
+const (
+	StatusPending   = "pending"   // Waiting until it is due
+	StatusReleasing = "releasing" // Being sent - only seen if we die part way through, and put back to pending on start
+	StatusReleased  = "released"  // Sent to provisionrequest
+	StatusCancelled = "cancelled" // Cancelled over the API before it was due
+)
+
+const ScheduleCollection = "provision_schedule"
+
+// A request being held until it is due
+type ScheduledRequest struct {
+	RequestID     string                           `bson:"request_id"`
+	AccountCode   string                           `bson:"account_code"`
+	SubscribeCode string                           `bson:"subscribe_code"`
+	RequestType   telmaxprovision.RequestType      `bson:"request_type"`
+	RequestTicket string                           `bson:"request_ticket,omitempty"`
+	EffectiveAt   time.Time                        `bson:"effective_at"` // When to send it - replaces the EffectiveAt on the request if rescheduled
+	Status        string                           `bson:"status"`
+	Request       telmaxprovision.ProvisionRequest `bson:"request"` // The request as it was submitted
+	Created       time.Time                        `bson:"created"`
+	Updated       time.Time                        `bson:"updated"`
+	Released      time.Time                        `bson:"released,omitempty"`
+}
+
+var Schedule *mongo.Collection
+
+func InitSchedule(db *mongo.Database) {
+	Schedule = db.Collection(ScheduleCollection)
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{"request_id", 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{"status", 1}, {"effective_at", 1}}},
+		{Keys: bson.D{{"account_code", 1}, {"subscribe_code", 1}}},
+	}
+	_, err := Schedule.Indexes().CreateMany(context.TODO(), indexes)
+	if err != nil {
+		log.Errorf("Problem creating schedule indexes - %v", err)
+	}
+	// Anything we were part way through sending when we stopped gets sent again.  The ledger skips it if it did go.
+	result, err := Schedule.UpdateMany(context.TODO(), bson.D{{"status", StatusReleasing}}, bson.D{{"$set", bson.D{{"status", StatusPending}}}})
+	if err != nil {
+		log.Errorf("Problem resetting requests that were being released - %v", err)
+	} else if result.ModifiedCount > 0 {
+		log.Warnf("%d requests were being released when we stopped - sending them again", result.ModifiedCount)
+	}
+}
+
+// Keep a request until it is due.  A redelivered request leaves the one we have alone, so a cancel or reschedule
+// isn't undone.
+func Hold(request telmaxprovision.ProvisionRequest) error {
+	now := time.Now()
+	scheduled := ScheduledRequest{
+		RequestID:     request.RequestID,
+		AccountCode:   request.AccountCode,
+		SubscribeCode: request.SubscribeCode,
+		RequestType:   request.RequestType,
+		RequestTicket: request.RequestTicket,
+		EffectiveAt:   request.EffectiveAt,
+		Status:        StatusPending,
+		Request:       request,
+		Created:       now,
+		Updated:       now,
+	}
+	opts := options.Update().SetUpsert(true)
+	result, err := Schedule.UpdateOne(context.TODO(), bson.D{{"request_id", request.RequestID}}, bson.D{{"$setOnInsert", scheduled}}, opts)
+	if err != nil {
+		log.Errorf("Problem holding request %v - %v", request.RequestID, err)
+		return err
+	}
+	if result.UpsertedCount > 0 {
+		log.Infof("Holding %v request %v for %v until %v", request.RequestType, request.RequestID, request.Key(), request.EffectiveAt)
+	} else {
+		log.Infof("Already holding request %v", request.RequestID)
+	}
+	return nil
+}
+
+// Look up a held request
+func GetScheduled(requestID string) (scheduled ScheduledRequest, err error) {
+	err = Schedule.FindOne(context.TODO(), bson.D{{"request_id", requestID}}).Decode(&scheduled)
+	return
+}
+
+// Search the held requests, soonest first
+func FindScheduled(filter bson.D, limit int64) (list []ScheduledRequest, err error) {
+	opts := options.Find().SetSort(bson.D{{"effective_at", 1}}).SetLimit(limit)
+	cursor, err := Schedule.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return
+	}
+	list = []ScheduledRequest{}
+	err = cursor.All(context.TODO(), &list)
+	return
+}
+
+// Cancel a request that hasn't been sent yet
+func Cancel(requestID string) (ScheduledRequest, error) {
+	return updatePending(requestID, bson.D{{"status", StatusCancelled}})
+}
+
+// Change when a request that hasn't been sent yet is due.  A time in the past sends it on the next check.
+func Reschedule(requestID string, when time.Time) (ScheduledRequest, error) {
+	return updatePending(requestID, bson.D{{"effective_at", when}})
+}
+
+// Change a request, but only while it is still pending
+func updatePending(requestID string, set bson.D) (scheduled ScheduledRequest, err error) {
+	set = append(set, bson.E{"updated", time.Now()})
+	filter := bson.D{{"request_id", requestID}, {"status", StatusPending}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = Schedule.FindOneAndUpdate(context.TODO(), filter, bson.D{{"$set", set}}, opts).Decode(&scheduled)
+	if err == mongo.ErrNoDocuments {
+		scheduled, err = GetScheduled(requestID)
+		if err == mongo.ErrNoDocuments {
+			return scheduled, errors.New("No scheduled request with ID " + requestID)
+		} else if err == nil {
+			err = errors.New("Request " + requestID + " is already " + scheduled.Status)
+		}
+	}
+	return
+}
+
+// Send every pending request that is due, soonest first
+func ReleaseDue(ctx context.Context) {
+	filter := bson.D{{"status", StatusPending}, {"effective_at", bson.D{{"$lte", time.Now()}}}}
+	due, err := FindScheduled(filter, int64(*Limit))
+	if err != nil {
+		log.Errorf("Problem finding requests that are due - %v", err)
+		return
+	}
+	for _, scheduled := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := release(scheduled); err != nil {
+			log.Errorf("Problem releasing request %v - %v", scheduled.RequestID, err)
+		}
+	}
+}
+
+// Send one request to provisionrequest.  It is claimed first so a cancel that races us either wins or fails.
+func release(scheduled ScheduledRequest) error {
+	filter := bson.D{{"request_id", scheduled.RequestID}, {"status", StatusPending}}
+	claim, err := Schedule.UpdateOne(context.TODO(), filter, bson.D{{"$set", bson.D{{"status", StatusReleasing}}}})
+	if err != nil {
+		return err
+	}
+	if claim.ModifiedCount == 0 {
+		log.Infof("Request %v was changed before it could be released", scheduled.RequestID)
+		return nil
+	}
+	setStatus := func(status string) error {
+		set := bson.D{{"status", status}, {"updated", time.Now()}}
+		if status == StatusReleased {
+			set = append(set, bson.E{"released", time.Now()})
+		}
+		_, err := Schedule.UpdateOne(context.TODO(), bson.D{{"request_id", scheduled.RequestID}}, bson.D{{"$set", set}})
+		return err
+	}
+
+	request := scheduled.Request
+	request.EffectiveAt = scheduled.EffectiveAt
+	// Give it a new sequence number, or anything sent for the subscriber while it was held would make it stale
+	request.Sequence, err = Bus.NextSequence(request.Key())
+	if err == nil {
+		err = Bus.ReleaseRequest(request)
+	}
+	if err != nil {
+		if serr := setStatus(StatusPending); serr != nil {
+			log.Errorf("Problem putting request %v back to pending - %v", scheduled.RequestID, serr)
+		}
+		return err
+	}
+	log.Infof("Released %v request %v for %v due at %v", request.RequestType, request.RequestID, request.Key(), request.EffectiveAt)
+	return setStatus(StatusReleased)
+}
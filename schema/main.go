@@ -0,0 +1,45 @@
+package main
+
+/*
+	Export the JSON Schema for each provisioning message type, so the billing side can validate the messages it
+	produces and consumes against the same contract the provisioning services use.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	OutDir      = flag.String("out", "", "Directory to write schema files to - prints to stdout if empty")
+	MessageType = flag.String("type", "", "Only export this message type (ProvisionRequest, ProvisionResult, ProvisionException)")
+)
+
+func main() {
+	flag.Parse()
+	types := telmaxprovision.MessageTypes()
+	if *MessageType != "" {
+		types = []string{*MessageType}
+	}
+	for _, messageType := range types {
+		schema, err := telmaxprovision.JSONSchema(messageType)
+		if err != nil {
+			log.Fatalf("Problem generating schema for %v - %v", messageType, err)
+		}
+		if *OutDir == "" {
+			fmt.Println(string(schema))
+			continue
+		}
+		filename := filepath.Join(*OutDir, fmt.Sprintf("%s.v%d.schema.json", messageType, telmaxprovision.SchemaVersion))
+		err = os.WriteFile(filename, append(schema, '\n'), 0644)
+		if err != nil {
+			log.Fatalf("Problem writing schema file %v - %v", filename, err)
+		}
+		log.Infof("Wrote %v", filename)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+/*
+	Create and read the encrypted secrets file.  The key is base64, from -key or PROVISION_SECRETS_KEY.
+
+	Make a key:		secretfile -newkey > secrets.key
+	Seal secrets:		secretfile -key secrets.key -seal secrets.json -out secrets.enc
+	Change one:		secretfile -key secrets.key -in secrets.enc -set mcp.password=... -out secrets.enc
+	List the names:		secretfile -key secrets.key -in secrets.enc
+	Show the values:	secretfile -key secrets.key -in secrets.enc -show
+*/
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+)
+
+var (
+	NewKey  = flag.Bool("newkey", false, "Print a new random key")
+	KeyFile = flag.String("key", "", "File holding the key")
+	In      = flag.String("in", "", "Encrypted secrets file to start from")
+	Seal    = flag.String("seal", "", "JSON file of names to values to start from")
+	Set     = flag.String("set", "", "Set a secret - name=value")
+	Delete  = flag.String("delete", "", "Remove a secret")
+	Out     = flag.String("out", "", "Write the encrypted secrets here")
+	Show    = flag.Bool("show", false, "Print the values as well as the names")
+)
+
+func main() {
+	flag.Parse()
+	if *NewKey {
+		key, err := secrets.NewKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	encoded := os.Getenv("PROVISION_SECRETS_KEY")
+	if *KeyFile != "" {
+		data, err := ioutil.ReadFile(*KeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		encoded = string(data)
+	}
+	key, err := secrets.ParseKey(encoded)
+	if err != nil {
+		log.Fatalf("Problem with the key - %v", err)
+	}
+
+	values := map[string]string{}
+	if *In != "" {
+		data, err := ioutil.ReadFile(*In)
+		if err != nil {
+			log.Fatal(err)
+		}
+		values, err = secrets.Open(data, key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *Seal != "" {
+		data, err := ioutil.ReadFile(*Seal)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &values); err != nil {
+			log.Fatalf("Problem reading %s - %v", *Seal, err)
+		}
+	}
+	if *Set != "" {
+		parts := strings.SplitN(*Set, "=", 2)
+		if len(parts) != 2 {
+			log.Fatal("-set needs name=value")
+		}
+		values[parts[0]] = parts[1]
+	}
+	if *Delete != "" {
+		delete(values, *Delete)
+	}
+
+	if *Out != "" {
+		data, err := secrets.Seal(values, key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := ioutil.WriteFile(*Out, data, 0600); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Wrote %d secrets to %s\n", len(values), *Out)
+		return
+	}
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if *Show {
+			fmt.Printf("%s\t%s\n", name, values[name])
+		} else {
+			fmt.Println(name)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package secrets
+
+/*
+	Passwords and keys, kept out of the code and off the command line.  A secret is looked up by name, such as
+	"mcp.password", in these places in order:
+
+	- the environment, as PROVISION_SECRET_ followed by the name in capitals with dots as underscores
+	  (PROVISION_SECRET_MCP_PASSWORD)
+	- a file with the same name as the secret in the -secrets.dir directory, as Docker and Kubernetes mount them
+	- the encrypted file given by -secrets.file, a JSON object of names to values sealed by secretfile
+
+	Secrets are read again on Reload, which Watch calls on SIGHUP, so a new password is used the next time it is
+	looked up without a restart.  Connections that were opened with the old one are left as they are.
+*/
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const EnvPrefix = "PROVISION_SECRET_"
+
+var (
+	Dir     = flag.String("secrets.dir", "/run/secrets", "Directory of secret files, one per secret")
+	File    = flag.String("secrets.file", "", "Encrypted file of secrets - not used when empty")
+	KeyFile = flag.String("secrets.key", "", "Key for the encrypted secrets file - PROVISION_SECRETS_KEY is used when empty")
+
+	mu       sync.RWMutex
+	files    = map[string]string{} // From the secrets directory
+	sealed   = map[string]string{} // From the encrypted file
+	missing  = map[string]bool{}   // Already warned about
+	onReload []func()
+)
+
+// Read the secret files.  Call once the flags are parsed.
+func Load() error {
+	dirSecrets, err := readDir(*Dir)
+	if err != nil {
+		return err
+	}
+	fileSecrets := map[string]string{}
+	if *File != "" {
+		key, err := readKey()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(*File)
+		if err != nil {
+			return err
+		}
+		fileSecrets, err = Open(data, key)
+		if err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	files = dirSecrets
+	sealed = fileSecrets
+	missing = map[string]bool{}
+	mu.Unlock()
+	log.Infof("Loaded %d secrets from %s and %d from the secrets file", len(dirSecrets), *Dir, len(fileSecrets))
+	return nil
+}
+
+// Read the secrets again, keeping the old ones if that fails, then run the reload hooks
+func Reload() error {
+	if err := Load(); err != nil {
+		log.Errorf("Problem reloading secrets - keeping the old ones - %v", err)
+		return err
+	}
+	mu.RLock()
+	hooks := onReload
+	mu.RUnlock()
+	for _, hook := range hooks {
+		hook()
+	}
+	return nil
+}
+
+// Run fn after each successful reload, for anything that has to do more than look the secret up again
+func OnReload(fn func()) {
+	mu.Lock()
+	onReload = append(onReload, fn)
+	mu.Unlock()
+}
+
+// Reload the secrets on SIGHUP until the context is done
+func Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				log.Warning("Reloading secrets")
+				Reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Look up a secret, returning false if no source has it
+func Lookup(name string) (string, bool) {
+	if value, ok := os.LookupEnv(EnvName(name)); ok {
+		return value, true
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if value, ok := files[name]; ok {
+		return value, true
+	}
+	value, ok := sealed[name]
+	return value, ok
+}
+
+// Get a secret, or the fallback if no source has it.  The fallback is for the flags the secrets used to be set by.
+func Get(name string, fallback string) string {
+	if value, ok := Lookup(name); ok {
+		return value
+	}
+	if fallback == "" {
+		mu.Lock()
+		if !missing[name] {
+			log.Warnf("Secret %s is not set", name)
+			missing[name] = true
+		}
+		mu.Unlock()
+	}
+	return fallback
+}
+
+// The environment variable for a secret
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// Read every file in the directory as a secret named after the file.  A missing directory just has no secrets.
+func readDir(dir string) (map[string]string, error) {
+	secrets := map[string]string{}
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return secrets, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		secrets[entry.Name()] = strings.TrimRight(string(data), "\r\n")
+	}
+	return secrets, nil
+}
+
+// The key for the secrets file, base64 encoded in the key file or the environment
+func readKey() ([]byte, error) {
+	encoded := os.Getenv("PROVISION_SECRETS_KEY")
+	if *KeyFile != "" {
+		data, err := ioutil.ReadFile(*KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+	if encoded == "" {
+		return nil, errors.New("no key for the secrets file")
+	}
+	return ParseKey(encoded)
+}
+
+// Decode a base64 AES-256 key
+func ParseKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("the secrets key must be 32 bytes")
+	}
+	return key, nil
+}
+
+// Make a new random key, base64 encoded
+func NewKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Encrypt secrets with AES-256-GCM.  The nonce goes in front of the sealed JSON.
+func Seal(secrets map[string]string, key []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+// Decrypt secrets sealed by Seal
+func Open(data []byte, key []byte) (map[string]string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("secrets file is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt the secrets file - wrong key?")
+	}
+	secrets := map[string]string{}
+	err = json.Unmarshal(plain, &secrets)
+	return secrets, err
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,169 @@
+package telmaxprovision
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The message types carried on the provisioning topics
+const (
+	MessageRequest   = "ProvisionRequest"
+	MessageResult    = "ProvisionResult"
+	MessageException = "ProvisionException"
+)
+
+// The schema version this build of the package writes.  Bump this and add an upgrade function whenever a payload
+// struct changes shape in a way older readers would get wrong.  New fields that can be left empty don't need a bump.
+// Version 0 is a bare, un-enveloped message from before versioning existed.
+const SchemaVersion = 1
+
+// Every message on the provisioning topics is wrapped in an envelope so consumers know what they are reading
+type Envelope struct {
+	SchemaVersion int             // The schema version of the payload
+	MessageType   string          // One of ProvisionRequest, ProvisionResult or ProvisionException
+	Producer      string          // The service that produced the message
+	Time          time.Time       // Time the message was produced
+	Payload       json.RawMessage // The message itself
+}
+
+// Upgrade a payload from one schema version to the next
+type UpgradeFunc func(payload json.RawMessage) (json.RawMessage, error)
+
+// Upgrade functions by message type, keyed by the version they upgrade from
+var Upgrades = map[string]map[int]UpgradeFunc{
+	MessageRequest: {
+		0: upgradeRequestV0,
+	},
+	MessageResult: {
+		0: upgradeNone,
+	},
+	MessageException: {
+		0: upgradeNone,
+	},
+}
+
+// Wrap a payload in an envelope at the current schema version and serialize it
+func Seal(messageType string, producer string, payload interface{}) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(Envelope{
+		SchemaVersion: SchemaVersion,
+		MessageType:   messageType,
+		Producer:      producer,
+		Time:          time.Now(),
+		Payload:       data,
+	})
+}
+
+// Read an envelope of the expected message type and upgrade the payload to the current schema version.
+// Bare messages from producers that don't use envelopes yet are accepted as version 0.
+func Open(data []byte, messageType string) (envelope Envelope, err error) {
+	err = json.Unmarshal(data, &envelope)
+	if err != nil {
+		return
+	}
+	if envelope.Payload == nil {
+		envelope = Envelope{
+			MessageType: bareType(data),
+			Payload:     data,
+		}
+		if envelope.MessageType == "" {
+			err = fmt.Errorf("expected %s message, got a bare message of unknown type", messageType)
+			return
+		}
+	}
+	if envelope.MessageType != messageType {
+		err = fmt.Errorf("expected %s message, got %s", messageType, envelope.MessageType)
+		return
+	}
+	if envelope.SchemaVersion > SchemaVersion {
+		err = fmt.Errorf("%s schema version %d is newer than supported version %d", messageType, envelope.SchemaVersion, SchemaVersion)
+		return
+	}
+	for envelope.SchemaVersion < SchemaVersion {
+		upgrade, ok := Upgrades[messageType][envelope.SchemaVersion]
+		if !ok {
+			err = fmt.Errorf("no upgrade for %s from schema version %d", messageType, envelope.SchemaVersion)
+			return
+		}
+		envelope.Payload, err = upgrade(envelope.Payload)
+		if err != nil {
+			err = fmt.Errorf("upgrading %s from schema version %d - %v", messageType, envelope.SchemaVersion, err)
+			return
+		}
+		envelope.SchemaVersion++
+	}
+	return
+}
+
+// Work out the type of a bare message from a field only that type has
+func bareType(data []byte) string {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return ""
+	}
+	if _, ok := fields["RequestType"]; ok {
+		return MessageRequest
+	}
+	if _, ok := fields["Success"]; ok {
+		return MessageResult
+	}
+	if _, ok := fields["Tag"]; ok {
+		return MessageException
+	}
+	return ""
+}
+
+// Open a provision request message
+func OpenRequest(data []byte) (request ProvisionRequest, envelope Envelope, err error) {
+	envelope, err = Open(data, MessageRequest)
+	if err == nil {
+		err = json.Unmarshal(envelope.Payload, &request)
+	}
+	return
+}
+
+// Open a provision result message
+func OpenResult(data []byte) (result ProvisionResult, envelope Envelope, err error) {
+	envelope, err = Open(data, MessageResult)
+	if err == nil {
+		err = json.Unmarshal(envelope.Payload, &result)
+	}
+	return
+}
+
+// Open a provision exception message
+func OpenException(data []byte) (exception ProvisionException, envelope Envelope, err error) {
+	envelope, err = Open(data, MessageException)
+	if err == nil {
+		err = json.Unmarshal(envelope.Payload, &exception)
+	}
+	return
+}
+
+// Version 0 requests used free-form request types, ie. "Device Swap"
+func upgradeRequestV0(payload json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]interface{}
+	err := json.Unmarshal(payload, &fields)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("payload is not an object")
+	}
+	if value, ok := fields["RequestType"].(string); ok {
+		if requestType, valid := ParseRequestType(value); valid {
+			fields["RequestType"] = string(requestType)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// The payload did not change shape between these versions
+func upgradeNone(payload json.RawMessage) (json.RawMessage, error) {
+	return payload, nil
+}
@@ -0,0 +1,73 @@
+package telmaxprovision
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	request := ProvisionRequest{
+		RequestID:     "req-1",
+		AccountCode:   "ACCT0001",
+		SubscribeCode: "SUBS001",
+		RequestType:   RequestDeviceSwap,
+	}
+	data, err := Seal(MessageRequest, "test", request)
+	if err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+	opened, envelope, err := OpenRequest(data)
+	if err != nil {
+		t.Fatalf("OpenRequest: %v", err)
+	}
+	if envelope.SchemaVersion != SchemaVersion || envelope.Producer != "test" || envelope.MessageType != MessageRequest {
+		t.Errorf("envelope = %+v", envelope)
+	}
+	if opened.RequestID != request.RequestID || opened.RequestType != request.RequestType {
+		t.Errorf("opened %+v, sealed %+v", opened, request)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	envelope := func(version int, messageType string, payload string) string {
+		data, _ := json.Marshal(Envelope{SchemaVersion: version, MessageType: messageType, Payload: json.RawMessage(payload)})
+		return string(data)
+	}
+	tests := []struct {
+		name        string
+		data        string
+		messageType string
+		requestType RequestType
+		err         string // Part of the error, or empty for none
+	}{
+		{"bare v0 request", `{"RequestID":"r1","RequestType":"Device Swap"}`, MessageRequest, RequestDeviceSwap, ""},
+		{"bare result", `{"RequestID":"r1","Success":true}`, MessageRequest, "", "expected ProvisionRequest message, got ProvisionResult"},
+		{"bare exception", `{"RequestID":"r1","Tag":"mcp"}`, MessageRequest, "", "got ProvisionException"},
+		{"bare unknown", `{"RequestID":"r1"}`, MessageRequest, "", "unknown type"},
+		{"v0 envelope", envelope(0, MessageRequest, `{"RequestID":"r1","RequestType":"device-return"}`), MessageRequest, RequestDeviceReturn, ""},
+		{"unknown v0 type kept", envelope(0, MessageRequest, `{"RequestID":"r1","RequestType":"Reboot"}`), MessageRequest, "Reboot", ""},
+		{"current", envelope(SchemaVersion, MessageRequest, `{"RequestID":"r1","RequestType":"New"}`), MessageRequest, RequestNew, ""},
+		{"wrong type", envelope(SchemaVersion, MessageResult, `{"RequestID":"r1"}`), MessageRequest, "", "expected ProvisionRequest"},
+		{"newer version", envelope(SchemaVersion+1, MessageRequest, `{"RequestID":"r1"}`), MessageRequest, "", "newer than supported"},
+		{"not an object", envelope(0, MessageRequest, `[1,2]`), MessageRequest, "", "upgrading"},
+		{"not json", `{`, MessageRequest, "", "unexpected end"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, _, err := OpenRequest([]byte(test.data))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if request.RequestType != test.requestType {
+				t.Errorf("RequestType = %q, want %q", request.RequestType, test.requestType)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package telmaxprovision
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The fields that must be present for a payload to be accepted.  These match what Validate checks for.
+var requiredFields = map[reflect.Type][]string{
+	reflect.TypeOf(ProvisionRequest{}):   {"RequestID", "AccountCode", "SubscribeCode", "RequestType"},
+	reflect.TypeOf(ProvisionProduct{}):   {"ProductCode", "Category"},
+	reflect.TypeOf(ProvisionDevice{}):    {"DeviceCode", "DeviceType"},
+	reflect.TypeOf(ProvisionResult{}):    {"RequestID", "Success", "Time"},
+	reflect.TypeOf(ProvisionException{}): {"RequestID", "System", "Time"},
+}
+
+// Fields that only accept a fixed list of values
+var enumFields = map[reflect.Type]map[string][]string{
+	reflect.TypeOf(ProvisionProduct{}): {"Category": ProductCategories},
+	reflect.TypeOf(ProvisionRequest{}): {"OnFailure": {"", string(FailureRollback), string(FailureCheckpoint)}},
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// The payload struct for each message type
+var messageTypes = map[string]reflect.Type{
+	MessageRequest:   reflect.TypeOf(ProvisionRequest{}),
+	MessageResult:    reflect.TypeOf(ProvisionResult{}),
+	MessageException: reflect.TypeOf(ProvisionException{}),
+}
+
+// The list of message types there is a schema for
+func MessageTypes() []string {
+	return []string{MessageRequest, MessageResult, MessageException}
+}
+
+// Generate a JSON Schema document for the enveloped form of a message type at the current schema version
+func JSONSchema(messageType string) ([]byte, error) {
+	payloadType, ok := messageTypes[messageType]
+	if !ok {
+		return nil, fmt.Errorf("unknown message type %s", messageType)
+	}
+	defs := map[string]interface{}{}
+	payload := schemaFor(payloadType, defs)
+	schema := map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       fmt.Sprintf("%s v%d", messageType, SchemaVersion),
+		"description": fmt.Sprintf("A %s wrapped in the provisioning message envelope", messageType),
+		"type":        "object",
+		"properties": map[string]interface{}{
+			"SchemaVersion": map[string]interface{}{"const": SchemaVersion},
+			"MessageType":   map[string]interface{}{"const": messageType},
+			"Producer":      map[string]interface{}{"type": "string"},
+			"Time":          map[string]interface{}{"type": "string", "format": "date-time"},
+			"Payload":       payload,
+		},
+		"required": []string{"SchemaVersion", "MessageType", "Payload"},
+		"$defs":    defs,
+	}
+	return json.MarshalIndent(schema, "", "  ")
+}
+
+// Build the schema for a type, adding any structs to defs and returning a reference to them
+func schemaFor(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	if t == reflect.TypeOf(RequestType("")) {
+		var values []string
+		for _, requestType := range RequestTypes {
+			values = append(values, string(requestType))
+		}
+		return map[string]interface{}{"type": "string", "enum": values}
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		schema := schemaFor(t.Elem(), defs)
+		return map[string]interface{}{"anyOf": []interface{}{schema, map[string]interface{}{"type": "null"}}}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		// nil slices are written out as null
+		return map[string]interface{}{"type": []string{"array", "null"}, "items": schemaFor(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaFor(t.Elem(), defs)}
+	case reflect.Struct:
+		if _, ok := defs[t.Name()]; !ok {
+			// Reserve the name first in case the struct refers to itself
+			defs[t.Name()] = nil
+			defs[t.Name()] = structSchema(t, defs)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := field.Name
+		if tag := field.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if tagName := strings.Split(tag, ",")[0]; tagName != "" {
+				name = tagName
+			}
+		}
+		property := schemaFor(field.Type, defs)
+		if values, ok := enumFields[t][field.Name]; ok {
+			property["enum"] = values
+		}
+		properties[name] = property
+	}
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if required, ok := requiredFields[t]; ok {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -11,14 +11,48 @@ type ProvisionRequest struct {
 	SubscribeCode string             // The subscribe code for this physical site or subscription
 	SiteID        string             // The identifier for the physical location
 	SubscribeName string             // The name of the subscription
-	RequestType   string             // Valid requests are New, Update, DeviceSwap, DeviceReturn, UnProvision, Cancel
+	RequestType   RequestType        // Valid requests are New, Update, DeviceSwap, DeviceReturn, UnProvision, Cancel, Suspend, Resume
 	RequestTicket string             // The TicketID if the request came from a ticket - used to add actions to tickets.
 	RequestUser   string             //  The user to notify if something went wrong (optional)
 	Products      []ProvisionProduct // A list of products to provision
 	Devices       []ProvisionDevice  // A list of devices to provision
+	Sequence      int64              // Goes up with every request for this subscriber - a lower number than one already handled is stale
+	EffectiveAt   time.Time          // When to act on the request - straight away if empty.  Future requests are held by the scheduler until then.
+	DryRun        bool               // Work out what the request would do and report it as planned results, without changing anything
+	OnFailure     FailurePolicy      // What to do with the steps already done if provisioning fails part way - the subsystem decides when empty
 
 }
 
+// The kinds of request a subsystem can be asked to act on
+type RequestType string
+
+const (
+	RequestNew          RequestType = "New"
+	RequestUpdate       RequestType = "Update"
+	RequestDeviceSwap   RequestType = "DeviceSwap"
+	RequestDeviceReturn RequestType = "DeviceReturn"
+	RequestUnProvision  RequestType = "UnProvision"
+	RequestCancel       RequestType = "Cancel"
+	RequestSuspend      RequestType = "Suspend" // Stop service without removing anything, such as for non-payment
+	RequestResume       RequestType = "Resume"  // Start suspended service again
+)
+
+// What a subsystem does with the steps it has done when a later one fails
+type FailurePolicy string
+
+const (
+	FailureRollback   FailurePolicy = "rollback"   // Undo the steps that were done, latest first
+	FailureCheckpoint FailurePolicy = "checkpoint" // Leave them, and record where we got to so a re-drive carries on from there
+)
+
+// The product categories billing will send us
+const (
+	CategoryInternet = "Internet"
+	CategoryPhone    = "Phone"
+	CategoryTV       = "TV"
+	CategoryPackage  = "Package"
+)
+
 type ProvisionProduct struct {
 	SubProductCode string // The SubProductCode for this instance
 	ProductCode    string // The product definition code that defines the product
@@ -36,15 +70,20 @@ type ProvisionDevice struct {
 
 type ProvisionResult struct {
 	RequestID     string    // Match up this with the request
+	AccountCode   string    // The account code from the request
+	SubscribeCode string    // The subscribe code from the request
 	Reference     string    // A reference to the thing that was provisioned - device code or sub_product_code
 	ReferenceType string    // The name of the field that the reference pertains to
 	Success       bool      // Was it successful
 	Time          time.Time // Time that provisioning completed
 	Result        string    // Human readable text about what the outcome was
+	Planned       bool      // For a dry run - Result says what would be done, and nothing was changed
 }
 
 type ProvisionException struct {
 	RequestID     string    // Match up this with the request
+	AccountCode   string    // The account code from the request
+	SubscribeCode string    // The subscribe code from the request
 	Reference     string    // A reference to the thing that was provisioned - device code or sub_product_code
 	ReferenceType string    // The name of the field that the reference pertains to
 	Time          time.Time // Time that provisioning completed
@@ -54,6 +93,57 @@ type ProvisionException struct {
 	Error         string    // Human readable text about what the outcome was
 }
 
+// The message key for everything about one subscriber, so it all lands on the same partition in order
+func SubscriberKey(accountCode string, subscribeCode string) string {
+	return accountCode + "-" + subscribeCode
+}
+
+func (request ProvisionRequest) Key() string {
+	return SubscriberKey(request.AccountCode, request.SubscribeCode)
+}
+
+// Results from before they carried the account fall back to the RequestID
+func (result ProvisionResult) Key() string {
+	if result.AccountCode == "" {
+		return result.RequestID
+	}
+	return SubscriberKey(result.AccountCode, result.SubscribeCode)
+}
+
+func (exception ProvisionException) Key() string {
+	if exception.AccountCode == "" {
+		return exception.RequestID
+	}
+	return SubscriberKey(exception.AccountCode, exception.SubscribeCode)
+}
+
+// Whether the request can be acted on at this time
+func (request ProvisionRequest) Due(now time.Time) bool {
+	return !request.EffectiveAt.After(now)
+}
+
+// Start a result for this request
+func (request ProvisionRequest) NewResult() ProvisionResult {
+	return ProvisionResult{
+		RequestID:     request.RequestID,
+		AccountCode:   request.AccountCode,
+		SubscribeCode: request.SubscribeCode,
+		Time:          time.Now(),
+		Planned:       request.DryRun,
+	}
+}
+
+// Start an exception for this request
+func (request ProvisionRequest) NewException(system string) ProvisionException {
+	return ProvisionException{
+		RequestID:     request.RequestID,
+		AccountCode:   request.AccountCode,
+		SubscribeCode: request.SubscribeCode,
+		Time:          time.Now(),
+		System:        system,
+	}
+}
+
 /*
 {"RequestID": "08923546y","AccountCode": "ACCT0160","AccountName": "telMAX","SubscribeCode": "SUBS001","SiteID": "093g56","SubscribeName": "Tim St. Pierre","RequestType": "New","RequestUser": "tstpierre"}
 
@@ -1,13 +1,193 @@
 package telmaxprovision
 
 import (
-	"errors"
+	"fmt"
+	"strings"
 )
 
-func (request *ProvisionRequest) CheckValid() error {
-	var err error
+var (
+	// Every request type a subsystem may be asked to handle
+	RequestTypes = []RequestType{
+		RequestNew,
+		RequestUpdate,
+		RequestDeviceSwap,
+		RequestDeviceReturn,
+		RequestUnProvision,
+		RequestCancel,
+		RequestSuspend,
+		RequestResume,
+	}
+	// Every failure policy a request may ask for
+	FailurePolicies = []FailurePolicy{
+		FailureRollback,
+		FailureCheckpoint,
+	}
+	// Every product category we know how to provision
+	ProductCategories = []string{
+		CategoryInternet,
+		CategoryPhone,
+		CategoryTV,
+		CategoryPackage,
+	}
+)
+
+// A single problem found with a provision request
+type FieldError struct {
+	Field   string // The path to the offending field, ie. Devices[1].Mac
+	Value   string // The value that was rejected, if there was one
+	Message string // Human readable text about what is wrong
+}
+
+func (fe FieldError) String() string {
+	if fe.Value != "" {
+		return fmt.Sprintf("%s (%s) %s", fe.Field, fe.Value, fe.Message)
+	}
+	return fe.Field + " " + fe.Message
+}
+
+// Everything that was wrong with a request.  Satisfies the error interface so it can be passed around like one.
+type ValidationErrors []FieldError
+
+func (errs ValidationErrors) Error() string {
+	var text []string
+	for _, fe := range errs {
+		text = append(text, fe.String())
+	}
+	return strings.Join(text, "; ")
+}
+
+// Package up the validation errors so they can be published to the exception topic
+func (errs ValidationErrors) Exception(request ProvisionRequest, system string) ProvisionException {
+	exception := request.NewException(system)
+	exception.Reference = request.RequestID
+	exception.ReferenceType = "RequestID"
+	exception.Tag = "Invalid Request"
+	exception.Error = errs.Error()
+	return exception
+}
+
+// Check the request type against the list of valid types.  Spacing and case are forgiven so the older "Device Swap"
+// spelling still resolves to DeviceSwap.
+func ParseRequestType(value string) (RequestType, bool) {
+	squash := func(s string) string {
+		s = strings.NewReplacer(" ", "", "-", "", "_", "").Replace(s)
+		return strings.ToLower(s)
+	}
+	for _, requestType := range RequestTypes {
+		if squash(value) == squash(string(requestType)) {
+			return requestType, true
+		}
+	}
+	return RequestType(value), false
+}
+
+// Normalize a MAC address to 12 uppercase hex characters with no separators
+func NormalizeMac(mac string) (string, error) {
+	mac = strings.NewReplacer(":", "", "-", "", ".", "", " ", "").Replace(mac)
+	mac = strings.ToUpper(mac)
+	if len(mac) != 12 {
+		return mac, fmt.Errorf("must be 12 hex characters")
+	}
+	for _, c := range mac {
+		if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return mac, fmt.Errorf("contains non-hex character %q", c)
+		}
+	}
+	return mac, nil
+}
+
+// Normalize a serial number - no surrounding space and uppercase
+func NormalizeSerial(serial string) string {
+	return strings.ToUpper(strings.TrimSpace(serial))
+}
+
+// Validate the request and normalize it in place.  Every consumer should run this before dispatching a request,
+// and publish the result as an exception if anything comes back.
+func (request *ProvisionRequest) Validate() ValidationErrors {
+	var errs ValidationErrors
+	require := func(field string, value string) {
+		if strings.TrimSpace(value) == "" {
+			errs = append(errs, FieldError{Field: field, Message: "is required"})
+		}
+	}
+
+	// Results, exceptions, the ledger and the tracker all find the request by it
+	require("RequestID", request.RequestID)
+	request.AccountCode = strings.TrimSpace(request.AccountCode)
+	request.SubscribeCode = strings.TrimSpace(request.SubscribeCode)
+	require("AccountCode", request.AccountCode)
+	require("SubscribeCode", request.SubscribeCode)
+
 	if request.RequestType == "" {
-		err = errors.New("RequestType is required")
+		require("RequestType", "")
+	} else if requestType, ok := ParseRequestType(string(request.RequestType)); ok {
+		request.RequestType = requestType
+	} else {
+		errs = append(errs, FieldError{Field: "RequestType", Value: string(request.RequestType), Message: "is not a valid request type"})
+	}
+
+	if request.OnFailure != "" {
+		policy := FailurePolicy(strings.ToLower(strings.TrimSpace(string(request.OnFailure))))
+		if validPolicy(policy) {
+			request.OnFailure = policy
+		} else {
+			errs = append(errs, FieldError{Field: "OnFailure", Value: string(request.OnFailure), Message: "is not a valid failure policy"})
+		}
+	}
+
+	for i := range request.Products {
+		product := &request.Products[i]
+		field := fmt.Sprintf("Products[%d]", i)
+		require(field+".ProductCode", product.ProductCode)
+		if !validCategory(product.Category) {
+			errs = append(errs, FieldError{Field: field + ".Category", Value: product.Category, Message: "is not a valid product category"})
+		}
+	}
+
+	for i := range request.Devices {
+		device := &request.Devices[i]
+		field := fmt.Sprintf("Devices[%d]", i)
+		require(field+".DeviceCode", device.DeviceCode)
+		require(field+".DeviceType", device.DeviceType)
+		device.Serial = NormalizeSerial(device.Serial)
+		// Some devices are only known by one or the other, but we need something to find it by
+		if device.Mac == "" && device.Serial == "" {
+			errs = append(errs, FieldError{Field: field, Message: "requires a Mac or a Serial"})
+		}
+		if device.Mac != "" {
+			mac, err := NormalizeMac(device.Mac)
+			if err != nil {
+				errs = append(errs, FieldError{Field: field + ".Mac", Value: device.Mac, Message: err.Error()})
+			} else {
+				device.Mac = mac
+			}
+		}
+	}
+	return errs
+}
+
+func validCategory(category string) bool {
+	for _, valid := range ProductCategories {
+		if category == valid {
+			return true
+		}
+	}
+	return false
+}
+
+func validPolicy(policy FailurePolicy) bool {
+	for _, valid := range FailurePolicies {
+		if policy == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// Simple check kept for older callers - see Validate for the full list of problems
+func (request *ProvisionRequest) CheckValid() error {
+	if errs := request.Validate(); len(errs) > 0 {
+		return errs
 	}
-	return err
+	return nil
 }
@@ -0,0 +1,70 @@
+package telmaxprovision
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	valid := func() ProvisionRequest {
+		return ProvisionRequest{
+			RequestID:     "req-1",
+			AccountCode:   "ACCT0001",
+			SubscribeCode: "SUBS001",
+			RequestType:   RequestNew,
+			Products:      []ProvisionProduct{{ProductCode: "PROD0001", Category: CategoryInternet}},
+			Devices:       []ProvisionDevice{{DeviceCode: "DEVI0001", DeviceType: "RG", Mac: "00:0b:03:03:03:03"}},
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(request *ProvisionRequest)
+		fields []string // The fields that should be reported
+	}{
+		{"valid", func(request *ProvisionRequest) {}, nil},
+		{"no request id", func(request *ProvisionRequest) { request.RequestID = " " }, []string{"RequestID"}},
+		{"no codes", func(request *ProvisionRequest) {
+			request.AccountCode = ""
+			request.SubscribeCode = "  "
+		}, []string{"AccountCode", "SubscribeCode"}},
+		{"no type", func(request *ProvisionRequest) { request.RequestType = "" }, []string{"RequestType"}},
+		{"bad type", func(request *ProvisionRequest) { request.RequestType = "Reboot" }, []string{"RequestType"}},
+		{"bad policy", func(request *ProvisionRequest) { request.OnFailure = "ignore" }, []string{"OnFailure"}},
+		{"bad category", func(request *ProvisionRequest) { request.Products[0].Category = "Radio" }, []string{"Products[0].Category"}},
+		{"no product code", func(request *ProvisionRequest) { request.Products[0].ProductCode = "" }, []string{"Products[0].ProductCode"}},
+		{"no mac or serial", func(request *ProvisionRequest) { request.Devices[0].Mac = "" }, []string{"Devices[0]"}},
+		{"bad mac", func(request *ProvisionRequest) { request.Devices[0].Mac = "00:0b:03:03:03:0g" }, []string{"Devices[0].Mac"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := valid()
+			test.change(&request)
+			var fields []string
+			for _, fe := range request.Validate() {
+				fields = append(fields, fe.Field)
+			}
+			if !reflect.DeepEqual(fields, test.fields) {
+				t.Errorf("fields = %v, want %v", fields, test.fields)
+			}
+		})
+	}
+}
+
+func TestValidateNormalizes(t *testing.T) {
+	request := ProvisionRequest{
+		RequestID:     "req-1",
+		AccountCode:   " ACCT0001 ",
+		SubscribeCode: "SUBS001",
+		RequestType:   "device swap",
+		OnFailure:     " Checkpoint",
+		Devices:       []ProvisionDevice{{DeviceCode: "DEVI0001", DeviceType: "ONT", Mac: "00-0b-03-03-03-03", Serial: " adtn1234 "}},
+	}
+	if errs := request.Validate(); len(errs) > 0 {
+		t.Fatalf("Validate: %v", errs)
+	}
+	device := request.Devices[0]
+	if request.AccountCode != "ACCT0001" || request.RequestType != RequestDeviceSwap || request.OnFailure != FailureCheckpoint ||
+		device.Mac != "000B03030303" || device.Serial != "ADTN1234" {
+		t.Errorf("not normalized - %+v", request)
+	}
+}
@@ -6,8 +6,8 @@ package main
 */
 
 import (
-	"bitbucket.org/timstpierre/telmax-provision/kafka"
-	"bitbucket.org/timstpierre/telmax-provision/structs"
+	"bitbucket.org/telmaxdc/telmax-provision/bootstrap"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -46,8 +46,12 @@ func main() {
 		},
 	}
 
+	// Connects to Mongo as well as Kafka, so the requests are numbered from the shared sequence counters
+	service := bootstrap.New("submit")
+	service.Init()
+	bus := service.Bus
 	for iterations > 0 {
-		id, err := kafka.SubmitRequest(request)
+		id, err := bus.SubmitRequest(request)
 		if err != nil {
 			log.Error("Problem submitting request %v", err)
 		}
@@ -55,5 +59,5 @@ func main() {
 		iterations--
 	}
 
-	kafka.Shutdown()
+	service.Close()
 }
@@ -0,0 +1,215 @@
+package tickets
+
+/*
+	Write provisioning progress back to the ticket a request came from.  Every result and exception a subsystem sends
+	while it handles a request with a RequestTicket is added to that ticket as a maxticket action, with the subsystem,
+	the outcome and a link to the request in the tracker, so the CSR can follow along from the ticket.
+
+	bootstrap sets this up for every subsystem - the kafka Client calls Result and Exception as it sends them, and the
+	actions are written in the background.
+*/
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"bitbucket.org/telmaxdc/telmax-common/maxticket"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+var (
+	LinkBase  = flag.String("tickets.link", "https://tracker.telmax.ca:5012/request/", "Link to a request is this followed by the RequestID - no link when empty")
+	Disabled  = flag.Bool("tickets.disable", false, "Don't add provisioning actions to tickets")
+	QueueSize = flag.Int("tickets.queue", 1000, "Actions waiting to be written to tickets before new ones are dropped")
+)
+
+// Who the actions are from, and the type they are filed under
+const (
+	ActionUser = "provisioning"
+	ActionType = "Provisioning"
+)
+
+// How long Stop waits for the queued actions to be written
+var StopTimeout = 10 * time.Second
+
+// A provisioning step to add to a ticket
+type Action struct {
+	Time      time.Time
+	System    string // The subsystem that did it
+	Success   bool   // Exceptions are never a success
+	Alert     bool
+	Text      string
+	RequestID string
+}
+
+// The ticket action for a step, with the subsystem, outcome and a link to the request in the tracker in the note
+func (action Action) TicketAction() maxticket.TicketAction {
+	outcome := "failed"
+	switch {
+	case action.Alert:
+		outcome = "ALERT"
+	case action.Success:
+		outcome = "ok"
+	}
+	note := fmt.Sprintf("%s %s - %s", action.System, outcome, action.Text)
+	if *LinkBase != "" {
+		note += "\n" + *LinkBase + action.RequestID
+	}
+	return maxticket.TicketAction{
+		Time: action.Time,
+		User: ActionUser,
+		Type: ActionType,
+		Note: note,
+	}
+}
+
+type queued struct {
+	ticketID string
+	action   Action
+}
+
+// Adds actions to the tickets of the requests a subsystem is working on.  The actions are written in the background,
+// so a slow ticket database never holds up provisioning.
+type Writer struct {
+	System   string // Recorded on actions for results, which don't say where they came from
+	TicketDB *mongo.Database
+
+	lock    sync.Mutex
+	working map[string]string // RequestID to TicketID
+	queue   chan queued
+	stopped bool // The queue is closed - handlers still running after Stop have their actions dropped
+	done    chan struct{}
+}
+
+// Create a writer and start writing actions as they are queued
+func NewWriter(db *mongo.Database, system string) *Writer {
+	writer := &Writer{
+		System:   system,
+		TicketDB: db,
+		working:  map[string]string{},
+		queue:    make(chan queued, *QueueSize),
+		done:     make(chan struct{}),
+	}
+	go writer.run()
+	return writer
+}
+
+// Start writing back for a request, if it came from a ticket.  Dry runs are left off tickets.
+func (writer *Writer) Open(request telmaxprovision.ProvisionRequest) {
+	if writer == nil || *Disabled || request.RequestTicket == "" || request.DryRun {
+		return
+	}
+	writer.lock.Lock()
+	writer.working[request.RequestID] = request.RequestTicket
+	writer.lock.Unlock()
+}
+
+// Stop writing back for a request once it has been handled.  Actions already queued are still written.
+func (writer *Writer) Close(requestID string) {
+	if writer == nil {
+		return
+	}
+	writer.lock.Lock()
+	delete(writer.working, requestID)
+	writer.lock.Unlock()
+}
+
+// Write the actions still queued and stop, giving up after StopTimeout
+func (writer *Writer) Stop() {
+	if writer == nil {
+		return
+	}
+	writer.lock.Lock()
+	if writer.stopped {
+		writer.lock.Unlock()
+		return
+	}
+	writer.stopped = true
+	close(writer.queue)
+	writer.lock.Unlock()
+	select {
+	case <-writer.done:
+	case <-time.After(StopTimeout):
+		log.Errorf("Gave up writing %d actions to tickets", len(writer.queue))
+	}
+}
+
+// The ticket for a request we are working on
+func (writer *Writer) ticket(requestID string) (string, bool) {
+	if writer == nil {
+		return "", false
+	}
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	ticketID, ok := writer.working[requestID]
+	return ticketID, ok
+}
+
+// Add a result to the ticket of its request
+func (writer *Writer) Result(result telmaxprovision.ProvisionResult) {
+	ticketID, ok := writer.ticket(result.RequestID)
+	if !ok {
+		return
+	}
+	writer.add(ticketID, Action{
+		Time:      result.Time,
+		System:    writer.System,
+		Success:   result.Success,
+		Text:      result.Result,
+		RequestID: result.RequestID,
+	})
+}
+
+// Add an exception to the ticket of its request
+func (writer *Writer) Exception(exception telmaxprovision.ProvisionException) {
+	ticketID, ok := writer.ticket(exception.RequestID)
+	if !ok {
+		return
+	}
+	text := exception.Error
+	if exception.Tag != "" {
+		text = exception.Tag + " - " + text
+	}
+	writer.add(ticketID, Action{
+		Time:      exception.Time,
+		System:    exception.System,
+		Alert:     exception.Alert,
+		Text:      text,
+		RequestID: exception.RequestID,
+	})
+}
+
+// Queue an action for the ticket.  Provisioning carries on if the ticket can't be updated, so a full queue, or one
+// that has been stopped, only drops the action and logs it.
+func (writer *Writer) add(ticketID string, action Action) {
+	if action.Time.IsZero() {
+		action.Time = time.Now()
+	}
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+	if writer.stopped {
+		log.Warnf("Stopped writing to tickets - dropped the action for request %v on ticket %v", action.RequestID, ticketID)
+		return
+	}
+	select {
+	case writer.queue <- queued{ticketID, action}:
+	default:
+		log.Warnf("Too many actions waiting for tickets - dropped the one for request %v on ticket %v", action.RequestID, ticketID)
+	}
+}
+
+// Write queued actions to their tickets until Stop is called
+func (writer *Writer) run() {
+	defer close(writer.done)
+	for item := range writer.queue {
+		err := maxticket.AddTicketAction(writer.TicketDB, item.ticketID, item.action.TicketAction())
+		if err != nil {
+			log.Errorf("Problem adding action for request %v to ticket %v - %v", item.action.RequestID, item.ticketID, err)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package tickets
+
+import (
+	"testing"
+	"time"
+)
+
+// Handlers can still be running after Stop, and their actions are dropped rather than sent on the closed queue
+func TestAddAfterStop(t *testing.T) {
+	writer := NewWriter(nil, "internet")
+	writer.Stop()
+	writer.add("TICK0001", Action{System: "internet", Text: "late", RequestID: "req-1"})
+	writer.Stop()
+	select {
+	case <-writer.done:
+	case <-time.After(time.Second):
+		t.Error("writer did not stop")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+)
+
+// Consistent response structure - error only exists if there is an error.  Status is always "ok" or "error"
+type Response struct {
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+}
+
+// Handle Options pre-flight requests
+func HandleOptions(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+}
+
+// Generate CORS headers for responses
+func CORSHeaders(w http.ResponseWriter, r *http.Request) {
+	headers := w.Header()
+	headers.Add("Access-Control-Allow-Headers", "Content-Type, Origin, Accept, token, api-key")
+	headers.Add("Access-Control-Allow-Methods", "GET, OPTIONS")
+	headers.Add("Access-Control-Allow-Origin", "*")
+}
+
+// Check API Key Authorization
+func CheckAuth(w http.ResponseWriter, r *http.Request) bool {
+	key := secrets.Get("tracker.apikey", *APIKey)
+	if key != "" && r.Header.Get("api-key") == key {
+		return true
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func writeResponse(w http.ResponseWriter, data interface{}, err error) {
+	var response Response
+	if err != nil {
+		response.Status = "error"
+		response.Error = err.Error()
+	} else {
+		response.Status = "ok"
+		response.Data = data
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GET /request/{requestid}
+func HandleRequest(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+	if !CheckAuth(w, r) {
+		return
+	}
+	requestID := mux.Vars(r)["requestid"]
+	tracked, err := GetTracked(requestID)
+	if err == mongo.ErrNoDocuments {
+		err = errors.New("No request found with ID " + requestID)
+	}
+	writeResponse(w, tracked, err)
+}
+
+// GET /account/{accountcode} or /account/{accountcode}/{subscribecode}
+func HandleAccount(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+	if !CheckAuth(w, r) {
+		return
+	}
+	filter := bson.D{{"account_code", mux.Vars(r)["accountcode"]}}
+	if subscribecode := mux.Vars(r)["subscribecode"]; subscribecode != "" {
+		filter = append(filter, bson.E{"subscribe_code", subscribecode})
+	}
+	find(w, r, filter)
+}
+
+// GET /ticket/{ticketid}
+func HandleTicket(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+	if !CheckAuth(w, r) {
+		return
+	}
+	find(w, r, bson.D{{"request_ticket", mux.Vars(r)["ticketid"]}})
+}
+
+// GET /requests?from=2021-06-01&to=2021-06-02T12:00:00-04:00&state=failed
+func HandleRequests(w http.ResponseWriter, r *http.Request) {
+	CORSHeaders(w, r)
+	if !CheckAuth(w, r) {
+		return
+	}
+	requestvars := r.URL.Query()
+	filter := bson.D{}
+	created := bson.D{}
+	for _, bound := range []struct{ name, op string }{{"from", "$gte"}, {"to", "$lt"}} {
+		value := requestvars.Get(bound.name)
+		if value == "" {
+			continue
+		}
+		when, err := parseTime(value)
+		if err != nil {
+			writeResponse(w, nil, err)
+			return
+		}
+		created = append(created, bson.E{bound.op, when})
+	}
+	if len(created) > 0 {
+		filter = append(filter, bson.E{"created", created})
+	}
+	if state := requestvars.Get("state"); state != "" {
+		filter = append(filter, bson.E{"state", state})
+	}
+	find(w, r, filter)
+}
+
+// Run a search, taking the limit from the query string
+func find(w http.ResponseWriter, r *http.Request, filter bson.D) {
+	limit := int64(*Limit)
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 1 {
+			writeResponse(w, nil, errors.New("limit must be a positive number"))
+			return
+		}
+		limit = parsed
+	}
+	list, err := FindTracked(filter, limit)
+	if err != nil {
+		log.Errorf("Problem searching tracker %v - %v", filter, err)
+	}
+	writeResponse(w, list, err)
+}
+
+// Accept either a full RFC3339 time or a date in local time
+func parseTime(value string) (time.Time, error) {
+	if when, err := time.Parse(time.RFC3339, value); err == nil {
+		return when, nil
+	}
+	when, err := time.ParseInLocation("2006-01-02", value, TZLocation)
+	if err != nil {
+		return when, errors.New("times must be RFC3339 or YYYY-MM-DD - " + value)
+	}
+	return when, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+/*
+	The tracker joins the results and exceptions from every subsystem back to the request they belong to, and keeps
+	a document per RequestID with the overall state of the request.  The HTTP API looks them up by RequestID,
+	account/subscribe, ticket or time range.
+*/
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"bitbucket.org/telmaxdc/telmax-common"
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"bitbucket.org/telmaxdc/telmax-provision/kafka"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+var (
+	LogLevel   = flag.String("loglevel", "info", "Log Level")
+	TZLocation *time.Location
+	KafkaTopic = flag.String("kafka.topic", "provisionrequest,provisionresult,provisionexception", "Kafka topics to consume from")
+	KafkaBrk   = flag.String("kafka.brokers", "kf01.dc1.osh.telmax.ca:9092", "Kafka brokers list separated by commas")
+	KafkaGroup = flag.String("kafka.group", "tracker", "Kafka group id")
+	KafkaDLQ   = flag.String("kafka.deadletter", "provisionrequest.dlq", "Kafka topic for messages that could not be handled - empty to disable")
+
+	Listen  = flag.String("listen", ":5012", "HTTP API listen address:port")
+	UseTLS  = flag.Bool("tls.enable", false, "Enable TLS")
+	TLSCert = flag.String("tls.cert", "/etc/ssl/tracker.crt", "HTTP Server Certificate")
+	TLSKey  = flag.String("tls.key", "/etc/ssl/private/tracker.key", "HTTP Server private key")
+	APIKey  = flag.String("apikey", "", "API Key used for simple authentication - deprecated, use the tracker.apikey secret")
+	Limit   = flag.Int("limit", 100, "Most requests returned by a search unless the limit parameter is given")
+
+	MongoURI     = flag.String("mongouri", "mongodb://coredb01.dc1.osh.telmax.ca:27017", "MongoDB URL for telephone database")
+	CoreDatabase = flag.String("coredatabase", "telmaxmb", "Core Database name")
+
+	DBClient *mongo.Client
+	CoreDB   *mongo.Database
+	Bus      *kafka.Client // Provisioning topics
+)
+
+func init() {
+	flag.Parse()
+	lvl, _ := log.ParseLevel(*LogLevel)
+	log.SetLevel(lvl)
+	TZLocation, _ = time.LoadLocation("America/Toronto")
+	if err := secrets.Load(); err != nil {
+		log.Fatalf("Problem loading secrets - %v", err)
+	}
+
+	DBClient = telmax.DBConnect(*MongoURI, "maxcoredb", secrets.Get("mongo.password", ""))
+	if DBClient == nil {
+		log.Fatal("Could not connect to the database")
+	}
+	CoreDB = DBClient.Database(*CoreDatabase)
+	InitTracker(CoreDB)
+
+	brokers := strings.Split(*KafkaBrk, ",")
+	var err error
+	Bus, err = kafka.Connect(brokers)
+	if err != nil {
+		log.Fatalf("Failed to connect to Kafka - %v", err)
+	}
+	Bus.DeadLetterTopic = *KafkaDLQ
+}
+
+func main() {
+	// Stop on a quit signal - the consumer finishes the messages it is on before we close everything
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	secrets.Watch(ctx)
+
+	// Run the web server
+	router := mux.NewRouter().StrictSlash(false)
+	router.Methods("OPTIONS").HandlerFunc(HandleOptions)
+
+	router.HandleFunc("/request/{requestid}", HandleRequest).Methods("GET")
+	router.HandleFunc("/account/{accountcode}", HandleAccount).Methods("GET")
+	router.HandleFunc("/account/{accountcode}/{subscribecode}", HandleAccount).Methods("GET")
+	router.HandleFunc("/ticket/{ticketid}", HandleTicket).Methods("GET")
+	router.HandleFunc("/requests", HandleRequests).Methods("GET")
+
+	server := &http.Server{Addr: *Listen, Handler: router}
+	go func() {
+		var err error
+		if *UseTLS {
+			log.Warning("Listening on " + *Listen + " TLS")
+			err = server.ListenAndServeTLS(*TLSCert, *TLSKey)
+		} else {
+			log.Warning("Listening on " + *Listen)
+			err = server.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	topics := strings.Split(*KafkaTopic, ",")
+	err := Bus.Consume(ctx, topics, *KafkaGroup, MessageHandler)
+	if err != nil {
+		log.Errorf("Consumer stopped - %v", err)
+	}
+	shutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if serr := server.Shutdown(shutdown); serr != nil {
+		log.Errorf("Problem stopping the web server - %v", serr)
+	}
+	AppCleanup()
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// Quit cleanly - close any database connections or other open sockets here.
+func AppCleanup() {
+	log.Error("Stopping Tracker")
+	Bus.Close()
+	DBClient.Disconnect(context.TODO())
+}
+
+func MessageHandler(ctx context.Context, topic string, timestamp time.Time, data []byte) error {
+	log.Debugf("Kafka message %v, %v, %v", topic, timestamp, string(data))
+	switch topic {
+	case "provisionrequest":
+		request, envelope, err := telmaxprovision.OpenRequest(data)
+		if err != nil {
+			return err
+		}
+		return TrackRequest(request, envelope)
+	case "provisionresult":
+		result, envelope, err := telmaxprovision.OpenResult(data)
+		if err != nil {
+			return err
+		}
+		return TrackResult(result, envelope)
+	case "provisionexception":
+		exception, envelope, err := telmaxprovision.OpenException(data)
+		if err != nil {
+			return err
+		}
+		return TrackException(exception, envelope)
+	}
+	return nil
+}
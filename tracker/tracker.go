@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+)
+
+// Overall state of a request
+const (
+	StatePending   = "pending"   // Nothing has reported back yet, or we haven't seen the request
+	StatePartial   = "partial"   // Some things worked, others failed or haven't reported yet
+	StateSucceeded = "succeeded" // Everything in the request was provisioned
+	StateFailed    = "failed"    // Nothing worked
+)
+
+const TrackerCollection = "provision_tracker"
+
+// Everything we have heard about one request
+type TrackedRequest struct {
+	RequestID     string                            `bson:"request_id"`
+	AccountCode   string                            `bson:"account_code,omitempty"`
+	SubscribeCode string                            `bson:"subscribe_code,omitempty"`
+	RequestTicket string                            `bson:"request_ticket,omitempty"`
+	RequestUser   string                            `bson:"request_user,omitempty"`
+	RequestType   telmaxprovision.RequestType       `bson:"request_type,omitempty"`
+	Request       *telmaxprovision.ProvisionRequest `bson:"request,omitempty"` // The original request, once we have seen it
+	Results       []TrackedResult                   `bson:"results"`           // Results from every subsystem, oldest first
+	Exceptions    []TrackedException                `bson:"exceptions"`        // Exceptions from every subsystem, oldest first
+	State         string                            `bson:"state"`
+	Created       time.Time                         `bson:"created"`             // When we first heard about the request
+	Requested     time.Time                         `bson:"requested,omitempty"` // When the request was submitted
+	Updated       time.Time                         `bson:"updated"`             // When we last heard anything about the request
+}
+
+// A result, and which subsystem sent it
+type TrackedResult struct {
+	Producer string                          `bson:"producer"`
+	Result   telmaxprovision.ProvisionResult `bson:"result"`
+}
+
+// An exception, and which subsystem sent it
+type TrackedException struct {
+	Producer  string                             `bson:"producer"`
+	Exception telmaxprovision.ProvisionException `bson:"exception"`
+}
+
+var (
+	Tracker *mongo.Collection
+	// Updates read the document back to work out the state, so don't let two of them overlap
+	trackLock sync.Mutex
+)
+
+func InitTracker(db *mongo.Database) {
+	Tracker = db.Collection(TrackerCollection)
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{"request_id", 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{"account_code", 1}, {"subscribe_code", 1}}},
+		{Keys: bson.D{{"request_ticket", 1}}},
+		{Keys: bson.D{{"created", -1}}},
+	}
+	_, err := Tracker.Indexes().CreateMany(context.TODO(), indexes)
+	if err != nil {
+		log.Errorf("Problem creating tracker indexes - %v", err)
+	}
+}
+
+// Record the original request
+func TrackRequest(request telmaxprovision.ProvisionRequest, envelope telmaxprovision.Envelope) error {
+	set := bson.D{
+		{"account_code", request.AccountCode},
+		{"subscribe_code", request.SubscribeCode},
+		{"request_ticket", request.RequestTicket},
+		{"request_user", request.RequestUser},
+		{"request_type", request.RequestType},
+		{"request", request},
+		{"requested", envelope.Time},
+	}
+	return track(request.RequestID, bson.D{{"$set", set}})
+}
+
+// Add a result from a subsystem
+func TrackResult(result telmaxprovision.ProvisionResult, envelope telmaxprovision.Envelope) error {
+	push := bson.D{{"results", bson.D{
+		{"$each", []TrackedResult{{Producer: envelope.Producer, Result: result}}},
+		{"$sort", bson.D{{"result.time", 1}}},
+	}}}
+	return track(result.RequestID, bson.D{{"$push", push}})
+}
+
+// Add an exception from a subsystem
+func TrackException(exception telmaxprovision.ProvisionException, envelope telmaxprovision.Envelope) error {
+	push := bson.D{{"exceptions", bson.D{
+		{"$each", []TrackedException{{Producer: envelope.Producer, Exception: exception}}},
+		{"$sort", bson.D{{"exception.time", 1}}},
+	}}}
+	return track(exception.RequestID, bson.D{{"$push", push}})
+}
+
+// Apply an update to a request, creating it if this is the first we've heard of it, then work out its state again.
+// Results can turn up before the request does, so any of the three topics may create the document.
+func track(requestID string, update bson.D) error {
+	trackLock.Lock()
+	defer trackLock.Unlock()
+	now := time.Now()
+	update = append(update,
+		bson.E{"$setOnInsert", bson.D{{"created", now}}},
+		bson.E{"$currentDate", bson.D{{"updated", true}}},
+	)
+	filter := bson.D{{"request_id", requestID}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var tracked TrackedRequest
+	err := Tracker.FindOneAndUpdate(context.TODO(), filter, update, opts).Decode(&tracked)
+	if err != nil {
+		log.Errorf("Problem updating tracker for %v - %v", requestID, err)
+		return err
+	}
+	state := tracked.CurrentState()
+	if state != tracked.State {
+		_, err = Tracker.UpdateOne(context.TODO(), filter, bson.D{{"$set", bson.D{{"state", state}}}})
+		if err != nil {
+			log.Errorf("Problem setting state of %v - %v", requestID, err)
+			return err
+		}
+		log.Infof("Request %v is now %v", requestID, state)
+	}
+	return nil
+}
+
+// Something a subsystem told us about one reference in a request
+type outcome struct {
+	reference string
+	success   bool
+	time      time.Time
+}
+
+// Work out the overall state from what the subsystems have told us.  Each product and device in the request should
+// get a result; the latest result or exception for each reference counts, so a retry that works clears an earlier
+// failure.  An exception without a reference is cleared by any later success.  Until the request itself has been
+// seen there is nothing to compare with, so it stays pending.
+func (tracked TrackedRequest) CurrentState() string {
+	if tracked.Request == nil || len(tracked.Results) == 0 && len(tracked.Exceptions) == 0 {
+		return StatePending
+	}
+	var events []outcome
+	for _, result := range tracked.Results {
+		events = append(events, outcome{result.Result.Reference, result.Result.Success, result.Result.Time})
+	}
+	for _, exception := range tracked.Exceptions {
+		events = append(events, outcome{exception.Exception.Reference, false, exception.Exception.Time})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].time.Before(events[j].time) })
+	outcomes := map[string]bool{}
+	for _, event := range events {
+		if event.success {
+			delete(outcomes, "")
+		}
+		outcomes[event.reference] = event.success
+	}
+	var succeeded, failed, outstanding int
+	for _, success := range outcomes {
+		if success {
+			succeeded++
+		} else {
+			failed++
+		}
+	}
+	for _, product := range tracked.Request.Products {
+		if _, ok := outcomes[product.SubProductCode]; !ok {
+			outstanding++
+		}
+	}
+	for _, device := range tracked.Request.Devices {
+		if _, ok := outcomes[device.DeviceCode]; !ok {
+			outstanding++
+		}
+	}
+	switch {
+	case succeeded == 0 && failed > 0:
+		return StateFailed
+	case failed == 0 && outstanding == 0:
+		return StateSucceeded
+	}
+	return StatePartial
+}
+
+// Look up a single request
+func GetTracked(requestID string) (tracked TrackedRequest, err error) {
+	err = Tracker.FindOne(context.TODO(), bson.D{{"request_id", requestID}}).Decode(&tracked)
+	return
+}
+
+// Find requests, newest first
+func FindTracked(filter bson.D, limit int64) (list []TrackedRequest, err error) {
+	opts := options.Find().SetSort(bson.D{{"created", -1}}).SetLimit(limit)
+	cur, err := Tracker.Find(context.TODO(), filter, opts)
+	if err != nil {
+		return
+	}
+	defer cur.Close(context.TODO())
+	list = []TrackedRequest{}
+	err = cur.All(context.TODO(), &list)
+	return
+}
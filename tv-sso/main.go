@@ -12,6 +12,8 @@ import (
 	"os/signal"
 	"syscall"
 	"time"
+
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 )
 
 var (
@@ -33,8 +35,11 @@ func init() {
 	flag.Parse()
 	lvl, _ := log.ParseLevel(*LogLevel)
 	log.SetLevel(lvl)
+	if err := secrets.Load(); err != nil {
+		log.Fatalf("Problem loading secrets - %v", err)
+	}
 
-	DBClient = telmax.DBConnect(*MongoURI, "maxcoredb", "coredbmax955TEL")
+	DBClient = telmax.DBConnect(*MongoURI, "maxcoredb", secrets.Get("mongo.password", ""))
 	if DBClient != nil {
 		CoreDB = DBClient.Database(*CoreDatabase)
 	}
@@ -58,6 +63,8 @@ func main() {
 					AppCleanup()
 					os.Exit(1)
 				} else if s == syscall.SIGHUP {
+					log.Warning("Reloading secrets")
+					secrets.Reload()
 
 				} else {
 
@@ -20,11 +20,13 @@ import (
 
 	//log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/mongo"
+
+	"bitbucket.org/telmaxdc/telmax-provision/metrics"
+	"bitbucket.org/telmaxdc/telmax-provision/secrets"
 )
 
 var (
 	EHusername          string = "telmax_billing"
-	EHpasswd            string = "691DistanceMedium300"
 	EHURL               string = "https://telmax-billing.moxi.com/billing/UpdateAccount/1?MSO=TELMAX"
 	RootCertificatePath        = flag.String("cacert", "/etc/ssl/cert.pem", "Path to the CA certificate")
 
@@ -51,7 +53,8 @@ var (
 */
 //}
 
-func EnghouseRequest(accountdata EngTrans, requestID string) error {
+// The XML document EnghouseRequest sends for an account
+func EnghouseXML(accountdata EngTrans, requestID string) ([]byte, error) {
 	requestdate := time.Now().Format("20060102150405")
 	//log.Debugf("Request date (%v)", requestdate)
 	accountdata.TransId = requestID
@@ -63,6 +66,14 @@ func EnghouseRequest(accountdata EngTrans, requestID string) error {
 			accountdata,
 		},
 	}
+	xmlStr, err := xml.Marshal(transaction)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), xmlStr...), nil
+}
+
+func EnghouseRequest(accountdata EngTrans, requestID string) (err error) {
 	var client http.Client
 	if *EHSkipVerify {
 		tr := &http.Transport{
@@ -88,11 +99,10 @@ func EnghouseRequest(accountdata EngTrans, requestID string) error {
 			},
 		}
 	}
-	xmlStr, err := xml.Marshal(transaction)
+	xmlStr2, err := EnghouseXML(accountdata, requestID)
 	if err != nil {
 		return err
 	}
-	xmlStr2 := append([]byte(xml.Header), xmlStr...)
 	fmt.Println(string(xmlStr2))
 	// Main Server
 	req, err := http.NewRequest("POST", EHURL, bytes.NewBuffer(xmlStr2))
@@ -103,7 +113,8 @@ func EnghouseRequest(accountdata EngTrans, requestID string) error {
 	//    req, err := http.NewRequest("POST", "https://billing-stg.moxi.com/billing/UpdateAccount/1?MSO=TELMAX", bytes.NewBuffer([]byte(myString)))
 	req.Header.Add("Content-Type", "text/plain")
 	//    	req.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
-	req.SetBasicAuth(EHusername, EHpasswd)
+	req.SetBasicAuth(EHusername, secrets.Get("enghouse.password", ""))
+	defer metrics.Backend("enghouse", "UpdateAccount").Done(&err)
 	resp, err := client.Do(req)
 	if err != nil {
 		return err
@@ -119,7 +130,17 @@ func EnghouseRequest(accountdata EngTrans, requestID string) error {
 	return err
 }
 
+// Build the account transaction for a subscribe from billing.  Gives the subscribe a TV user if it doesn't have one.
 func EnghouseAccount(CoreDB *mongo.Database, accountcode string, subscribecode string) (accountdata EngTrans, err error) {
+	return buildAccount(CoreDB, accountcode, subscribecode, true)
+}
+
+// Build the account transaction the same as EnghouseAccount, but without saving anything - for dry runs
+func PlanAccount(CoreDB *mongo.Database, accountcode string, subscribecode string) (accountdata EngTrans, err error) {
+	return buildAccount(CoreDB, accountcode, subscribecode, false)
+}
+
+func buildAccount(CoreDB *mongo.Database, accountcode string, subscribecode string, save bool) (accountdata EngTrans, err error) {
 
 	// Get the subscribe record - this has the essential details in it
 	subscribe, err := maxbill.GetSubscribe(CoreDB, accountcode, subscribecode)
@@ -130,7 +151,7 @@ func EnghouseAccount(CoreDB *mongo.Database, accountcode string, subscribecode s
 		err = errors.New("subscribe not found")
 		return
 	}
-	if subscribe.TVUsername == "" {
+	if subscribe.TVUsername == "" && save {
 		subscribe.AddTVUser()
 		subscribe.Update(CoreDB)
 	}
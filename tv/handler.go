@@ -1,38 +1,46 @@
 package main
 
 import (
+	"context"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"bitbucket.org/telmaxdc/telmax-common/devices"
-	"bitbucket.org/telmaxdc/telmax-provision/kafka"
 	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
 	"bitbucket.org/telmaxdc/telmax-provision/tv/enghouse"
 )
 
 // Determine what sort of request it was
-func HandleProvision(request telmaxprovision.ProvisionRequest) {
+func HandleProvision(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
 	log.Infof("Got provision request %v", request)
 
 	switch request.RequestType {
-	case "New":
+	case telmaxprovision.RequestNew:
 		log.Info("Handling new TV provision request")
-		NewRequest(request)
+		return NewRequest(request)
 
-	case "Update":
-		NewRequest(request)
+	case telmaxprovision.RequestUpdate:
+		return NewRequest(request)
 
-	case "DeviceReturn":
+	case telmaxprovision.RequestDeviceReturn:
 		log.Info("Handling returned devices")
-		DeviceReturn(request)
+		return DeviceReturn(request)
 
-	case "Cancel":
-		CancelRequest(request)
+	case telmaxprovision.RequestCancel:
+		return CancelRequest(request)
+
+	case telmaxprovision.RequestSuspend:
+		return SetAccountStatus(request, "SUSPEND")
+
+	case telmaxprovision.RequestResume:
+		return SetAccountStatus(request, "ACTIVE")
 	}
+	return nil
 }
 
-func DeviceReturn(request telmaxprovision.ProvisionRequest) {
+// Refresh the TV accounts the returned boxes were on.  Every account is tried - the last problem is returned.
+func DeviceReturn(request telmaxprovision.ProvisionRequest) (failed error) {
 	type accountSubscribe struct {
 		AccountCode   string
 		SubscribeCode string
@@ -43,6 +51,7 @@ func DeviceReturn(request telmaxprovision.ProvisionRequest) {
 			deviceData, err := devices.GetDevice(CoreDB, "device_code", device.DeviceCode)
 			if err != nil {
 				log.Errorf("Problem getting device details for code %v - %v", device.DeviceCode, err)
+				failed = err
 			} else {
 				if deviceData.Accountcode != "" && deviceData.Subscribecode != "" {
 					log.Infof("Pushing account %v subscribe %v to accounts to refresh", deviceData.Accountcode, deviceData.Subscribecode)
@@ -62,51 +71,64 @@ func DeviceReturn(request telmaxprovision.ProvisionRequest) {
 		// Run an update on the TV account here - this will trigger a refresh without the STBs
 		log.Infof("Updating TV account %v", tvaccount)
 		accountdata, err := enghouse.EnghouseAccount(CoreDB, tvaccount.AccountCode, tvaccount.SubscribeCode)
-
+		if err != nil {
+			log.Errorf("Problem looking up TV account %v", err)
+			failed = err
+			continue
+		}
 		if len(accountdata.Service) > 0 {
 			err = enghouse.EnghouseRequest(accountdata, request.RequestID)
 			if err != nil {
 				log.Errorf("Problem provisioning TV account %v", err)
+				failed = err
 			}
 		} else {
 			log.Infof("No Enghouse channels for account %v subscribe %v", request.AccountCode, request.SubscribeCode)
 		}
 	}
-
+	return
 }
 
-func NewRequest(request telmaxprovision.ProvisionRequest) {
+func NewRequest(request telmaxprovision.ProvisionRequest) error {
 	accountdata, err := enghouse.EnghouseAccount(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		log.Errorf("Problem looking up TV account %v", err)
+		result := request.NewResult()
+		result.Result = "Problem looking up TV account " + err.Error()
+		Bus.SubmitResult(result)
+		return err
+	}
 	if len(accountdata.Service) > 0 {
 		err = enghouse.EnghouseRequest(accountdata, request.RequestID)
-		result := telmaxprovision.ProvisionResult{
-			RequestID: request.RequestID,
-			Time:      time.Now(),
-		}
+		result := request.NewResult()
 		if err != nil {
 			log.Errorf("Problem provisioning TV account %v", err)
 			result.Result = "Problem provisioning TV Services" + err.Error()
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
 			ResultException(result, "New TV Account", false, err)
-
+			return err
 		} else {
 			result.Success = true
 			result.Result = "Enghouse provisioning accepted"
-			kafka.SubmitResult(result)
+			Bus.SubmitResult(result)
 		}
 	} else {
 		log.Infof("No Enghouse channels for account %v subscribe %v", request.AccountCode, request.SubscribeCode)
 	}
+	return nil
 }
 
-func CancelRequest(request telmaxprovision.ProvisionRequest) {
+func CancelRequest(request telmaxprovision.ProvisionRequest) error {
+	result := request.NewResult()
 	accountdata, err := enghouse.EnghouseAccount(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		log.Errorf("Problem looking up TV account %v", err)
+		result.Result = "Problem looking up TV account " + err.Error()
+		Bus.SubmitResult(result)
+		return err
+	}
 	accountdata.AccountStatus = "REMOVED"
 	err = enghouse.EnghouseRequest(accountdata, request.RequestID)
-	result := telmaxprovision.ProvisionResult{
-		RequestID: request.RequestID,
-		Time:      time.Now(),
-	}
 	if err != nil {
 		log.Errorf("Problem cancelling TV account %v", err)
 		result.Result = "Problem cancelling TV Services" + err.Error()
@@ -114,12 +136,44 @@ func CancelRequest(request telmaxprovision.ProvisionRequest) {
 		result.Success = true
 		result.Result = "Enghouse cancellation accepted"
 	}
-	kafka.SubmitResult(result)
+	Bus.SubmitResult(result)
+	return err
+}
+
+// Suspend or re-activate the Enghouse account, leaving its channels and boxes as they are
+func SetAccountStatus(request telmaxprovision.ProvisionRequest, status string) error {
+	result := request.NewResult()
+	accountdata, err := enghouse.EnghouseAccount(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		log.Errorf("Problem looking up TV account %v", err)
+		result.Result = "Problem looking up TV account " + err.Error()
+		Bus.SubmitResult(result)
+		return err
+	}
+	if len(accountdata.Service) == 0 {
+		log.Infof("No Enghouse channels for account %v subscribe %v", request.AccountCode, request.SubscribeCode)
+		return nil
+	}
+	accountdata.AccountStatus = status
+	err = enghouse.EnghouseRequest(accountdata, request.RequestID)
+	if err != nil {
+		log.Errorf("Problem setting TV account to %v %v", status, err)
+		result.Result = "Problem setting TV Services to " + status + " " + err.Error()
+		Bus.SubmitResult(result)
+		ResultException(result, string(request.RequestType)+" TV Account", false, err)
+		return err
+	}
+	result.Success = true
+	result.Result = "Enghouse " + status + " accepted"
+	Bus.SubmitResult(result)
+	return nil
 }
 
 func ResultException(result telmaxprovision.ProvisionResult, tag string, alert bool, err error) {
 	exception := telmaxprovision.ProvisionException{
 		RequestID:     result.RequestID,
+		AccountCode:   result.AccountCode,
+		SubscribeCode: result.SubscribeCode,
 		Reference:     result.Reference,
 		ReferenceType: result.ReferenceType,
 		Time:          time.Now(),
@@ -128,7 +182,7 @@ func ResultException(result telmaxprovision.ProvisionResult, tag string, alert b
 		Alert:         alert,
 		Error:         tag + " - " + err.Error(),
 	}
-	submiterr := kafka.SubmitException(exception)
+	submiterr := Bus.SubmitException(exception)
 	if submiterr != nil {
 		log.Errorf("Problem submitting exception %v", submiterr)
 	}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+
+	"bitbucket.org/telmaxdc/telmax-common/devices"
+	telmaxprovision "bitbucket.org/telmaxdc/telmax-provision/structs"
+	"bitbucket.org/telmaxdc/telmax-provision/tv/enghouse"
+)
+
+// Report the Enghouse transactions HandleProvision would send for a request, without sending them
+func PlanProvision(ctx context.Context, request telmaxprovision.ProvisionRequest) error {
+	log.Infof("Planning provision request %v", request)
+	switch request.RequestType {
+	case telmaxprovision.RequestNew, telmaxprovision.RequestUpdate:
+		PlanNew(request)
+
+	case telmaxprovision.RequestDeviceReturn:
+		PlanDeviceReturn(request)
+
+	case telmaxprovision.RequestCancel:
+		PlanCancel(request)
+
+	case telmaxprovision.RequestSuspend:
+		PlanStatus(request, "SUSPEND")
+
+	case telmaxprovision.RequestResume:
+		PlanStatus(request, "ACTIVE")
+	}
+	return nil
+}
+
+// Send the XML that would go to Enghouse for an account as a planned result
+func plannedXML(result telmaxprovision.ProvisionResult, accountdata enghouse.EngTrans, requestID string) {
+	xmlData, err := enghouse.EnghouseXML(accountdata, requestID)
+	if err != nil {
+		result.Result = fmt.Sprintf("Problem building Enghouse XML for %s - %v", accountdata.MsoAccountId, err)
+	} else {
+		result.Success = true
+		result.Result = fmt.Sprintf("Would send Enghouse %s for %s:\n%s", accountdata.AccountStatus, accountdata.MsoAccountId, xmlData)
+	}
+	Bus.SubmitResult(result)
+}
+
+func PlanNew(request telmaxprovision.ProvisionRequest) {
+	result := request.NewResult()
+	accountdata, err := enghouse.PlanAccount(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		result.Result = "Problem looking up TV account " + err.Error()
+		Bus.SubmitResult(result)
+		return
+	}
+	if len(accountdata.Service) == 0 {
+		result.Success = true
+		result.Result = fmt.Sprintf("No Enghouse channels for account %v subscribe %v - nothing would be sent", request.AccountCode, request.SubscribeCode)
+		Bus.SubmitResult(result)
+		return
+	}
+	plannedXML(result, accountdata, request.RequestID)
+}
+
+func PlanCancel(request telmaxprovision.ProvisionRequest) {
+	PlanStatus(request, "REMOVED")
+}
+
+// The account as it would be sent with a new status
+func PlanStatus(request telmaxprovision.ProvisionRequest, status string) {
+	result := request.NewResult()
+	accountdata, err := enghouse.PlanAccount(CoreDB, request.AccountCode, request.SubscribeCode)
+	if err != nil {
+		result.Result = "Problem looking up TV account " + err.Error()
+		Bus.SubmitResult(result)
+		return
+	}
+	accountdata.AccountStatus = status
+	plannedXML(result, accountdata, request.RequestID)
+}
+
+// The accounts DeviceReturn would refresh, each without the returned boxes
+func PlanDeviceReturn(request telmaxprovision.ProvisionRequest) {
+	result := request.NewResult()
+	accounts := map[string][2]string{}
+	for _, device := range request.Devices {
+		if device.DeviceType != "TVSetTopBox" {
+			continue
+		}
+		deviceData, err := devices.GetDevice(CoreDB, "device_code", device.DeviceCode)
+		if err != nil {
+			result.Result = fmt.Sprintf("Problem getting device details for code %v - %v", device.DeviceCode, err)
+			Bus.SubmitResult(result)
+		} else if deviceData.Accountcode != "" && deviceData.Subscribecode != "" {
+			accounts[deviceData.Accountcode+deviceData.Subscribecode] = [2]string{deviceData.Accountcode, deviceData.Subscribecode}
+		}
+	}
+	for _, account := range accounts {
+		accountdata, err := enghouse.PlanAccount(CoreDB, account[0], account[1])
+		if err != nil {
+			result.Result = "Problem looking up TV account " + err.Error()
+			Bus.SubmitResult(result)
+			continue
+		}
+		if len(accountdata.Service) > 0 {
+			plannedXML(result, accountdata, request.RequestID)
+		}
+	}
+}